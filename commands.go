@@ -0,0 +1,109 @@
+package main
+
+import (
+	"NexusGateway/config"
+	"NexusGateway/handler"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// runCommand handles one-off CLI commands (go run . <command> [flags]).
+// It returns the process exit code.
+func runCommand(cfg *config.Config, args []string) int {
+	store := handler.GetVectorStore(cfg)
+	if store == nil {
+		log.Println("❌ No vector store configured (set PINECONE_API_KEY or VECTOR_STORE)")
+		return 1
+	}
+
+	switch args[0] {
+	case "cache-import":
+		// go run . cache-import -file faq.jsonl -namespace support
+		fs := flag.NewFlagSet("cache-import", flag.ExitOnError)
+		file := fs.String("file", "", "JSONL file of {\"question\",\"answer\",\"model\"} lines")
+		namespace := fs.String("namespace", cfg.CacheNamespace, "target namespace")
+		pinned := fs.Bool("pinned", false, "never expire or evict the imported entries")
+		fs.Parse(args[1:])
+
+		in, err := openInput(*file)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+		defer in.Close()
+
+		result, err := handler.ImportCacheEntries(context.Background(), cfg, *namespace, in, *pinned)
+		for _, e := range result.Errors {
+			log.Printf("⚠️ %s", e)
+		}
+		if err != nil {
+			log.Printf("❌ Import failed: %v", err)
+			return 1
+		}
+		log.Printf("✅ Imported %d entries (%d failed)", result.Imported, result.Failed)
+
+	case "cache-export":
+		// go run . cache-export -namespace support -out support.snapshot.jsonl
+		fs := flag.NewFlagSet("cache-export", flag.ExitOnError)
+		namespace := fs.String("namespace", cfg.CacheNamespace, "namespace to export")
+		out := fs.String("out", "", "snapshot file (default: stdout)")
+		fs.Parse(args[1:])
+
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Printf("❌ %v", err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+
+		count, err := handler.ExportCacheSnapshot(cfg, *namespace, w)
+		if err != nil {
+			log.Printf("❌ Export failed after %d entries: %v", count, err)
+			return 1
+		}
+		log.Printf("✅ Exported %d entries from namespace %q", count, *namespace)
+
+	case "cache-restore":
+		// go run . cache-restore -file support.snapshot.jsonl [-namespace staging]
+		fs := flag.NewFlagSet("cache-restore", flag.ExitOnError)
+		file := fs.String("file", "", "snapshot file (default: stdin)")
+		namespace := fs.String("namespace", "", "target namespace (default: the snapshot's own)")
+		restamp := fs.Bool("restamp", true, "stamp entries as new, so the TTL starts now")
+		fs.Parse(args[1:])
+
+		in, err := openInput(*file)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+		defer in.Close()
+
+		count, err := handler.RestoreCacheSnapshot(cfg, *namespace, in, *restamp)
+		if err != nil {
+			log.Printf("❌ Restore failed after %d entries: %v", count, err)
+			return 1
+		}
+		log.Printf("✅ Restored %d entries", count)
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (available: cache-import, cache-export, cache-restore)\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// openInput opens a file, or stdin when the path is empty
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
@@ -63,6 +63,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -71,10 +72,130 @@ type Config struct {
 	RedisURL            string
 	PineconeKey         string
 	PineconeHost        string
+	VectorStore         string // "pinecone" (default), "memory" or "off"
+	Embedder            string // Default embedder spec, e.g. "openai" or "ollama:nomic-embed-text"
+	EmbedderNamespaces  map[string]string
+	OllamaHost          string
 	DBUrl               string
 	StripeSecretKey     string
 	StripeWebhookSecret string
 	Port                string
+	AdminKey            string
+
+	// Semantic cache: minimum similarity for a hit, with per-model and
+	// per-key overrides (a key override wins over a model override).
+	CacheThreshold       float64
+	CacheModelThresholds map[string]float64
+	CacheKeyThresholds   map[string]float64
+
+	// Cache namespaces: every key shares CacheNamespace unless mapped to
+	// its own. Entries older than the namespace TTL are ignored and swept.
+	CacheNamespace      string
+	CacheKeyNamespaces  map[string]string
+	CacheTTL            time.Duration
+	CacheNamespaceTTLs  map[string]time.Duration
+	CacheMaxEntries     int
+	CacheSweepInterval  time.Duration
+
+	// Hit verification: the top-K candidates above the threshold are checked
+	// against the new prompt before one is served
+	CacheVerifyTopK       int
+	CacheVerifyNumbers    bool
+	CacheVerifyEntities   bool
+	CacheVerifyMinOverlap float64
+	CacheJudgeModel       string // Empty disables the LLM judge
+
+	// Near-hit adaptation: candidates scoring between CacheAdaptThreshold and
+	// the hit threshold are rewritten by CacheAdaptModel (0 disables)
+	CacheAdaptThreshold float64
+	CacheAdaptModel     string
+
+	// Conversation keys: prior turns included in the cache key, and the
+	// history size past which the semantic tier is skipped
+	CacheContextTurns    int
+	CacheMaxHistoryTurns int
+	CacheMaxKeyChars     int
+
+	// Cache eligibility rules: inline JSON, or a file re-read when it changes
+	CachePolicy     string
+	CachePolicyFile string
+
+	// Keys whose provider call starts alongside the cache lookup ("*" = all)
+	CacheSpeculativeKeys map[string]bool
+
+	// Response feedback: ids stay ratable for the window, and an entry is
+	// evicted once bad ratings outnumber good ones by CacheFeedbackEvictAt (0 = never)
+	CacheFeedbackWindow  time.Duration
+	CacheFeedbackEvictAt int
+
+	// Identical in-flight requests share one upstream call; across instances
+	// a Redis lock elects the caller and others wait up to the timeout
+	CacheCoalesce        bool
+	CacheCoalesceTimeout time.Duration
+
+	// Background cache writes: a bounded queue flushed in batches, with
+	// exponential backoff between retries of a failed upsert
+	CacheWriteQueueSize     int
+	CacheWriteBatchSize     int
+	CacheWriteFlushInterval time.Duration
+	CacheWriteMaxRetries    int
+	CacheWriteRetryBackoff  time.Duration
+
+	// Warm-up imports embed this many prompts per API call, one call per interval
+	CacheImportBatchSize int
+	CacheImportInterval  time.Duration
+
+	// Streams send an SSE comment this often while waiting on output,
+	// so idle proxies don't cut the connection (0 = off)
+	StreamHeartbeatInterval time.Duration
+
+	// Resumable streams: events are buffered in Redis for the window
+	// (0 = off), and a disconnected stream's upstream call keeps running
+	// for the grace period while the client reconnects with Last-Event-ID
+	StreamResumeWindow time.Duration
+	StreamResumeGrace  time.Duration
+
+	// Chat requests one WebSocket connection may run at the same time
+	WSMaxConcurrent int
+
+	// Browser origins allowed to open a WebSocket ("*" = any); empty
+	// allows only the gateway's own host. Clients that send no Origin
+	// (servers, CLIs) are always allowed.
+	WSAllowedOrigins map[string]bool
+
+	// Batch jobs: items processed at once across all jobs, lines and bytes
+	// per upload, and how long an item may run before another worker can
+	// claim it again
+	BatchConcurrency int
+	BatchMaxLines    int
+	BatchMaxBytes    int
+	BatchItemTimeout time.Duration
+
+	// Async requests: how long one may run before another worker retries it,
+	// and how completion callbacks are retried (exponential backoff)
+	AsyncTimeout         time.Duration
+	CallbackMaxAttempts  int
+	CallbackRetryBackoff time.Duration
+
+	// Context windows: requests over the model's limit (minus the reply
+	// reserve) lose their oldest turns, dropped ("truncate"), condensed by
+	// the summary model ("summarize") or left alone ("off"). System prompts
+	// and the latest ContextKeepTurns messages are always kept.
+	ContextStrategy      string
+	ContextKeepTurns     int
+	ContextReserveTokens int
+	ContextSummaryModel  string
+
+	// Pre-flight limits, checked before anything goes upstream: request body
+	// bytes and estimated prompt tokens (0 = no token limit beyond the
+	// context window). Per-key values beat per-plan ("free", "pro") values,
+	// which beat the defaults.
+	RequestMaxBytes       int
+	RequestMaxBytesKeys   map[string]int
+	RequestMaxBytesPlans  map[string]int
+	RequestMaxTokens      int
+	RequestMaxTokensKeys  map[string]int
+	RequestMaxTokensPlans map[string]int
 }
 
 func LoadConfig() *Config {
@@ -93,10 +214,42 @@ func LoadConfig() *Config {
 	stripeKey := get("STRIPE_SECRET_KEY")
 	webhookSecret := get("STRIPE_WEBHOOK_SECRET")
 	port := get("PORT")
+	cacheThreshold := parseFloat(get("CACHE_THRESHOLD"), 0.85)
+	embedder := get("EMBEDDER")
+	ollamaHost := get("OLLAMA_HOST")
 
 	// 2. Validate Critical Keys
-	if apiKey == "" {
-		log.Fatal("Error: OPENAI_API_KEY is not set")
+	// Anthropic-only setups are fine as long as the embedder isn't OpenAI
+	if apiKey == "" && anthropicKey == "" {
+		log.Fatal("Error: set OPENAI_API_KEY or ANTHROPIC_API_KEY")
+	}
+	// Without OpenAI the semantic cache needs an explicit EMBEDDER: a silent
+	// fallback to the hash embedder would serve lexical look-alikes as hits
+	vectorStore := get("VECTOR_STORE")
+	if embedder == "" {
+		embedder = "openai"
+		if apiKey == "" {
+			vectorStore = "off"
+			log.Println("⚠️ Warning: OPENAI_API_KEY is not set and EMBEDDER is not set, semantic cache disabled")
+		}
+	}
+	adaptModel := get("CACHE_ADAPT_MODEL")
+	if adaptModel == "" {
+		adaptModel = "gpt-4o-mini"
+		if apiKey == "" {
+			adaptModel = "claude-3-haiku-20240307"
+		}
+	}
+	summaryModel := get("CONTEXT_SUMMARY_MODEL")
+	if summaryModel == "" {
+		summaryModel = adaptModel
+	}
+	contextStrategy := get("CONTEXT_STRATEGY")
+	if contextStrategy == "" {
+		contextStrategy = "truncate"
+	}
+	if ollamaHost == "" {
+		ollamaHost = "http://localhost:11434"
 	}
 	if dbUrl == "" {
 		log.Println("⚠️ Warning: DB_URL is not set. Auth will fail.")
@@ -112,9 +265,86 @@ func LoadConfig() *Config {
 		RedisURL:            redisURL,
 		PineconeKey:         pineconeKey,
 		PineconeHost:        pineconeHost,
+		VectorStore:         vectorStore,
+		Embedder:            embedder,
+		EmbedderNamespaces:  parseStringMap(get("EMBEDDER_NAMESPACES")),
+		OllamaHost:          ollamaHost,
 		DBUrl:               dbUrl,
 		StripeSecretKey:     stripeKey,
 		StripeWebhookSecret: webhookSecret,
 		Port:                port,
+		AdminKey:            get("ADMIN_API_KEY"),
+
+		CacheThreshold:       cacheThreshold,
+		CacheModelThresholds: parseFloatMap(get("CACHE_THRESHOLD_MODELS")),
+		CacheKeyThresholds:   parseFloatMap(get("CACHE_THRESHOLD_KEYS")),
+
+		CacheNamespace:     get("CACHE_NAMESPACE"),
+		CacheKeyNamespaces: parseStringMap(get("CACHE_NAMESPACE_KEYS")),
+		CacheTTL:           parseDuration(get("CACHE_TTL"), 7*24*time.Hour),
+		CacheNamespaceTTLs: parseDurationMap(get("CACHE_TTL_NAMESPACES")),
+		CacheMaxEntries:    parseInt(get("CACHE_MAX_ENTRIES"), 100000),
+		CacheSweepInterval: parseDuration(get("CACHE_SWEEP_INTERVAL"), 10*time.Minute),
+
+		CacheVerifyTopK:       parseInt(get("CACHE_VERIFY_TOP_K"), 3),
+		CacheVerifyNumbers:    parseBool(get("CACHE_VERIFY_NUMBERS"), true),
+		CacheVerifyEntities:   parseBool(get("CACHE_VERIFY_ENTITIES"), true),
+		CacheVerifyMinOverlap: parseFloat(get("CACHE_VERIFY_MIN_OVERLAP"), 0.25),
+		CacheJudgeModel:       get("CACHE_JUDGE_MODEL"),
+
+		CacheAdaptThreshold: parseFloat(get("CACHE_ADAPT_THRESHOLD"), 0),
+		CacheAdaptModel:     adaptModel,
+
+		CacheContextTurns:    parseInt(get("CACHE_CONTEXT_TURNS"), 4),
+		CacheMaxHistoryTurns: parseInt(get("CACHE_MAX_HISTORY_TURNS"), 10),
+		CacheMaxKeyChars:     parseInt(get("CACHE_MAX_KEY_CHARS"), 6000),
+
+		CachePolicy:     get("CACHE_POLICY"),
+		CachePolicyFile: get("CACHE_POLICY_FILE"),
+
+		CacheSpeculativeKeys: parseStringSet(get("CACHE_SPECULATIVE_KEYS")),
+
+		CacheFeedbackWindow:  parseDuration(get("CACHE_FEEDBACK_WINDOW"), 7*24*time.Hour),
+		CacheFeedbackEvictAt: parseInt(get("CACHE_FEEDBACK_EVICT_AT"), 3),
+
+		CacheCoalesce:        parseBool(get("CACHE_COALESCE"), true),
+		CacheCoalesceTimeout: parseDuration(get("CACHE_COALESCE_TIMEOUT"), 60*time.Second),
+
+		CacheWriteQueueSize:     parseInt(get("CACHE_WRITE_QUEUE_SIZE"), 1000),
+		CacheWriteBatchSize:     parseInt(get("CACHE_WRITE_BATCH_SIZE"), 100),
+		CacheWriteFlushInterval: parseDuration(get("CACHE_WRITE_FLUSH_INTERVAL"), 500*time.Millisecond),
+		CacheWriteMaxRetries:    parseInt(get("CACHE_WRITE_MAX_RETRIES"), 3),
+		CacheWriteRetryBackoff:  parseDuration(get("CACHE_WRITE_RETRY_BACKOFF"), 200*time.Millisecond),
+
+		CacheImportBatchSize: parseInt(get("CACHE_IMPORT_BATCH_SIZE"), 50),
+		CacheImportInterval:  parseDuration(get("CACHE_IMPORT_INTERVAL"), time.Second),
+
+		StreamHeartbeatInterval: parseDuration(get("STREAM_HEARTBEAT_INTERVAL"), 15*time.Second),
+		StreamResumeWindow:      parseDuration(get("STREAM_RESUME_WINDOW"), 2*time.Minute),
+		StreamResumeGrace:       parseDuration(get("STREAM_RESUME_GRACE"), 15*time.Second),
+
+		WSMaxConcurrent:  parseInt(get("WS_MAX_CONCURRENT"), 8),
+		WSAllowedOrigins: parseStringSet(get("WS_ALLOWED_ORIGINS")),
+
+		BatchConcurrency: parseInt(get("BATCH_CONCURRENCY"), 4),
+		BatchMaxLines:    parseInt(get("BATCH_MAX_LINES"), 50000),
+		BatchMaxBytes:    parseInt(get("BATCH_MAX_BYTES"), 64<<20),
+		BatchItemTimeout: parseDuration(get("BATCH_ITEM_TIMEOUT"), 5*time.Minute),
+
+		AsyncTimeout:         parseDuration(get("ASYNC_TIMEOUT"), 10*time.Minute),
+		CallbackMaxAttempts:  parseInt(get("CALLBACK_MAX_ATTEMPTS"), 5),
+		CallbackRetryBackoff: parseDuration(get("CALLBACK_RETRY_BACKOFF"), 2*time.Second),
+
+		ContextStrategy:      contextStrategy,
+		ContextKeepTurns:     parseInt(get("CONTEXT_KEEP_TURNS"), 4),
+		ContextReserveTokens: parseInt(get("CONTEXT_RESERVE_TOKENS"), 1024),
+		ContextSummaryModel:  summaryModel,
+
+		RequestMaxBytes:       parseInt(get("REQUEST_MAX_BYTES"), 1<<20),
+		RequestMaxBytesKeys:   parseIntMap(get("REQUEST_MAX_BYTES_KEYS")),
+		RequestMaxBytesPlans:  parseIntMap(get("REQUEST_MAX_BYTES_PLANS")),
+		RequestMaxTokens:      parseInt(get("REQUEST_MAX_TOKENS"), 0),
+		RequestMaxTokensKeys:  parseIntMap(get("REQUEST_MAX_TOKENS_KEYS")),
+		RequestMaxTokensPlans: parseIntMap(get("REQUEST_MAX_TOKENS_PLANS")),
 	}
-}
\ No newline at end of file
+}
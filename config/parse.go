@@ -0,0 +1,126 @@
+package config
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseFloat reads a float env value, falling back to def when empty or invalid
+func parseFloat(raw string, def float64) float64 {
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("⚠️ Warning: invalid number %q, using %v", raw, def)
+		return def
+	}
+	return v
+}
+
+// parseInt reads an int env value, falling back to def when empty or invalid
+func parseInt(raw string, def int) int {
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("⚠️ Warning: invalid integer %q, using %v", raw, def)
+		return def
+	}
+	return v
+}
+
+// parseBool reads a boolean env value ("true", "1", "false"...), falling back to def
+func parseBool(raw string, def bool) bool {
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("⚠️ Warning: invalid boolean %q, using %v", raw, def)
+		return def
+	}
+	return v
+}
+
+// parseDuration reads a Go duration ("90s", "24h"), falling back to def
+func parseDuration(raw string, def time.Duration) time.Duration {
+	if raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("⚠️ Warning: invalid duration %q, using %v", raw, def)
+		return def
+	}
+	return v
+}
+
+// parseStringMap reads "name=value,other=value" into a map
+func parseStringMap(raw string) map[string]string {
+	out := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return out
+}
+
+// parseFloatMap reads "name=0.9,other=0.8" into a map
+func parseFloatMap(raw string) map[string]float64 {
+	out := map[string]float64{}
+	for name, value := range parseStringMap(raw) {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Printf("⚠️ Warning: invalid value for %q: %q", name, value)
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// parseIntMap reads "name=4000,other=16000" into a map
+func parseIntMap(raw string) map[string]int {
+	out := map[string]int{}
+	for name, value := range parseStringMap(raw) {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("⚠️ Warning: invalid integer for %q: %q", name, value)
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// parseDurationMap reads "news=1h,faq=720h" into a map
+func parseDurationMap(raw string) map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for name, value := range parseStringMap(raw) {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			log.Printf("⚠️ Warning: invalid duration for %q: %q", name, value)
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// parseStringSet reads a comma-separated list ("a,b,c") into a set
+func parseStringSet(raw string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
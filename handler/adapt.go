@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// CacheAdapted marks an answer rewritten from a near-miss cache entry
+const CacheAdapted = "ADAPTED"
+
+var (
+	cacheAdapted      = Counter("nexus_cache_adapted_total", "Near-hits answered by adapting a cached answer")
+	cacheAdaptFailed  = Counter("nexus_cache_adapt_failures_total", "Adaptation calls that failed and fell through to the full model")
+	adaptSystemPrompt = strings.Join([]string{
+		"You adapt a previously written answer to a new request.",
+		"The earlier request was similar but not identical.",
+		"Rewrite the earlier answer so it fully and correctly answers the new request: fix numbers, names and details that differ, and drop anything that no longer applies.",
+		"Reply with the new answer only, without mentioning the earlier one.",
+	}, " ")
+)
+
+// SelectAdaptCandidate returns the best candidate in the adaptation band
+// (above CacheAdaptThreshold) that has a stored prompt and answer. It is
+// used when no candidate could be served as a plain hit.
+func SelectAdaptCandidate(cfg *config.Config, embedderName string, matches []CacheMatch) *CacheMatch {
+	if cfg.CacheAdaptThreshold <= 0 || cfg.CacheAdaptModel == "" {
+		return nil
+	}
+	for i := range matches {
+		match := &matches[i]
+		if match.Score <= cfg.CacheAdaptThreshold {
+			break
+		}
+		if name, _ := match.Metadata["embedder"].(string); name != "" && name != embedderName {
+			continue
+		}
+		prompt, _ := match.Metadata["prompt"].(string)
+		if prompt != "" && match.Answer != "" {
+			return match
+		}
+	}
+	return nil
+}
+
+// AdaptCachedAnswer asks the cheap adaptation model to rewrite a cached
+// answer for the new request (prompt is its cache key text). model and
+// messages describe the full call being avoided, for savings accounting.
+func AdaptCachedAnswer(cfg *config.Config, model string, messages []Message, prompt string, match *CacheMatch) (string, error) {
+	provider, err := GetProvider(cfg.CacheAdaptModel, cfg.OpenAIKey, cfg.AnthropicKey)
+	if err != nil {
+		return "", err
+	}
+
+	cachedPrompt, _ := match.Metadata["prompt"].(string)
+	adaptMessages := []Message{
+		{Role: "system", Content: adaptSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf(
+			"Earlier request:\n%s\n\nEarlier answer:\n%s\n\nNew request:\n%s",
+			cachedPrompt, match.Answer, prompt,
+		)},
+	}
+	answer, err := provider.Send(context.Background(), adaptMessages, SendOptions{})
+	if err == nil && strings.TrimSpace(answer) == "" {
+		err = fmt.Errorf("empty adaptation")
+	}
+	if err != nil {
+		cacheAdaptFailed.Add(1)
+		return "", err
+	}
+	cacheAdapted.Add(1)
+
+	// Costs and savings are booked apart from plain hits
+	adaptCost := EstimateCost(cfg.CacheAdaptModel, CountMessageTokens(cfg.CacheAdaptModel, adaptMessages), CountTokens(cfg.CacheAdaptModel, answer))
+	fullCost := EstimateCost(model, CountMessageTokens(model, messages), CountTokens(model, answer))
+	if client := GetClient(); client != nil {
+		client.Incr(ctx, "stats:cache_adapted")
+		client.IncrBy(ctx, "stats:adapt_cost_micros", usdMicros(adaptCost))
+		client.IncrBy(ctx, "stats:adapt_savings_micros", usdMicros(max(fullCost-adaptCost, 0)))
+	}
+	log.Printf("🪄 Adapted near-hit with %s: cost $%.6f instead of ~$%.6f", cfg.CacheAdaptModel, adaptCost, fullCost)
+	return answer, nil
+}
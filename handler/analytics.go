@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 )
 
@@ -25,4 +26,102 @@ func LogRequest(apiKey string, model string, status int, isCacheHit bool) {
 			log.Printf("⚠️ Analytics Error: %v", err)
 		}
 	}()
-}
\ No newline at end of file
+}
+
+// LogTokenUsage stores the tokens (and list-price cost) of one upstream call
+func LogTokenUsage(apiKey string, model string, usage TokenUsage, status int) {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		query := `
+			INSERT INTO token_usage (api_key, model, prompt_tokens, completion_tokens, estimated, cost_usd, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+		cost := EstimateCost(model, usage.PromptTokens, usage.CompletionTokens)
+		_, err := db.Exec(context.Background(), query, apiKey, model, usage.PromptTokens, usage.CompletionTokens, usage.Estimated, cost, status)
+		if err != nil {
+			log.Printf("⚠️ Usage Log Error: %v", err)
+		}
+	}()
+}
+
+// LogTemplateUse records which template version a request was rendered from
+func LogTemplateUse(apiKey, templateID string, version int, model string) {
+	if db == nil {
+		return
+	}
+
+	go func() {
+		query := `
+			INSERT INTO template_usage (api_key, template_id, version, model)
+			VALUES ($1, $2, $3, $4)
+		`
+		_, err := db.Exec(context.Background(), query, apiKey, templateID, version, model)
+		if err != nil {
+			log.Printf("⚠️ Template Log Error: %v", err)
+		}
+	}()
+}
+
+// LogCacheAudit records an admin action on the cache in the background
+func LogCacheAudit(actor, action, namespace, target string, details map[string]any) {
+	log.Printf("🛡️ Cache Audit: %s %s namespace=%q target=%q %v", actor, action, namespace, target, details)
+	if db == nil {
+		return
+	}
+
+	go func() {
+		detailsJSON, _ := json.Marshal(details)
+		query := `
+			INSERT INTO cache_audit_log (actor, action, namespace, target, details)
+			VALUES ($1, $2, $3, $4, $5)
+		`
+		_, err := db.Exec(context.Background(), query, actor, action, namespace, target, string(detailsJSON))
+		if err != nil {
+			log.Printf("⚠️ Audit Log Error: %v", err)
+		}
+	}()
+}
+// LogCacheBypass records that a cache policy rule kept a request away from
+// the cache, counted per rule in Redis and stored in the background
+func LogCacheBypass(apiKey, model, direction, rule string) {
+	log.Printf("🚫 Cache %s bypassed by policy rule %q (model %s)", direction, rule, model)
+	if client := GetClient(); client != nil {
+		client.Incr(context.Background(), policyBypassKey(rule))
+	}
+	if db == nil {
+		return
+	}
+
+	go func() {
+		query := `
+			INSERT INTO cache_policy_log (api_key, model, direction, rule)
+			VALUES ($1, $2, $3, $4)
+		`
+		_, err := db.Exec(context.Background(), query, apiKey, model, direction, rule)
+		if err != nil {
+			log.Printf("⚠️ Policy Log Error: %v", err)
+		}
+	}()
+}
+
+// LogCacheFeedback stores a client's rating of a response in the background
+func LogCacheFeedback(responseID string, record ResponseRecord, rating, comment string) {
+	log.Printf("🗳️ Feedback %s on %s response %s (score %.2f)", rating, record.Cache, responseID, record.Score)
+	if db == nil {
+		return
+	}
+
+	go func() {
+		query := `
+			INSERT INTO cache_feedback (response_id, api_key, namespace, entry_id, cache_status, score, rating, comment)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`
+		_, err := db.Exec(context.Background(), query, responseID, record.APIKey, record.Logical, record.EntryID, record.Cache, record.Score, rating, comment)
+		if err != nil {
+			log.Printf("⚠️ Feedback Log Error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Async requests ({"async": true} on /api/chat): the request is stored in
+// the async_requests table and answered in the background. The caller polls
+// GET /api/requests/{id}, and a registered callback URL gets the result.
+
+var (
+	asyncRequests = Counter("nexus_async_requests_total", "Chat requests accepted in async mode")
+	asyncFailures = Counter("nexus_async_failures_total", "Async requests that ended in an error")
+
+	asyncRunner struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+
+	// Request headers that change how a chat is answered, kept for the background run
+	asyncForwardedHeaders = []string{"Cache-Control", "X-Nexus-Cache-Threshold", "X-Nexus-Cache-Refresh", "X-Nexus-Tags", "X-Nexus-Context-Strategy"}
+)
+
+// AsyncRequest is what GET /api/requests/{id} returns
+type AsyncRequest struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`                // queued, running, completed, failed
+	StatusCode int               `json:"status_code,omitempty"` // The HTTP status /api/chat would have returned
+	Response   map[string]any    `json:"response,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"` // X-Nexus-* headers
+	Error      string            `json:"error,omitempty"`
+	Callback   *CallbackStatus   `json:"callback,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+// StartAsyncRunner resumes queued requests and pending callbacks now, then
+// every minute (which also retries requests a crashed worker left running)
+func StartAsyncRunner(cfg *config.Config) {
+	asyncRunner.ctx, asyncRunner.cancel = context.WithCancel(context.Background())
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			resumeAsyncRequests(cfg)
+			select {
+			case <-ticker.C:
+			case <-asyncRunner.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// StopAsyncRunner cancels running requests and callback retries and waits
+// for them; whatever is left resumes on the next start
+func StopAsyncRunner(shutdownCtx context.Context) {
+	if asyncRunner.cancel == nil {
+		return
+	}
+	asyncRunner.cancel()
+	done := make(chan struct{})
+	go func() {
+		asyncRunner.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("⏳ Async runner stopped")
+	case <-shutdownCtx.Done():
+		log.Println("⚠️ Async runner stop timed out; unfinished requests resume on restart")
+	}
+}
+
+func resumeAsyncRequests(cfg *config.Config) {
+	rows, err := db.Query(asyncRunner.ctx, `
+		SELECT id FROM async_requests
+		WHERE status = 'queued' OR (status = 'running' AND claimed_at < now() - make_interval(secs => $1))
+		ORDER BY created_at
+	`, cfg.AsyncTimeout.Seconds())
+	if err == nil {
+		var ids []string
+		if ids, err = pgx.CollectRows(rows, pgx.RowTo[string]); err == nil {
+			for _, id := range ids {
+				goAsync(func() { runAsyncRequest(cfg, id) })
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Async resume failed: %v", err)
+	}
+	ResumeCallbacks(cfg)
+}
+
+// goAsync runs fn in the background, tracked for shutdown
+func goAsync(fn func()) {
+	if asyncRunner.ctx == nil || asyncRunner.ctx.Err() != nil {
+		return
+	}
+	asyncRunner.wg.Add(1)
+	go func() {
+		defer asyncRunner.wg.Done()
+		fn()
+	}()
+}
+
+// HandleAsyncChat stores an async /api/chat request and replies 202 with its id
+func HandleAsyncChat(w http.ResponseWriter, r *http.Request, cfg *config.Config, userKey string, userReq ChatRequest) {
+	if db == nil {
+		http.Error(w, "Async requests need the database", http.StatusServiceUnavailable)
+		return
+	}
+	if err := ValidateConversation(userReq.Conversation()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := CheckTextOnly(userReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	model := userReq.Model
+	if model == "" {
+		model = "gpt-3.5-turbo"
+	}
+	if le := LimitsFor(cfg, userKey).CheckTokens(model, userReq.Conversation(), userReq.Tools); le != nil {
+		RefundRequest(userKey)
+		le.Write(w)
+		return
+	}
+
+	headers := map[string]string{}
+	for _, name := range asyncForwardedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	userReq.Async = false
+	request, _ := json.Marshal(userReq)
+	rawHeaders, _ := json.Marshal(headers)
+
+	id := "req_" + GenerateHash(fmt.Sprintf("%s|%d", userKey, time.Now().UnixNano()))[:24]
+	_, err := db.Exec(r.Context(), `
+		INSERT INTO async_requests (id, api_key, status, request, headers)
+		VALUES ($1, $2, 'queued', $3, $4)
+	`, id, userKey, string(request), string(rawHeaders))
+	if err != nil {
+		log.Printf("Async create error: %v", err)
+		http.Error(w, "Failed to queue request", http.StatusInternalServerError)
+		return
+	}
+	asyncRequests.Add(1)
+	log.Printf("⏳ Async request %s queued", id)
+
+	goAsync(func() { runAsyncRequest(cfg, id) })
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"id":     id,
+		"status": "queued",
+		"url":    "/api/requests/" + id,
+	})
+}
+
+// runAsyncRequest claims a request (queued, or abandoned by a dead worker),
+// answers it through the normal chat path and fires the callback
+func runAsyncRequest(cfg *config.Config, id string) {
+	var apiKey, rawReq, rawHeaders string
+	err := db.QueryRow(asyncRunner.ctx, `
+		UPDATE async_requests SET status = 'running', claimed_at = now()
+		WHERE id = $1 AND (status = 'queued' OR (status = 'running' AND claimed_at < now() - make_interval(secs => $2)))
+		RETURNING api_key, request, headers
+	`, id, cfg.AsyncTimeout.Seconds()).Scan(&apiKey, &rawReq, &rawHeaders)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("⚠️ Async request %s: %v", id, err)
+		}
+		return // Another worker has it
+	}
+
+	runCtx, cancel := context.WithTimeout(asyncRunner.ctx, cfg.AsyncTimeout)
+	defer cancel()
+
+	// The credit was charged when the request was accepted
+	var req ChatRequest
+	var headers map[string]string
+	json.Unmarshal([]byte(rawReq), &req)
+	json.Unmarshal([]byte(rawHeaders), &headers)
+	r, _ := http.NewRequestWithContext(runCtx, http.MethodPost, "/api/chat", nil)
+	r.Header.Set("Authorization", "Bearer "+apiKey)
+	for name, v := range headers {
+		r.Header.Set(name, v)
+	}
+
+	recorder := headerRecorder{}
+	text, chatErr := CompleteChat(runCtx, cfg, recorder, r, apiKey, req)
+	if asyncRunner.ctx.Err() != nil {
+		return // Shutting down: retried once the claim goes stale
+	}
+
+	status, statusCode, errMessage := "completed", http.StatusOK, ""
+	var response map[string]any
+	if chatErr != nil {
+		status, statusCode, errMessage = "failed", chatErr.Status, chatErr.Message
+		asyncFailures.Add(1)
+	} else {
+		response = map[string]any{
+			"choices": []map[string]any{
+				{"message": map[string]string{"content": text}},
+			},
+		}
+	}
+	rawResponse, _ := json.Marshal(response)
+	rawResultHeaders, _ := json.Marshal(recorder.values())
+
+	// A callback is due if the key has one registered
+	callbackStatus := ""
+	if cb, _ := LoadCallback(context.Background(), apiKey); cb != nil {
+		callbackStatus = "pending"
+	}
+	_, err = db.Exec(context.Background(), `
+		UPDATE async_requests
+		SET status = $2, status_code = $3, response = $4, result_headers = $5, error = $6,
+			finished_at = now(), callback_status = NULLIF($7, '')
+		WHERE id = $1
+	`, id, status, statusCode, string(rawResponse), string(rawResultHeaders), errMessage, callbackStatus)
+	if err != nil {
+		log.Printf("⚠️ Async request %s: %v", id, err)
+		return
+	}
+	log.Printf("⏳ Async request %s %s", id, status)
+
+	if callbackStatus != "" {
+		DeliverCallback(cfg, id)
+	}
+}
+
+// LoadAsyncRequest returns the request if it belongs to apiKey
+func LoadAsyncRequest(reqCtx context.Context, id, apiKey string) (*AsyncRequest, error) {
+	var req AsyncRequest
+	var owner string
+	var statusCode, attempts *int
+	var response, headers, errMessage, callbackStatus *string
+	err := db.QueryRow(reqCtx, `
+		SELECT id, api_key, status, status_code, response, result_headers, error,
+			callback_status, callback_attempts, created_at, finished_at
+		FROM async_requests WHERE id = $1
+	`, id).Scan(&req.ID, &owner, &req.Status, &statusCode, &response, &headers, &errMessage,
+		&callbackStatus, &attempts, &req.CreatedAt, &req.FinishedAt)
+	if err != nil || owner != apiKey {
+		return nil, fmt.Errorf("request %s not found", id)
+	}
+
+	if statusCode != nil {
+		req.StatusCode = *statusCode
+	}
+	if response != nil {
+		json.Unmarshal([]byte(*response), &req.Response)
+	}
+	if headers != nil {
+		json.Unmarshal([]byte(*headers), &req.Headers)
+	}
+	if errMessage != nil {
+		req.Error = *errMessage
+	}
+	if callbackStatus != nil {
+		req.Callback = &CallbackStatus{Status: *callbackStatus}
+		if attempts != nil {
+			req.Callback.Attempts = *attempts
+		}
+	}
+	return &req, nil
+}
+
+// HandleAsyncRequest (GET /api/requests/{id}) reports an async request.
+// Polling is free; only the key that submitted it can see it.
+func HandleAsyncRequest(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Async requests need the database", http.StatusServiceUnavailable)
+		return
+	}
+	req, err := LoadAsyncRequest(r.Context(), r.PathValue("id"), getAPIKey(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
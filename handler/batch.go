@@ -0,0 +1,561 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Batch jobs: a JSONL upload of chat requests, processed in the background
+// through the same cache and provider path as /api/chat. Jobs and their
+// items live in Postgres (batch_jobs, batch_items), so a restart — or
+// another instance — picks up whatever is left.
+
+var (
+	batchItemsDone   = Counter("nexus_batch_items_total", "Batch items answered")
+	batchItemsFailed = Counter("nexus_batch_item_failures_total", "Batch items that ended in an error")
+
+	batchRunner struct {
+		mu      sync.Mutex
+		ctx     context.Context
+		cancel  context.CancelFunc
+		wg      sync.WaitGroup
+		slots   chan struct{} // BatchConcurrency, shared by every job
+		running map[string]bool
+	}
+)
+
+// batchLineLimit caps one line of an upload even when the key has no byte limit
+const batchLineLimit = 4 << 20
+
+// BatchLine is one line of an upload: a chat request plus an optional
+// caller id echoed in its result
+type BatchLine struct {
+	CustomID string `json:"custom_id,omitempty"`
+	ChatRequest
+}
+
+type BatchJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"` // queued, running, completed
+	Total      int        `json:"total"`
+	Completed  int        `json:"completed"`
+	Failed     int        `json:"failed"`
+	Pending    int        `json:"pending"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// BatchResult is one line of a job's results download
+type BatchResult struct {
+	Line     int               `json:"line"`
+	CustomID string            `json:"custom_id,omitempty"`
+	Status   int               `json:"status"` // The HTTP status /api/chat would have returned
+	Response map[string]any    `json:"response,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"` // X-Nexus-* headers
+	Error    string            `json:"error,omitempty"`
+}
+
+type batchItem struct {
+	Line      int
+	CustomID  string
+	Request   string
+	ClaimedAt time.Time // Identifies this claim: finishing is conditional on it
+	Charged   bool      // A credit is held for the item, possibly by an earlier claim
+}
+
+// StartBatchRunner resumes unfinished jobs now and then rechecks every
+// minute, which also recovers items left behind by a crashed worker
+func StartBatchRunner(cfg *config.Config) {
+	batchRunner.ctx, batchRunner.cancel = context.WithCancel(context.Background())
+	batchRunner.slots = make(chan struct{}, max(cfg.BatchConcurrency, 1))
+	batchRunner.running = map[string]bool{}
+	if db == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			resumeBatchJobs(cfg)
+			select {
+			case <-ticker.C:
+			case <-batchRunner.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// StopBatchRunner stops claiming items and waits for the ones in progress.
+// Items it interrupts are claimed again once BatchItemTimeout passes.
+func StopBatchRunner(shutdownCtx context.Context) {
+	if batchRunner.cancel == nil {
+		return
+	}
+	batchRunner.cancel()
+	done := make(chan struct{})
+	go func() {
+		batchRunner.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("📦 Batch runner stopped")
+	case <-shutdownCtx.Done():
+		log.Println("⚠️ Batch runner stop timed out; unfinished items resume on restart")
+	}
+}
+
+func resumeBatchJobs(cfg *config.Config) {
+	rows, err := db.Query(batchRunner.ctx, "SELECT id FROM batch_jobs WHERE status IN ('queued', 'running') ORDER BY created_at")
+	if err != nil {
+		log.Printf("⚠️ Batch resume failed: %v", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Printf("⚠️ Batch resume failed: %v", err)
+		return
+	}
+	for _, id := range ids {
+		runBatchJob(cfg, id)
+	}
+}
+
+// runBatchJob processes a job in the background unless this instance already is
+func runBatchJob(cfg *config.Config, id string) {
+	batchRunner.mu.Lock()
+	defer batchRunner.mu.Unlock()
+	if batchRunner.ctx == nil || batchRunner.ctx.Err() != nil || batchRunner.running[id] {
+		return
+	}
+	batchRunner.running[id] = true
+	batchRunner.wg.Add(1)
+
+	go func() {
+		defer func() {
+			batchRunner.mu.Lock()
+			delete(batchRunner.running, id)
+			batchRunner.mu.Unlock()
+			batchRunner.wg.Done()
+		}()
+		processBatchJob(cfg, id)
+	}()
+}
+
+// processBatchJob claims pending items a page at a time and runs each in a
+// shared concurrency slot. Claims are atomic, so instances can share a job.
+func processBatchJob(cfg *config.Config, id string) {
+	runCtx := batchRunner.ctx
+	var apiKey string
+	err := db.QueryRow(runCtx, "UPDATE batch_jobs SET status = 'running' WHERE id = $1 AND status <> 'completed' RETURNING api_key", id).Scan(&apiKey)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("⚠️ Batch %s: %v", id, err)
+		}
+		return
+	}
+	log.Printf("📦 Processing batch %s", id)
+
+	var items sync.WaitGroup
+	for runCtx.Err() == nil {
+		claimed, err := claimBatchItems(runCtx, id, cap(batchRunner.slots), cfg.BatchItemTimeout)
+		if err != nil {
+			log.Printf("⚠️ Batch %s: %v", id, err)
+			break
+		}
+		if len(claimed) == 0 {
+			break
+		}
+		for _, item := range claimed {
+			select {
+			case batchRunner.slots <- struct{}{}:
+			case <-runCtx.Done():
+				items.Wait()
+				return
+			}
+			items.Add(1)
+			go func(item batchItem) {
+				defer func() {
+					<-batchRunner.slots
+					items.Done()
+				}()
+				processBatchItem(cfg, id, apiKey, item)
+			}(item)
+		}
+	}
+	items.Wait()
+	if runCtx.Err() != nil {
+		return
+	}
+
+	// Done once nothing is pending or claimed (possibly by another instance)
+	tag, err := db.Exec(context.Background(), `
+		UPDATE batch_jobs SET status = 'completed', finished_at = now()
+		WHERE id = $1 AND status <> 'completed'
+		AND NOT EXISTS (SELECT 1 FROM batch_items WHERE job_id = $1 AND status IN ('pending', 'running'))
+	`, id)
+	if err != nil {
+		log.Printf("⚠️ Batch %s: %v", id, err)
+	} else if tag.RowsAffected() > 0 {
+		log.Printf("✅ Batch %s completed", id)
+	}
+}
+
+// claimBatchItems marks up to limit items as running: pending ones, and ones
+// whose worker hasn't finished within timeout (it died)
+func claimBatchItems(runCtx context.Context, id string, limit int, timeout time.Duration) ([]batchItem, error) {
+	rows, err := db.Query(runCtx, `
+		UPDATE batch_items SET status = 'running', claimed_at = now()
+		WHERE job_id = $1 AND line IN (
+			SELECT line FROM batch_items
+			WHERE job_id = $1 AND (status = 'pending' OR (status = 'running' AND claimed_at < now() - make_interval(secs => $3)))
+			ORDER BY line LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING line, custom_id, request, claimed_at, charged
+	`, id, limit, timeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (batchItem, error) {
+		var item batchItem
+		err := row.Scan(&item.Line, &item.CustomID, &item.Request, &item.ClaimedAt, &item.Charged)
+		return item, err
+	})
+}
+
+// chargeBatchItem takes a credit for a claimed item if the key has one left.
+// The quota check and the increment are one conditional UPDATE, so items
+// running side by side can't overdraw the quota, and the item is marked in
+// the same transaction, so a crash can't charge it twice.
+func chargeBatchItem(runCtx context.Context, jobID, apiKey string, item batchItem) (bool, error) {
+	tx, err := db.Begin(runCtx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(runCtx)
+
+	tag, err := tx.Exec(runCtx, "UPDATE users SET requests_used = requests_used + 1 WHERE api_key = $1 AND requests_used < request_limit", apiKey)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+	tag, err = tx.Exec(runCtx, `
+		UPDATE batch_items SET charged = true
+		WHERE job_id = $1 AND line = $2 AND status = 'running' AND claimed_at = $3
+	`, jobID, item.Line, item.ClaimedAt)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err // Claim lost: the new claim charges
+	}
+	return true, tx.Commit(runCtx)
+}
+
+// processBatchItem answers one line like a /api/chat request from the
+// job's key: it costs a credit, but isn't subject to the IP rate limit.
+// The credit is taken when the item is claimed and stays with the item, so
+// an item re-claimed after a timeout reuses it instead of paying twice. A
+// failed item gets its credit back.
+func processBatchItem(cfg *config.Config, jobID, apiKey string, item batchItem) {
+	itemCtx, cancel := context.WithTimeout(batchRunner.ctx, cfg.BatchItemTimeout)
+	defer cancel()
+
+	result := BatchResult{Line: item.Line, CustomID: item.CustomID}
+	var chargeErr error
+	if !item.Charged {
+		item.Charged, chargeErr = chargeBatchItem(itemCtx, jobID, apiKey, item)
+	}
+	var req ChatRequest
+	if chargeErr != nil {
+		log.Printf("DB Error: %v", chargeErr)
+		result.Status, result.Error = http.StatusInternalServerError, "Server Error"
+	} else if !item.Charged {
+		result.Status, result.Error = http.StatusPaymentRequired, "402 - Quota Exceeded. Upgrade your plan."
+	} else if err := json.Unmarshal([]byte(item.Request), &req); err != nil {
+		result.Status, result.Error = http.StatusBadRequest, "Invalid request body"
+	} else {
+		r, _ := http.NewRequestWithContext(itemCtx, http.MethodPost, "/api/chat", nil)
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+		headers := headerRecorder{}
+		text, chatErr := CompleteChat(itemCtx, cfg, headers, r, apiKey, req)
+		if batchRunner.ctx.Err() != nil {
+			return // Shutting down: the item is claimed again after a restart
+		}
+		result.Headers = headers.values()
+		if chatErr != nil {
+			result.Status, result.Error = chatErr.Status, chatErr.Message
+		} else {
+			result.Status = http.StatusOK
+			result.Response = map[string]any{
+				"choices": []map[string]any{
+					{"message": map[string]string{"content": text}},
+				},
+			}
+		}
+	}
+
+	itemStatus, counter := "done", "completed"
+	if result.Status != http.StatusOK {
+		itemStatus, counter = "failed", "failed"
+	}
+	raw, _ := json.Marshal(result)
+
+	// Finish the item only if this claim still holds it; the job counter
+	// and a failed item's refund move in the same statement, so neither can
+	// happen twice
+	tag, err := db.Exec(context.Background(), `
+		WITH finished AS (
+			UPDATE batch_items SET status = $3, result = $4
+			WHERE job_id = $1 AND line = $2 AND status = 'running' AND claimed_at = $5
+			RETURNING charged
+		), refunded AS (
+			UPDATE users SET requests_used = requests_used - 1
+			WHERE api_key = $6 AND $3 = 'failed' AND EXISTS (SELECT 1 FROM finished WHERE charged)
+		)
+		UPDATE batch_jobs SET `+counter+` = `+counter+` + 1
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM finished)
+	`, jobID, item.Line, itemStatus, string(raw), item.ClaimedAt, apiKey)
+	if err != nil {
+		log.Printf("⚠️ Batch %s line %d: %v", jobID, item.Line, err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		log.Printf("⚠️ Batch %s line %d: claim lost to another worker, result dropped", jobID, item.Line)
+		return
+	}
+	if itemStatus == "done" {
+		batchItemsDone.Add(1)
+	} else {
+		batchItemsFailed.Add(1)
+	}
+}
+
+// HandleCreateBatch (POST /api/batches) stores a JSONL upload as a job
+func HandleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	userKey := getAPIKey(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db == nil {
+		http.Error(w, "Batch jobs need the database", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 1. Parse and validate every line before anything is stored; the key's
+	// pre-flight limits apply to each line as if it were its own request.
+	// The body as a whole is capped at BatchMaxBytes by AuthMiddleware.
+	limits := LimitsFor(cfg, userKey)
+	lineLimit := batchLineLimit
+	if limits.MaxBytes > 0 {
+		lineLimit = min(lineLimit, limits.MaxBytes)
+	}
+	templates := map[string]*PromptTemplate{} // Each version used is loaded once
+	var items []batchItem
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), lineLimit+1) // +1 so a line at the limit still fits with its newline
+	lineNo := 1
+	for ; scanner.Scan(); lineNo++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var line BatchLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			http.Error(w, fmt.Sprintf("line %d: invalid JSON: %v", lineNo, err), http.StatusBadRequest)
+			return
+		}
+		line.TemplateUsed = nil // Only Apply sets it
+		if ref := line.Template; ref != nil {
+			key := fmt.Sprintf("%s@%d", ref.ID, ref.Version)
+			t, ok := templates[key]
+			if !ok {
+				if ref.ID == "" {
+					http.Error(w, fmt.Sprintf("line %d: template.id is required", lineNo), http.StatusBadRequest)
+					return
+				}
+				var err error
+				if t, err = LoadTemplate(r.Context(), ref.ID, ref.Version); err != nil {
+					http.Error(w, fmt.Sprintf("line %d: %v", lineNo, err), http.StatusBadRequest)
+					return
+				}
+				templates[key] = t
+			}
+			if err := t.Apply(&line.ChatRequest); err != nil {
+				http.Error(w, fmt.Sprintf("line %d: %v", lineNo, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := ValidateConversation(line.Conversation()); err != nil {
+			http.Error(w, fmt.Sprintf("line %d: %v", lineNo, err), http.StatusBadRequest)
+			return
+		}
+		if err := CheckTextOnly(line.ChatRequest); err != nil {
+			http.Error(w, fmt.Sprintf("line %d: %v", lineNo, err), http.StatusBadRequest)
+			return
+		}
+		model := line.Model
+		if model == "" {
+			model = "gpt-3.5-turbo"
+		}
+		le := limits.CheckBytes(len(raw))
+		if le == nil {
+			le = limits.CheckTokens(model, line.Conversation(), line.Tools)
+		}
+		if le != nil {
+			RefundRequest(userKey)
+			le.Message = fmt.Sprintf("line %d: %s", lineNo, le.Message)
+			le.Write(w)
+			return
+		}
+		if len(items) >= cfg.BatchMaxLines {
+			RefundRequest(userKey)
+			batchLinesError(cfg, lineNo).Write(w)
+			return
+		}
+		request, _ := json.Marshal(line.ChatRequest)
+		items = append(items, batchItem{Line: lineNo, CustomID: line.CustomID, Request: string(request)})
+	}
+	if err := scanner.Err(); err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			RefundRequest(userKey)
+			batchBytesError(cfg, 0).Write(w)
+		case errors.Is(err, bufio.ErrTooLong):
+			RefundRequest(userKey)
+			le := limits.bytesError(0)
+			if limits.MaxBytes <= 0 || lineLimit < limits.MaxBytes {
+				le = &LimitError{
+					Type: "request_too_large", Code: "max_request_bytes", Message: fmt.Sprintf("over the %d byte line limit", lineLimit),
+					Limit: lineLimit, Scope: "default",
+				}
+			}
+			le.Message = fmt.Sprintf("line %d: %s", lineNo, le.Message)
+			le.Write(w)
+		default:
+			http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Upload contains no requests", http.StatusBadRequest)
+		return
+	}
+
+	// 2. Store the job and its items in one transaction
+	id := "batch_" + GenerateHash(fmt.Sprintf("%s|%d", userKey, time.Now().UnixNano()))[:20]
+	if err := storeBatchJob(r.Context(), id, userKey, items); err != nil {
+		log.Printf("Batch create error: %v", err)
+		http.Error(w, "Failed to store batch", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("📦 Batch %s queued (%d requests)", id, len(items))
+
+	runBatchJob(cfg, id)
+	writeJSON(w, http.StatusAccepted, BatchJob{ID: id, Status: "queued", Total: len(items), Pending: len(items), CreatedAt: time.Now()})
+}
+
+func storeBatchJob(reqCtx context.Context, id, apiKey string, items []batchItem) error {
+	tx, err := db.Begin(reqCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(reqCtx)
+
+	if _, err := tx.Exec(reqCtx, "INSERT INTO batch_jobs (id, api_key, status, total) VALUES ($1, $2, 'queued', $3)", id, apiKey, len(items)); err != nil {
+		return err
+	}
+	const chunk = 500
+	for start := 0; start < len(items); start += chunk {
+		batch := &pgx.Batch{}
+		for _, item := range items[start:min(start+chunk, len(items))] {
+			batch.Queue("INSERT INTO batch_items (job_id, line, custom_id, request, status) VALUES ($1, $2, $3, $4, 'pending')", id, item.Line, item.CustomID, item.Request)
+		}
+		if err := tx.SendBatch(reqCtx, batch).Close(); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(reqCtx)
+}
+
+// loadBatchJob returns the job if it belongs to apiKey
+func loadBatchJob(reqCtx context.Context, id, apiKey string) (*BatchJob, error) {
+	var job BatchJob
+	var owner string
+	err := db.QueryRow(reqCtx, `
+		SELECT id, api_key, status, total, completed, failed, created_at, finished_at
+		FROM batch_jobs WHERE id = $1
+	`, id).Scan(&job.ID, &owner, &job.Status, &job.Total, &job.Completed, &job.Failed, &job.CreatedAt, &job.FinishedAt)
+	if err != nil || owner != apiKey {
+		return nil, fmt.Errorf("batch %s not found", id)
+	}
+	job.Pending = job.Total - job.Completed - job.Failed
+	return &job, nil
+}
+
+// HandleBatch (GET /api/batches/{id}) reports a job's progress. Polling is
+// free; only the job's own key can see it.
+func HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Batch jobs need the database", http.StatusServiceUnavailable)
+		return
+	}
+	job, err := loadBatchJob(r.Context(), r.PathValue("id"), getAPIKey(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// HandleBatchResults (GET /api/batches/{id}/results) streams the finished
+// lines as JSONL in upload order. ?only=errors keeps the failed ones.
+func HandleBatchResults(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Batch jobs need the database", http.StatusServiceUnavailable)
+		return
+	}
+	id := r.PathValue("id")
+	if _, err := loadBatchJob(r.Context(), id, getAPIKey(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	statuses := []string{"done", "failed"}
+	if r.URL.Query().Get("only") == "errors" {
+		statuses = []string{"failed"}
+	}
+	rows, err := db.Query(r.Context(), "SELECT result FROM batch_items WHERE job_id = $1 AND status = ANY($2) ORDER BY line", id, statuses)
+	if err != nil {
+		http.Error(w, "Failed to read results", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+"_results.jsonl"))
+	out := bufio.NewWriter(w)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			log.Printf("Batch results error: %v", err)
+			break
+		}
+		out.WriteString(result)
+		out.WriteByte('\n')
+	}
+	out.Flush()
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// useTestDB points db at a fresh schema in the Postgres named by TEST_DB_URL,
+// with a users table and the migrations applied. Without TEST_DB_URL the
+// test is skipped.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DB_URL")
+	if url == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	schema := "nexus_test_" + newFlightToken()[:12]
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("parse TEST_DB_URL: %v", err)
+	}
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema
+	poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		t.Fatalf("connect pool: %v", err)
+	}
+	t.Cleanup(func() {
+		db = nil
+		pool.Close()
+		admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close(ctx)
+	})
+
+	// The users table predates the migrations
+	schemaSQL := []string{`CREATE TABLE users (
+		id            serial  PRIMARY KEY,
+		email         text    NOT NULL DEFAULT '',
+		api_key       text    UNIQUE NOT NULL,
+		requests_used integer NOT NULL DEFAULT 0,
+		request_limit integer NOT NULL DEFAULT 100
+	)`}
+	files, _ := filepath.Glob("../migrations/*.sql")
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read %s: %v", file, err)
+		}
+		schemaSQL = append(schemaSQL, string(raw))
+	}
+	for _, sql := range schemaSQL {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			t.Fatalf("schema: %v", err)
+		}
+	}
+	db = pool
+}
+
+func seedBatchUser(t *testing.T, apiKey string, used, limit int) {
+	t.Helper()
+	if _, err := db.Exec(ctx, "INSERT INTO users (api_key, requests_used, request_limit) VALUES ($1, $2, $3)", apiKey, used, limit); err != nil {
+		t.Fatalf("seed user: %v", err)
+	}
+}
+
+// seedBatchJob stores a job of n lines that fail without an upstream call
+func seedBatchJob(t *testing.T, id, apiKey string, n int) {
+	t.Helper()
+	items := make([]batchItem, n)
+	for i := range items {
+		items[i] = batchItem{Line: i + 1, Request: `"not a chat request"`}
+	}
+	if err := storeBatchJob(ctx, id, apiKey, items); err != nil {
+		t.Fatalf("store job: %v", err)
+	}
+}
+
+func requestsUsed(t *testing.T, apiKey string) int {
+	t.Helper()
+	var used int
+	if err := db.QueryRow(ctx, "SELECT requests_used FROM users WHERE api_key = $1", apiKey).Scan(&used); err != nil {
+		t.Fatalf("read usage: %v", err)
+	}
+	return used
+}
+
+func lines(items []batchItem) []int {
+	out := make([]int, len(items))
+	for i, item := range items {
+		out[i] = item.Line
+	}
+	return out
+}
+
+func TestClaimBatchItems(t *testing.T) {
+	useTestDB(t)
+	seedBatchUser(t, "nk-batch", 0, 100)
+	seedBatchJob(t, "batch_claims", "nk-batch", 3)
+
+	first, err := claimBatchItems(ctx, "batch_claims", 2, time.Minute)
+	if err != nil || len(first) != 2 || first[0].Line != 1 || first[1].Line != 2 {
+		t.Fatalf("first claim = %v, %v; want lines 1 and 2", lines(first), err)
+	}
+	if rest, _ := claimBatchItems(ctx, "batch_claims", 2, time.Minute); len(rest) != 1 || rest[0].Line != 3 {
+		t.Fatalf("second claim = %v, want line 3", lines(rest))
+	}
+	if none, _ := claimBatchItems(ctx, "batch_claims", 2, time.Minute); len(none) != 0 {
+		t.Fatalf("claimed %v while every item is fresh", lines(none))
+	}
+
+	// Line 1's worker took its credit and died
+	if charged, err := chargeBatchItem(ctx, "batch_claims", "nk-batch", first[0]); !charged || err != nil {
+		t.Fatalf("charge = %v, %v", charged, err)
+	}
+	db.Exec(ctx, "UPDATE batch_items SET claimed_at = now() - interval '1 hour' WHERE job_id = 'batch_claims' AND line = 1")
+
+	reclaimed, err := claimBatchItems(ctx, "batch_claims", 2, time.Minute)
+	if err != nil || len(reclaimed) != 1 || reclaimed[0].Line != 1 {
+		t.Fatalf("reclaim = %v, %v; want line 1", lines(reclaimed), err)
+	}
+	if !reclaimed[0].Charged {
+		t.Error("reclaimed item lost the credit its first claim took")
+	}
+	if reclaimed[0].ClaimedAt.Equal(first[0].ClaimedAt) {
+		t.Error("reclaim kept the old claim time")
+	}
+	// The dead claim can neither charge nor finish the item any more
+	if charged, _ := chargeBatchItem(ctx, "batch_claims", "nk-batch", first[0]); charged {
+		t.Error("stale claim charged the item")
+	}
+	if used := requestsUsed(t, "nk-batch"); used != 1 {
+		t.Errorf("requests_used = %d, want 1", used)
+	}
+}
+
+func TestChargeBatchItemQuota(t *testing.T) {
+	useTestDB(t)
+	seedBatchUser(t, "nk-batch", 0, 2)
+	seedBatchJob(t, "batch_quota", "nk-batch", 5)
+
+	claimed, err := claimBatchItems(ctx, "batch_quota", 5, time.Minute)
+	if err != nil || len(claimed) != 5 {
+		t.Fatalf("claim = %v, %v", lines(claimed), err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	charged := 0
+	for _, item := range claimed {
+		wg.Add(1)
+		go func(item batchItem) {
+			defer wg.Done()
+			ok, err := chargeBatchItem(context.Background(), "batch_quota", "nk-batch", item)
+			if err != nil {
+				t.Errorf("charge line %d: %v", item.Line, err)
+			}
+			if ok {
+				mu.Lock()
+				charged++
+				mu.Unlock()
+			}
+		}(item)
+	}
+	wg.Wait()
+
+	if charged != 2 {
+		t.Errorf("%d items charged side by side, want the 2 the quota allows", charged)
+	}
+	if used := requestsUsed(t, "nk-batch"); used != 2 {
+		t.Errorf("requests_used = %d, want 2", used)
+	}
+}
+
+func TestBatchResume(t *testing.T) {
+	useTestDB(t)
+	// A previous process charged line 1 and died; line 2 was never claimed
+	seedBatchUser(t, "nk-batch", 1, 10)
+	seedBatchJob(t, "batch_resume", "nk-batch", 2)
+	db.Exec(ctx, "UPDATE batch_jobs SET status = 'running' WHERE id = 'batch_resume'")
+	db.Exec(ctx, `
+		UPDATE batch_items SET status = 'running', claimed_at = now() - interval '1 hour', charged = true
+		WHERE job_id = 'batch_resume' AND line = 1
+	`)
+
+	StartBatchRunner(&config.Config{BatchConcurrency: 2, BatchItemTimeout: time.Minute})
+	t.Cleanup(func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		StopBatchRunner(stopCtx)
+	})
+
+	var job *BatchJob
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, _ = loadBatchJob(ctx, "batch_resume", "nk-batch"); job != nil && job.Status == "completed" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if job == nil || job.Status != "completed" {
+		t.Fatalf("job = %+v, want completed", job)
+	}
+	if job.Failed != 2 || job.Completed != 0 || job.Pending != 0 {
+		t.Errorf("job counts = %+v, want both lines failed once", job)
+	}
+	// Both lines failed, so both credits came back, including the dead
+	// worker's
+	if used := requestsUsed(t, "nk-batch"); used != 0 {
+		t.Errorf("requests_used = %d, want 0", used)
+	}
+}
@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values for the X-Nexus-Cache response header
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS"
+)
+
+// CacheRequestOptions lets a client control caching from the JSON body
+type CacheRequestOptions struct {
+	NoCache      bool     `json:"no_cache"`      // Don't serve from cache, but save the fresh answer
+	NoStore      bool     `json:"no_store"`      // Don't read or write the cache at all
+	ForceRefresh bool     `json:"force_refresh"` // Regenerate and overwrite the cached answer
+	Threshold    *float64 `json:"threshold"`     // Minimum similarity for a hit (0-1)
+}
+
+// CacheOptions is the resolved cache behaviour for one request
+type CacheOptions struct {
+	Read      bool
+	Write     bool
+	Threshold float64
+}
+
+// ResolveCacheOptions merges config defaults, headers and body fields.
+// Precedence for the threshold: request > API key > model > global.
+func ResolveCacheOptions(r *http.Request, cfg *config.Config, apiKey string, req ChatRequest) (CacheOptions, error) {
+	opts := CacheOptions{Read: true, Write: true, Threshold: cfg.CacheThreshold}
+
+	// 1. Config defaults
+	if t, ok := cfg.CacheModelThresholds[req.Model]; ok {
+		opts.Threshold = t
+	}
+	if t, ok := cfg.CacheKeyThresholds[apiKey]; ok {
+		opts.Threshold = t
+	}
+
+	// 2. Headers
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			opts.Read = false
+		case "no-store":
+			opts.Read = false
+			opts.Write = false
+		}
+	}
+	if refresh, _ := strconv.ParseBool(r.Header.Get("X-Nexus-Cache-Refresh")); refresh {
+		opts.Read = false
+	}
+	if raw := r.Header.Get("X-Nexus-Cache-Threshold"); raw != "" {
+		t, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid X-Nexus-Cache-Threshold: %q", raw)
+		}
+		opts.Threshold = t
+	}
+
+	// 3. Body fields
+	if req.Cache != nil {
+		if req.Cache.NoCache || req.Cache.ForceRefresh {
+			opts.Read = false
+		}
+		if req.Cache.NoStore {
+			opts.Read = false
+			opts.Write = false
+		}
+		if req.Cache.Threshold != nil {
+			opts.Threshold = *req.Cache.Threshold
+		}
+	}
+
+	if opts.Threshold < 0 || opts.Threshold > 1 {
+		return opts, fmt.Errorf("cache threshold must be between 0 and 1, got %v", opts.Threshold)
+	}
+	return opts, nil
+}
+
+// SetCacheHeaders reports the cache outcome to the client
+func SetCacheHeaders(w http.ResponseWriter, status string, score float64, looked bool) {
+	w.Header().Set("X-Nexus-Cache", status)
+	if looked {
+		w.Header().Set("X-Nexus-Cache-Score", strconv.FormatFloat(score, 'f', 4, 64))
+	}
+}
+
+// ResolveCacheNamespace picks the vector store namespace for an API key
+func ResolveCacheNamespace(cfg *config.Config, apiKey string) string {
+	if ns, ok := cfg.CacheKeyNamespaces[apiKey]; ok {
+		return ns
+	}
+	return cfg.CacheNamespace
+}
+
+// CacheTTL returns how long entries in a namespace stay servable (0 = forever)
+func CacheTTL(cfg *config.Config, namespace string) time.Duration {
+	if ttl, ok := cfg.CacheNamespaceTTLs[namespace]; ok {
+		return ttl
+	}
+	return cfg.CacheTTL
+}
+
+// CacheFreshnessFilter is the metadata filter that hides entries
+// older than the namespace TTL (nil when the namespace never expires).
+// Pinned entries always pass, and so do entries written before stamping
+// existed (no created_at), as IsCacheEntryExpired counts them fresh.
+func CacheFreshnessFilter(cfg *config.Config, namespace string) map[string]interface{} {
+	ttl := CacheTTL(cfg, namespace)
+	if ttl <= 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"$or": []interface{}{
+			map[string]interface{}{"created_at": map[string]interface{}{"$gte": time.Now().Add(-ttl).Unix()}},
+			map[string]interface{}{"pinned": map[string]interface{}{"$eq": true}},
+			map[string]interface{}{"created_at": map[string]interface{}{"$exists": false}},
+		},
+	}
+}
+
+// EmbedForCache embeds text with the route's embedder and checks the
+// vector may share its namespace and index (bind=true claims them if
+// unbound). On error the returned vector is nil and the semantic tier is
+// skipped.
+func EmbedForCache(cfg *config.Config, route CacheRoute, text string, bind bool) ([]float32, Embedder, error) {
+	embedder, err := GetEmbedder(cfg, route.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	vector, err := EmbedOne(embedder, text)
+	if err != nil {
+		return nil, embedder, err
+	}
+	if err := CheckEmbedderBinding(route.Index(cfg), route.Namespace, embedder.Name(), len(vector), bind); err != nil {
+		return nil, embedder, err
+	}
+	return vector, embedder, nil
+}
+
+// NewCacheMetadata stamps a fresh cache entry. The prompt is kept so hits
+// can be verified against the new request.
+func NewCacheMetadata(model, prompt, answer, embedder string) map[string]interface{} {
+	return map[string]interface{}{
+		"embedder":    embedder,
+		"prompt":      prompt,
+		"response":    answer,
+		"model":       model,
+		"created_at":  time.Now().Unix(),
+		"hits":        0,
+		"last_hit_at": 0,
+	}
+}
+
+// IsCacheEntryExpired reports whether an entry is past the namespace TTL.
+// Pinned entries never expire. Entries written before stamping existed
+// have no created_at yet: they count as fresh, and the sweeper stamps them
+// (see SweepCache).
+func IsCacheEntryExpired(metadata map[string]interface{}, ttl time.Duration) bool {
+	if ttl <= 0 || IsCacheEntryPinned(metadata) {
+		return false
+	}
+	createdAt := metaInt(metadata, "created_at")
+	return createdAt != 0 && time.Since(time.Unix(createdAt, 0)) > ttl
+}
+
+// RecordCacheHit bumps the hit counter of an entry and appends to its hit
+// history in the background. The count lives in Redis (HINCRBY, so
+// concurrent hits all land); the metadata copy is for display only.
+func RecordCacheHit(store VectorStore, namespace string, match *CacheMatch) {
+	go func() {
+		now := time.Now().Unix()
+		hits := metaInt(match.Metadata, "hits") + 1
+		client := GetClient()
+		if client != nil {
+			if n, err := client.HIncrBy(ctx, cacheHitCountKey(namespace), match.ID, 1).Result(); err == nil {
+				hits = n
+			}
+		}
+		fields := map[string]interface{}{
+			"hits":        hits,
+			"last_hit_at": now,
+		}
+		if err := store.UpdateMetadata(namespace, match.ID, fields); err != nil {
+			log.Printf("⚠️ Cache hit update failed: %v", err)
+		}
+
+		if client == nil {
+			return
+		}
+		event, _ := json.Marshal(CacheHitEvent{At: now, Score: match.Score})
+		key := cacheHitHistoryKey(namespace, match.ID)
+		client.LPush(ctx, key, event)
+		client.LTrim(ctx, key, 0, 99) // Keep the latest 100 hits
+		client.Expire(ctx, key, 30*24*time.Hour)
+	}()
+}
+
+// CacheHitEvent is one entry of a cache entry's hit history
+type CacheHitEvent struct {
+	At    int64   `json:"at"`
+	Score float64 `json:"score"`
+}
+
+func cacheHitHistoryKey(namespace, id string) string {
+	return "cache:hits:" + namespace + ":" + id
+}
+
+// cacheHitCountKey is the Redis hash of hit counts (entry id → hits) for a namespace
+func cacheHitCountKey(namespace string) string {
+	return "cache:hitcount:" + namespace
+}
+
+// CacheHitCounts returns the Redis hit counts of a namespace (nil without Redis)
+func CacheHitCounts(namespace string) map[string]int64 {
+	client := GetClient()
+	if client == nil {
+		return nil
+	}
+	raw, err := client.HGetAll(ctx, cacheHitCountKey(namespace)).Result()
+	if err != nil {
+		return nil
+	}
+	counts := make(map[string]int64, len(raw))
+	for id, v := range raw {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		counts[id] = n
+	}
+	return counts
+}
+
+// ForgetCacheHits drops the hit counts and histories of deleted entries
+func ForgetCacheHits(namespace string, ids ...string) {
+	client := GetClient()
+	if client == nil || len(ids) == 0 {
+		return
+	}
+	client.HDel(ctx, cacheHitCountKey(namespace), ids...)
+	for _, id := range ids {
+		client.Del(ctx, cacheHitHistoryKey(namespace, id))
+	}
+}
+
+// IsCacheEntryPinned reports whether an entry was imported as pinned
+func IsCacheEntryPinned(metadata map[string]interface{}) bool {
+	pinned, _ := metadata["pinned"].(bool)
+	return pinned
+}
+
+// metaInt reads a numeric metadata field (JSON numbers decode as float64)
+func metaInt(metadata map[string]interface{}, key string) int64 {
+	switch v := metadata[key].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
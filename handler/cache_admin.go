@@ -0,0 +1,466 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheEntry is the admin view of one cached answer (vector values omitted)
+type CacheEntry struct {
+	ID        string                 `json:"id"`
+	Namespace string                 `json:"namespace"`
+	Score     float64                `json:"score,omitempty"`
+	Expired   bool                   `json:"expired"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+type CacheSearchRequest struct {
+	Namespace string  `json:"namespace"`
+	Query     string  `json:"query"`   // Prompt text, embedded and searched by similarity
+	LikeID    string  `json:"like_id"` // Or: find entries similar to an existing entry
+	TopK      int     `json:"top_k"`
+	MinScore  float64 `json:"min_score"`
+}
+
+type CachePurgeRequest struct {
+	Namespace string `json:"namespace"`
+	Model     string `json:"model"`
+}
+
+// adminActor identifies who performed an admin action, for the audit log
+func adminActor(r *http.Request) string {
+	actor := r.Header.Get("X-Nexus-Admin")
+	if actor == "" {
+		actor = "admin"
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return actor + "@" + ip
+}
+
+// requireVectorStore stops admin handlers early when no vector store is configured
+func requireVectorStore(w http.ResponseWriter, cfg *config.Config) VectorStore {
+	store := GetVectorStore(cfg)
+	if store == nil {
+		http.Error(w, "Vector store not configured", http.StatusServiceUnavailable)
+	}
+	return store
+}
+
+// requireCacheRoute resolves the logical namespace an admin request names to
+// where it lives today (physical namespace and store), like lookups do
+func requireCacheRoute(w http.ResponseWriter, cfg *config.Config, logical string) (CacheRoute, VectorStore) {
+	route := ResolveCacheRoute(logical)
+	if requireVectorStore(w, cfg) == nil {
+		return route, nil
+	}
+	return route, route.Store(cfg)
+}
+
+// HandleAdminCacheList pages through a namespace: GET /api/admin/cache?namespace=&cursor=
+func HandleAdminCacheList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	namespace := r.URL.Query().Get("namespace")
+	route, store := requireCacheRoute(w, cfg, namespace)
+	if store == nil {
+		return
+	}
+
+	ids, next, err := store.List(route.Namespace, r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	entries := []CacheEntry{}
+	if len(ids) > 0 {
+		vectors, err := store.Fetch(route.Namespace, ids)
+		if err != nil {
+			http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		ttl := CacheTTL(cfg, namespace)
+		for _, id := range ids {
+			if v, ok := vectors[id]; ok {
+				entries = append(entries, CacheEntry{ID: id, Namespace: namespace, Expired: IsCacheEntryExpired(v.Metadata, ttl), Metadata: v.Metadata})
+			}
+		}
+	}
+
+	LogCacheAudit(adminActor(r), "list", namespace, "", map[string]any{"count": len(entries)})
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "next_cursor": next})
+}
+
+// HandleAdminCacheSearch finds entries by prompt text or by similarity to
+// another entry: POST /api/admin/cache/search
+func HandleAdminCacheSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	var req CacheSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	route, store := requireCacheRoute(w, cfg, req.Namespace)
+	if store == nil {
+		return
+	}
+	if req.TopK <= 0 || req.TopK > 100 {
+		req.TopK = 10
+	}
+
+	// 1. Resolve the search vector
+	var vector []float32
+	switch {
+	case req.Query != "":
+		v, _, err := EmbedForCache(cfg, route, req.Query, false)
+		if err != nil {
+			http.Error(w, "Embedding Error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		vector = v
+	case req.LikeID != "":
+		vectors, err := store.Fetch(route.Namespace, []string{req.LikeID})
+		if err != nil {
+			http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		v, ok := vectors[req.LikeID]
+		if !ok {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		vector = v.Values
+	default:
+		http.Error(w, "query or like_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// 2. Search
+	matches, err := store.Query(route.Namespace, vector, req.TopK, nil)
+	if err != nil {
+		http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	ttl := CacheTTL(cfg, req.Namespace)
+	entries := []CacheEntry{}
+	for _, m := range matches {
+		if m.Score < req.MinScore {
+			continue
+		}
+		entries = append(entries, CacheEntry{ID: m.ID, Namespace: req.Namespace, Score: m.Score, Expired: IsCacheEntryExpired(m.Metadata, ttl), Metadata: m.Metadata})
+	}
+
+	LogCacheAudit(adminActor(r), "search", req.Namespace, req.LikeID, map[string]any{"query": req.Query, "results": len(entries)})
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// HandleAdminCacheEntry shows or deletes one entry:
+// GET|DELETE /api/admin/cache/entries/{id}?namespace=
+func HandleAdminCacheEntry(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	id := r.PathValue("id")
+	namespace := r.URL.Query().Get("namespace")
+	route, store := requireCacheRoute(w, cfg, namespace)
+	if store == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		vectors, err := store.Fetch(route.Namespace, []string{id})
+		if err != nil {
+			http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		v, ok := vectors[id]
+		if !ok {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+
+		ttl := CacheTTL(cfg, namespace)
+		resp := map[string]any{
+			"entry":       CacheEntry{ID: id, Namespace: namespace, Expired: IsCacheEntryExpired(v.Metadata, ttl), Metadata: v.Metadata},
+			"hit_history": cacheHitHistory(route.Namespace, id),
+		}
+		if createdAt := metaInt(v.Metadata, "created_at"); createdAt > 0 && ttl > 0 && !IsCacheEntryPinned(v.Metadata) {
+			resp["expires_at"] = time.Unix(createdAt, 0).Add(ttl).Unix()
+		}
+
+		LogCacheAudit(adminActor(r), "view", namespace, id, nil)
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodDelete:
+		if err := store.Delete(route.Namespace, []string{id}); err != nil {
+			http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		ForgetCacheHits(route.Namespace, id)
+		MirrorDeleteToMigration(cfg, route.Namespace, []string{id})
+
+		LogCacheAudit(adminActor(r), "delete_entry", namespace, id, nil)
+		writeJSON(w, http.StatusOK, map[string]any{"deleted": id})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleAdminCacheNamespace wipes a whole namespace: DELETE /api/admin/cache/namespace?namespace=
+func HandleAdminCacheNamespace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	namespace := r.URL.Query().Get("namespace")
+	route, store := requireCacheRoute(w, cfg, namespace)
+	if store == nil {
+		return
+	}
+
+	// The copy would outlive the wipe and come back at switch-over
+	if activeMigration(route.Namespace) != nil {
+		http.Error(w, "Namespace has a migration running", http.StatusConflict)
+		return
+	}
+
+	if err := store.DeleteNamespace(route.Namespace); err != nil {
+		http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	ClearEmbedderBinding(route.Namespace) // An empty namespace can take any embedder again
+	if client := GetClient(); client != nil {
+		client.Del(ctx, embedderSpecKey(route.Namespace), cacheHitCountKey(route.Namespace))
+	}
+
+	LogCacheAudit(adminActor(r), "delete_namespace", namespace, "", map[string]any{"physical": route.Namespace})
+	writeJSON(w, http.StatusOK, map[string]any{"deleted_namespace": namespace})
+}
+
+// HandleAdminCachePurge deletes every entry produced by a model: POST /api/admin/cache/purge
+func HandleAdminCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	var req CachePurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "model is required", http.StatusBadRequest)
+		return
+	}
+	route, store := requireCacheRoute(w, cfg, req.Namespace)
+	if store == nil {
+		return
+	}
+
+	// Not every backend can delete by metadata filter, so scan and delete by id
+	var matched []string
+	err := ScanStore(store, route.Namespace, func(vectors map[string]VectorRecord) error {
+		for id, v := range vectors {
+			if model, _ := v.Metadata["model"].(string); model == req.Model {
+				matched = append(matched, id)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = store.Delete(route.Namespace, matched)
+	}
+	if err == nil {
+		ForgetCacheHits(route.Namespace, matched...)
+		MirrorDeleteToMigration(cfg, route.Namespace, matched)
+	}
+	if err != nil {
+		http.Error(w, "Vector Store Error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	LogCacheAudit(adminActor(r), "purge_model", req.Namespace, req.Model, map[string]any{"deleted": len(matched)})
+	writeJSON(w, http.StatusOK, map[string]any{"model": req.Model, "deleted": len(matched)})
+}
+
+// cacheHitHistory returns the most recent hits of an entry, newest first
+func cacheHitHistory(namespace, id string) []CacheHitEvent {
+	history := []CacheHitEvent{}
+	client := GetClient()
+	if client == nil {
+		return history
+	}
+
+	raw, err := client.LRange(ctx, cacheHitHistoryKey(namespace, id), 0, -1).Result()
+	if err != nil {
+		log.Printf("⚠️ Hit history read failed: %v", err)
+		return history
+	}
+	for _, item := range raw {
+		var event CacheHitEvent
+		if json.Unmarshal([]byte(item), &event) == nil {
+			history = append(history, event)
+		}
+	}
+	return history
+}
+
+// HandleAdminCacheImport warms a namespace from a JSONL body of
+// {"question","answer","model"} lines: POST /api/admin/cache/import?namespace=&pinned=
+func HandleAdminCacheImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	if requireVectorStore(w, cfg) == nil {
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	pinned, _ := strconv.ParseBool(r.URL.Query().Get("pinned"))
+	result, err := ImportCacheEntries(r.Context(), cfg, namespace, r.Body, pinned)
+	if err != nil {
+		http.Error(w, "Import Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	LogCacheAudit(adminActor(r), "import", namespace, "", map[string]any{"imported": result.Imported, "failed": result.Failed, "pinned": pinned})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandleAdminCacheExport streams a namespace snapshot: GET /api/admin/cache/export?namespace=
+func HandleAdminCacheExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	if requireVectorStore(w, cfg) == nil {
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "cache-"+namespace+".snapshot.jsonl"))
+
+	// Headers are already out once streaming starts, so errors can only be logged
+	count, err := ExportCacheSnapshot(cfg, namespace, w)
+	if err != nil {
+		log.Printf("⚠️ Snapshot export of %q failed after %d entries: %v", namespace, count, err)
+	}
+
+	LogCacheAudit(adminActor(r), "export", namespace, "", map[string]any{"exported": count})
+}
+
+// HandleAdminCacheRestore loads a snapshot body: POST /api/admin/cache/restore?namespace=
+// Entries are re-stamped as new unless ?restamp=false
+func HandleAdminCacheRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	if requireVectorStore(w, cfg) == nil {
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	restamp := true
+	if raw := r.URL.Query().Get("restamp"); raw != "" {
+		restamp, _ = strconv.ParseBool(raw)
+	}
+	count, err := RestoreCacheSnapshot(cfg, namespace, r.Body, restamp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Restore Error after %d entries: %v", count, err), http.StatusBadRequest)
+		return
+	}
+
+	LogCacheAudit(adminActor(r), "restore", namespace, "", map[string]any{"restored": count, "restamp": restamp})
+	writeJSON(w, http.StatusOK, map[string]any{"restored": count})
+}
+
+// HandleAdminCacheMigrations lists or starts re-embedding migrations:
+// GET|POST /api/admin/cache/migrations
+func HandleAdminCacheMigrations(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"migrations": ListCacheMigrations()})
+
+	case http.MethodPost:
+		var req StartMigrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		m, err := StartCacheMigration(cfg, req)
+		if err != nil {
+			http.Error(w, "Migration Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		LogCacheAudit(adminActor(r), "start_migration", req.Namespace, m.ID, map[string]any{"target": req.TargetNamespace, "embedder": req.Embedder})
+		writeJSON(w, http.StatusAccepted, m)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleAdminCacheMigration reports progress, or resumes a failed migration:
+// GET /api/admin/cache/migrations/{id}, POST /api/admin/cache/migrations/{id}/resume
+func HandleAdminCacheMigration(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	id := r.PathValue("id")
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/resume") {
+		m, err := ResumeCacheMigration(cfg, id)
+		if err != nil {
+			http.Error(w, "Migration Error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		LogCacheAudit(adminActor(r), "resume_migration", m.Logical, id, nil)
+		writeJSON(w, http.StatusAccepted, m)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := GetCacheMigration(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	progress := 0.0
+	if m.Total > 0 {
+		progress = min(float64(m.Processed+m.Skipped)/float64(m.Total), 1)
+	}
+	if m.Status == "completed" {
+		progress = 1
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"migration": m, "progress": progress})
+}
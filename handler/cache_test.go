@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"testing"
+	"time"
+)
+
+func TestIsCacheEntryExpired(t *testing.T) {
+	now := time.Now()
+	hourAgo := float64(now.Add(-time.Hour).Unix()) // JSON numbers decode as float64
+	weekAgo := now.Add(-7 * 24 * time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+		ttl      time.Duration
+		want     bool
+	}{
+		{"no ttl", map[string]interface{}{"created_at": weekAgo}, 0, false},
+		{"within ttl", map[string]interface{}{"created_at": hourAgo}, 2 * time.Hour, false},
+		{"past ttl", map[string]interface{}{"created_at": hourAgo}, 30 * time.Minute, true},
+		{"int64 stamp past ttl", map[string]interface{}{"created_at": weekAgo}, 24 * time.Hour, true},
+		{"unstamped counts as fresh", map[string]interface{}{}, time.Minute, false},
+		{"pinned never expires", map[string]interface{}{"created_at": weekAgo, "pinned": true}, time.Minute, false},
+		{"pinned must be a bool", map[string]interface{}{"created_at": weekAgo, "pinned": "true"}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCacheEntryExpired(tt.metadata, tt.ttl); got != tt.want {
+				t.Errorf("IsCacheEntryExpired(%v, %s) = %v, want %v", tt.metadata, tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheFreshnessFilter(t *testing.T) {
+	ttl := time.Hour
+	cfg := &config.Config{CacheTTL: ttl, CacheNamespaceTTLs: map[string]time.Duration{"forever": 0}}
+	if filter := CacheFreshnessFilter(cfg, "forever"); filter != nil {
+		t.Errorf("CacheFreshnessFilter for a namespace without TTL = %v, want nil", filter)
+	}
+	filter := CacheFreshnessFilter(cfg, "default")
+	if filter == nil {
+		t.Fatal("CacheFreshnessFilter returned nil for a positive ttl")
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+		want     bool
+	}{
+		{"fresh", map[string]interface{}{"created_at": time.Now().Unix()}, true},
+		{"stale", map[string]interface{}{"created_at": time.Now().Add(-2 * ttl).Unix()}, false},
+		{"stale but pinned", map[string]interface{}{"created_at": time.Now().Add(-2 * ttl).Unix(), "pinned": true}, true},
+		{"unstamped", map[string]interface{}{"response": "written before stamping"}, true},
+		{"stamp that isn't a number", map[string]interface{}{"created_at": "yesterday"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesFilter(tt.metadata, filter); got != tt.want {
+				t.Errorf("matchesFilter(%v) = %v, want %v", tt.metadata, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEmbedderBinding(t *testing.T) {
+	// Without Redis bindings are kept in memory
+	t.Cleanup(func() { embedderBindings = map[string]string{} })
+
+	if err := CheckEmbedderBinding("idx-a", "support", "openai:text-embedding-3-small", 1536, false); err != nil {
+		t.Fatalf("check on an unbound index: %v", err)
+	}
+	if err := CheckEmbedderBinding("idx-a", "support", "openai:text-embedding-3-small", 1536, true); err != nil {
+		t.Fatalf("first bind: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		index     string
+		namespace string
+		embedder  string
+		dim       int
+		wantErr   bool
+	}{
+		{"same embedder", "idx-a", "support", "openai:text-embedding-3-small", 1536, false},
+		{"other embedder in the namespace", "idx-a", "support", "openai:text-embedding-3-large", 1536, true},
+		{"other dimension in another namespace of the index", "idx-a", "sales", "hash", 256, true},
+		{"same dimension in another namespace of the index", "idx-a", "sales", "openai:text-embedding-ada-002", 1536, false},
+		{"other index", "idx-b", "billing", "hash", 256, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckEmbedderBinding(tt.index, tt.namespace, tt.embedder, tt.dim, true)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckEmbedderBinding = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
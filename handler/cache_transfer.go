@@ -0,0 +1,278 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const snapshotFormat = "nexus-cache-snapshot"
+
+// ImportEntry is one line of a warm-up JSONL file
+type ImportEntry struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+	Model    string `json:"model"` // Optional: recorded in the entry metadata
+}
+
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors"`
+}
+
+// SnapshotHeader is the first line of a snapshot file. Every following line
+// is a VectorRecord, so a snapshot can be restored into any VectorStore.
+type SnapshotHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Namespace  string `json:"namespace"`
+	ExportedAt int64  `json:"exported_at"`
+	Dimension  int    `json:"dimension"`
+	Embedder   string `json:"embedder"` // Embedder that produced the vectors, if known
+	Count      int    `json:"count"`    // Entries at export start; informational only
+}
+
+// ImportCacheEntries embeds question/answer pairs in batches and stores them
+// as cache entries. Batches are spaced by CacheImportInterval to stay under
+// the embedding API rate limit. Pinned entries never expire and are never
+// evicted, so curated answers outlive the namespace TTL. The logical
+// namespace is resolved to where it lives today, like lookups do.
+func ImportCacheEntries(ctx context.Context, cfg *config.Config, logical string, r io.Reader, pinned bool) (ImportResult, error) {
+	result := ImportResult{Errors: []string{}}
+	batchSize := max(cfg.CacheImportBatchSize, 1)
+
+	route := ResolveCacheRoute(logical)
+	namespace, store := route.Namespace, route.Store(cfg)
+	if store == nil {
+		return result, fmt.Errorf("no vector store configured")
+	}
+	embedder, err := GetEmbedder(cfg, namespace)
+	if err != nil {
+		return result, err
+	}
+
+	var ticker *time.Ticker
+	if cfg.CacheImportInterval > 0 {
+		ticker = time.NewTicker(cfg.CacheImportInterval)
+		defer ticker.Stop()
+	}
+
+	var batch []ImportEntry
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+
+		// 1. Rate limit: wait for the next slot
+		if ticker != nil && result.Imported+result.Failed > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// 2. Embed the whole batch in one call
+		questions := make([]string, len(batch))
+		for i, e := range batch {
+			questions[i] = e.Question
+		}
+		vectors, err := embedder.Embed(questions)
+		if err == nil && len(vectors) > 0 {
+			err = CheckEmbedderBinding(route.Index(cfg), namespace, embedder.Name(), len(vectors[0]), true)
+		}
+		if err != nil {
+			result.Failed += len(batch)
+			result.Errors = append(result.Errors, fmt.Sprintf("embedding batch of %d failed: %v", len(batch), err))
+			return nil
+		}
+
+		// 3. Store
+		records := make([]VectorRecord, len(batch))
+		for i, e := range batch {
+			metadata := NewCacheMetadata(e.Model, e.Question, e.Answer, embedder.Name())
+			metadata["source"] = "import"
+			if pinned {
+				metadata["pinned"] = true
+			}
+			records[i] = VectorRecord{ID: GenerateHash(e.Question), Values: vectors[i], Metadata: metadata}
+		}
+		if err := store.Upsert(namespace, records); err != nil {
+			result.Failed += len(batch)
+			result.Errors = append(result.Errors, fmt.Sprintf("upsert of %d entries failed: %v", len(batch), err))
+			return nil
+		}
+		MirrorToMigration(cfg, namespace, records)
+		result.Imported += len(batch)
+		log.Printf("📥 Imported %d entries into namespace %q", result.Imported, logical)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry ImportEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Question == "" || entry.Answer == "" {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: need JSON with question and answer", lineNo))
+			continue
+		}
+		if entry.Model == "" {
+			entry.Model = "import"
+		}
+
+		batch = append(batch, entry)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	return result, flush()
+}
+
+// ExportCacheSnapshot writes a logical namespace (vectors + metadata) as a
+// snapshot, read from wherever its route points
+func ExportCacheSnapshot(cfg *config.Config, logical string, w io.Writer) (int, error) {
+	route := ResolveCacheRoute(logical)
+	namespace, store := route.Namespace, route.Store(cfg)
+	if store == nil {
+		return 0, fmt.Errorf("no vector store configured")
+	}
+	counts, err := store.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	// The header needs the dimension, so hold the first page until it's known
+	enc := json.NewEncoder(w)
+	headerWritten := false
+	writeHeader := func(dimension int, embedder string) error {
+		headerWritten = true
+		return enc.Encode(SnapshotHeader{
+			Format:     snapshotFormat,
+			Version:    1,
+			Namespace:  logical,
+			ExportedAt: time.Now().Unix(),
+			Dimension:  dimension,
+			Embedder:   embedder,
+			Count:      counts[namespace],
+		})
+	}
+
+	written := 0
+	err = ScanStore(store, namespace, func(records map[string]VectorRecord) error {
+		for _, record := range records {
+			if !headerWritten {
+				embedder, _ := record.Metadata["embedder"].(string)
+				if err := writeHeader(len(record.Values), embedder); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+			written++
+		}
+		return nil
+	})
+	if err == nil && !headerWritten {
+		err = writeHeader(0, "") // Empty namespace
+	}
+	return written, err
+}
+
+// RestoreCacheSnapshot loads a snapshot into a logical namespace, written
+// wherever its route points. An empty namespace restores into the namespace
+// the snapshot was exported from. With restamp,
+// entries get created_at=now, so an old snapshot isn't swept as soon as it
+// lands; without it they keep their age (and may already be expired).
+func RestoreCacheSnapshot(cfg *config.Config, logical string, r io.Reader, restamp bool) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+	// 1. Header
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("empty snapshot")
+	}
+	var header SnapshotHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != snapshotFormat {
+		return 0, fmt.Errorf("not a %s file", snapshotFormat)
+	}
+	if header.Version != 1 {
+		return 0, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	if logical == "" {
+		logical = header.Namespace
+	}
+	route := ResolveCacheRoute(logical)
+	namespace, store := route.Namespace, route.Store(cfg)
+	if store == nil {
+		return 0, fmt.Errorf("no vector store configured")
+	}
+	if header.Embedder != "" && header.Dimension > 0 {
+		if err := CheckEmbedderBinding(route.Index(cfg), namespace, header.Embedder, header.Dimension, true); err != nil {
+			return 0, err
+		}
+	}
+
+	// 2. Records, upserted 100 at a time
+	now := time.Now().Unix()
+	restored := 0
+	batch := make([]VectorRecord, 0, 100)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record VectorRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return restored, fmt.Errorf("record %d: %v", restored+len(batch)+1, err)
+		}
+		if header.Dimension > 0 && len(record.Values) != header.Dimension {
+			return restored, fmt.Errorf("record %s has dimension %d, snapshot says %d", record.ID, len(record.Values), header.Dimension)
+		}
+		if restamp {
+			if record.Metadata == nil {
+				record.Metadata = map[string]interface{}{}
+			}
+			record.Metadata["created_at"] = now
+		}
+
+		batch = append(batch, record)
+		if len(batch) == cap(batch) {
+			if err := store.Upsert(namespace, batch); err != nil {
+				return restored, err
+			}
+			MirrorToMigration(cfg, namespace, batch)
+			restored += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, err
+	}
+	if len(batch) > 0 {
+		if err := store.Upsert(namespace, batch); err != nil {
+			return restored, err
+		}
+		MirrorToMigration(cfg, namespace, batch)
+		restored += len(batch)
+	}
+	return restored, nil
+}
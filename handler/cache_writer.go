@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// CacheWrite is one entry waiting to be stored
+type CacheWrite struct {
+	Route  CacheRoute
+	Record VectorRecord
+}
+
+// The background writer takes cache upserts off the request path. Writes go
+// into a bounded queue (dropped when full), are grouped into one upsert per
+// namespace, and retried with exponential backoff.
+type cacheWriter struct {
+	cfg   *config.Config
+	queue chan CacheWrite
+	done  chan struct{}
+}
+
+var (
+	writerMu sync.Mutex
+	writer   *cacheWriter
+
+	cacheWritesEnqueued = Counter("nexus_cache_writes_enqueued_total", "Cache entries queued for writing")
+	cacheWritesDropped  = Counter("nexus_cache_writes_dropped_total", "Cache entries dropped because the write queue was full")
+	cacheWritesWritten  = Counter("nexus_cache_writes_written_total", "Cache entries written to the vector store")
+	cacheWritesFailed   = Counter("nexus_cache_writes_failed_total", "Cache entries given up on after every retry")
+	cacheWriteRetries   = Counter("nexus_cache_write_retries_total", "Retried cache upsert batches")
+	cacheWriteBatches   = Counter("nexus_cache_write_batches_total", "Cache upsert batches sent")
+)
+
+// StartCacheWriter starts the background writer. Without it, EnqueueCacheWrite
+// writes synchronously (CLI commands, tests).
+func StartCacheWriter(cfg *config.Config) {
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	if writer != nil || GetVectorStore(cfg) == nil {
+		return
+	}
+
+	writer = &cacheWriter{
+		cfg:   cfg,
+		queue: make(chan CacheWrite, max(cfg.CacheWriteQueueSize, 1)),
+		done:  make(chan struct{}),
+	}
+	queue := writer.queue
+	RegisterGauge("nexus_cache_write_queue_depth", "Cache entries waiting to be written", func() float64 { return float64(len(queue)) })
+	RegisterGauge("nexus_cache_write_queue_capacity", "Size of the cache write queue", func() float64 { return float64(cap(queue)) })
+
+	go writer.run()
+	log.Printf("✍️ Cache writer running (queue %d, batches of %d)", cfg.CacheWriteQueueSize, cfg.CacheWriteBatchSize)
+}
+
+// EnqueueCacheWrite queues an entry for the background writer. It never
+// blocks: when the queue is full the entry is dropped and counted.
+func EnqueueCacheWrite(cfg *config.Config, write CacheWrite) {
+	writerMu.Lock()
+	w := writer
+	if w == nil {
+		writerMu.Unlock()
+		flushCacheWrites(cfg, []CacheWrite{write})
+		return
+	}
+	defer writerMu.Unlock()
+
+	select {
+	case w.queue <- write:
+		cacheWritesEnqueued.Add(1)
+	default:
+		cacheWritesDropped.Add(1)
+		log.Printf("⚠️ Cache write queue full, dropping entry %s", write.Record.ID)
+	}
+}
+
+// StopCacheWriter stops accepting writes and flushes the queue, giving up
+// when ctx expires. Called on shutdown.
+func StopCacheWriter(ctx context.Context) {
+	writerMu.Lock()
+	w := writer
+	writer = nil
+	if w != nil {
+		close(w.queue) // Safe: enqueues hold writerMu and see writer == nil from now on
+	}
+	writerMu.Unlock()
+	if w == nil {
+		return
+	}
+
+	select {
+	case <-w.done:
+		log.Println("✍️ Cache writer flushed")
+	case <-ctx.Done():
+		log.Printf("⚠️ Cache writer stopped with %d entries unwritten", len(w.queue))
+	}
+}
+
+func (w *cacheWriter) run() {
+	defer close(w.done)
+
+	interval := w.cfg.CacheWriteFlushInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batchSize := max(w.cfg.CacheWriteBatchSize, 1)
+	batch := make([]CacheWrite, 0, batchSize)
+	for {
+		select {
+		case write, ok := <-w.queue:
+			if !ok {
+				flushCacheWrites(w.cfg, batch)
+				return
+			}
+			batch = append(batch, write)
+			if len(batch) >= batchSize {
+				flushCacheWrites(w.cfg, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flushCacheWrites(w.cfg, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flushCacheWrites upserts a batch, one call per store and namespace, then
+// mirrors the new entries into any running migration
+func flushCacheWrites(cfg *config.Config, batch []CacheWrite) {
+	// The same prompt answered twice in one batch keeps the latest answer
+	groups := map[CacheRoute][]VectorRecord{}
+	seen := map[CacheRoute]map[string]int{}
+	for _, write := range batch {
+		route := CacheRoute{Namespace: write.Route.Namespace, Host: write.Route.Host}
+		if seen[route] == nil {
+			seen[route] = map[string]int{}
+		}
+		if i, ok := seen[route][write.Record.ID]; ok {
+			groups[route][i] = write.Record
+			continue
+		}
+		seen[route][write.Record.ID] = len(groups[route])
+		groups[route] = append(groups[route], write.Record)
+	}
+
+	for route, records := range groups {
+		store := route.Store(cfg)
+		if store == nil {
+			continue
+		}
+		if err := upsertWithRetry(cfg, store, route.Namespace, records); err != nil {
+			cacheWritesFailed.Add(int64(len(records)))
+			log.Printf("⚠️ Cache write of %d entries to %q failed: %v", len(records), route.Namespace, err)
+			continue
+		}
+		cacheWritesWritten.Add(int64(len(records)))
+		MirrorToMigration(cfg, route.Namespace, records)
+	}
+}
+
+func upsertWithRetry(cfg *config.Config, store VectorStore, namespace string, records []VectorRecord) error {
+	backoff := cfg.CacheWriteRetryBackoff
+	var err error
+	for attempt := 0; attempt <= cfg.CacheWriteMaxRetries; attempt++ {
+		if attempt > 0 {
+			cacheWriteRetries.Add(1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		cacheWriteBatches.Add(1)
+		if err = store.Upsert(namespace, records); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Completion callbacks: a key registers one URL (the callbacks table) and
+// gets a signing secret. Every finished async request is POSTed there with
+//
+//	X-Nexus-Timestamp: <unix seconds>
+//	X-Nexus-Signature: sha256=<hex HMAC-SHA256(secret, timestamp + "." + body)>
+//
+// Failed deliveries are retried with exponential backoff. Delivery is at
+// least once: receivers should dedupe on X-Nexus-Request-Id.
+//
+// Callback URLs are user-supplied, so they must be https, redirects are not
+// followed, and the dialer refuses private, loopback and link-local
+// addresses. The check is on the address actually dialled, after DNS, so a
+// name that later resolves somewhere internal is refused too.
+
+var (
+	callbacksDelivered = Counter("nexus_callbacks_delivered_total", "Async completion callbacks delivered")
+	callbackFailures   = Counter("nexus_callback_failures_total", "Callback delivery attempts that failed")
+
+	errCallbackAddress = errors.New("callback address is not public")
+
+	callbackClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy: nil, // A proxy would dial on our behalf, past the address check
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					addr, err := netip.ParseAddrPort(address)
+					if err != nil || !IsPublicAddr(addr.Addr()) {
+						return errCallbackAddress
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // A 3xx counts as a failed delivery
+		},
+	}
+)
+
+// IsPublicAddr reports whether a callback may be delivered to addr: not
+// loopback, private, link-local, multicast or unspecified
+func IsPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() &&
+		!cgnatPrefix.Contains(addr) && !addr.IsLinkLocalUnicast()
+}
+
+// cgnatPrefix is the carrier-grade NAT range (RFC 6598), private in practice
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// validateCallbackURL checks a URL at registration: https, and a host that
+// resolves only to public addresses (delivery checks again when dialling)
+func validateCallbackURL(reqCtx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("url must be an absolute https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(reqCtx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("url host %q does not resolve", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !IsPublicAddr(addr) {
+			return fmt.Errorf("url host %q resolves to a non-public address", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// Callback is a key's registered completion URL
+type Callback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// CallbackStatus is the delivery state of one async request's callback
+type CallbackStatus struct {
+	Status   string `json:"status"` // pending, delivered, failed
+	Attempts int    `json:"attempts"`
+}
+
+func LoadCallback(reqCtx context.Context, apiKey string) (*Callback, error) {
+	if db == nil {
+		return nil, nil
+	}
+	var cb Callback
+	err := db.QueryRow(reqCtx, "SELECT url, secret FROM callbacks WHERE api_key = $1", apiKey).Scan(&cb.URL, &cb.Secret)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cb, nil
+}
+
+// SignCallback returns the X-Nexus-Signature value for a body sent at timestamp
+func SignCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleCallback manages the key's callback URL. It is free, like polling.
+// GET shows it, PUT {"url": "..."} sets it (and returns the secret; add
+// ?rotate=true for a new one), DELETE removes it.
+func HandleCallback(w http.ResponseWriter, r *http.Request) {
+	userKey := getAPIKey(r)
+	if db == nil {
+		http.Error(w, "Callbacks need the database", http.StatusServiceUnavailable)
+		return
+	}
+	if !ValidateAPIKey(userKey) {
+		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cb, err := LoadCallback(r.Context(), userKey)
+		if err != nil {
+			http.Error(w, "Failed to load callback", http.StatusInternalServerError)
+			return
+		}
+		if cb == nil {
+			http.Error(w, "No callback registered", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, Callback{URL: cb.URL}) // The secret is only shown when set
+
+	case http.MethodPut:
+		var req Callback
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateCallbackURL(r.Context(), req.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b := make([]byte, 24)
+		rand.Read(b)
+		rotate, _ := strconv.ParseBool(r.URL.Query().Get("rotate"))
+
+		var secret string
+		err := db.QueryRow(r.Context(), `
+			INSERT INTO callbacks (api_key, url, secret) VALUES ($1, $2, $3)
+			ON CONFLICT (api_key) DO UPDATE SET url = EXCLUDED.url, updated_at = now(),
+				secret = CASE WHEN $4 THEN EXCLUDED.secret ELSE callbacks.secret END
+			RETURNING secret
+		`, userKey, req.URL, "whsec_"+hex.EncodeToString(b), rotate).Scan(&secret)
+		if err != nil {
+			log.Printf("Callback save error: %v", err)
+			http.Error(w, "Failed to save callback", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, Callback{URL: req.URL, Secret: secret})
+
+	case http.MethodDelete:
+		if _, err := db.Exec(r.Context(), "DELETE FROM callbacks WHERE api_key = $1", userKey); err != nil {
+			http.Error(w, "Failed to delete callback", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeliverCallback sends an async request's result in the background,
+// retrying until it is delivered or out of attempts
+func DeliverCallback(cfg *config.Config, id string) {
+	goAsync(func() {
+		for {
+			wait, again := attemptCallback(cfg, id)
+			if !again {
+				return
+			}
+			select {
+			case <-asyncRunner.ctx.Done():
+				return // The next start picks it up
+			case <-time.After(wait):
+			}
+		}
+	})
+}
+
+// ResumeCallbacks retries every due delivery (after a restart, or one whose
+// worker died)
+func ResumeCallbacks(cfg *config.Config) {
+	rows, err := db.Query(asyncRunner.ctx, `
+		SELECT id FROM async_requests
+		WHERE callback_status = 'pending' AND (callback_next_at IS NULL OR callback_next_at <= now())
+	`)
+	if err != nil {
+		log.Printf("⚠️ Callback resume failed: %v", err)
+		return
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Printf("⚠️ Callback resume failed: %v", err)
+		return
+	}
+	for _, id := range ids {
+		DeliverCallback(cfg, id)
+	}
+}
+
+// attemptCallback makes one delivery attempt. It returns how long to wait
+// before the next one, or false when there is nothing more to do.
+func attemptCallback(cfg *config.Config, id string) (time.Duration, bool) {
+	// Claim the attempt: a short lease keeps other workers off it meanwhile
+	var apiKey string
+	var attempts int
+	err := db.QueryRow(context.Background(), `
+		UPDATE async_requests
+		SET callback_next_at = now() + interval '1 minute', callback_attempts = callback_attempts + 1
+		WHERE id = $1 AND callback_status = 'pending' AND (callback_next_at IS NULL OR callback_next_at <= now())
+		RETURNING api_key, callback_attempts
+	`, id).Scan(&apiKey, &attempts)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("⚠️ Callback %s: %v", id, err)
+		}
+		return 0, false
+	}
+
+	cb, err := LoadCallback(context.Background(), apiKey)
+	if cb == nil || err != nil {
+		setCallbackStatus(id, "failed") // Unregistered since the request finished
+		return 0, false
+	}
+	req, err := LoadAsyncRequest(context.Background(), id, apiKey)
+	if err != nil {
+		log.Printf("⚠️ Callback %s: %v", id, err)
+		return 0, false
+	}
+	req.Callback = nil
+	body, _ := json.Marshal(req)
+
+	if err = postCallback(cb, id, body); err == nil {
+		callbacksDelivered.Add(1)
+		setCallbackStatus(id, "delivered")
+		log.Printf("📬 Callback for %s delivered", id)
+		return 0, false
+	}
+	callbackFailures.Add(1)
+	if attempts >= max(cfg.CallbackMaxAttempts, 1) {
+		setCallbackStatus(id, "failed")
+		log.Printf("⚠️ Callback for %s failed for good after %d attempts: %v", id, attempts, err)
+		return 0, false
+	}
+
+	wait := cfg.CallbackRetryBackoff << (attempts - 1)
+	db.Exec(context.Background(), "UPDATE async_requests SET callback_next_at = now() + make_interval(secs => $2) WHERE id = $1", id, wait.Seconds())
+	log.Printf("⚠️ Callback for %s failed (attempt %d), retrying in %s: %v", id, attempts, wait, err)
+	return wait, true
+}
+
+func postCallback(cb *Callback, id string, body []byte) error {
+	if u, err := url.Parse(cb.URL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("callback url must be https") // Registered before https was required
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(asyncRunner.ctx, http.MethodPost, cb.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nexus-Request-Id", id)
+	req.Header.Set("X-Nexus-Timestamp", timestamp)
+	req.Header.Set("X-Nexus-Signature", SignCallback(cb.Secret, timestamp, body))
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func setCallbackStatus(id, status string) {
+	if _, err := db.Exec(context.Background(), "UPDATE async_requests SET callback_status = $2 WHERE id = $1", id, status); err != nil {
+		log.Printf("⚠️ Callback %s: %v", id, err)
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestSignCallback(t *testing.T) {
+	body := `{"id":"req_1","status":"completed"}`
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"completed request", "whsec_test", "1700000000", body, "sha256=95075b40bda6fe81ef897ecc09a9df12f772f4f2eadd8f00b6447001350031d0"},
+		{"timestamp is signed", "whsec_test", "1700000001", body, "sha256=14ef66eb9e0b8775085cdfa6d542f4a532a2ea46107358fefb2075d81be2fd67"},
+		{"empty body", "s3cr3t", "1712345678", "", "sha256=a382b82659ff5fcace05a7aa5662b56164f3792a244e7a2a97d7f41b396dd5a7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignCallback(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("SignCallback(%q, %q, %q) = %s, want %s", tt.secret, tt.timestamp, tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"100.64.0.1", false},      // Carrier-grade NAT
+		{"169.254.169.254", false}, // Cloud metadata endpoint
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false}, // IPv4-mapped loopback
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		if got := IsPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("IsPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://8.8.8.8/hooks/nexus", false},
+		{"http://8.8.8.8/hooks/nexus", true},
+		{"https://127.0.0.1/hooks", true},
+		{"https://[::1]:8443/hooks", true},
+		{"https://169.254.169.254/latest/meta-data", true},
+		{"/relative/path", true},
+		{"https:///no-host", true},
+	}
+	for _, tt := range tests {
+		err := validateCallbackURL(context.Background(), tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateCallbackURL(%q) = %v, want error: %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
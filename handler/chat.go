@@ -9,12 +9,29 @@ import (
 	"log"
 	"net/http"
 	"strings" // Added strings package
+	"time"
 )
 
 // Request Structure
 type ChatRequest struct {
-	Message string `json:"message"`
-	Model   string `json:"model"`
+	Message     string               `json:"message"`  // Single user turn (shorthand)
+	Messages    []Message            `json:"messages"` // Full conversation, oldest first
+	Model       string               `json:"model"`
+	Temperature *float64             `json:"temperature,omitempty"`
+	Tools       []json.RawMessage    `json:"tools,omitempty"` // Provider-native tool definitions
+	Tags        []string             `json:"tags,omitempty"`  // Free-form labels the cache policy can match
+	Cache       *CacheRequestOptions `json:"cache,omitempty"`
+	Async       bool                 `json:"async,omitempty"` // Answer later: poll /api/requests/{id} or get a callback
+	Template    *TemplateRef         `json:"template,omitempty"` // Render a stored prompt template first
+
+	// The template version the request was rendered from, logged once it
+	// is answered. Stored with async and batch requests; set by
+	// ApplyTemplate only, never taken from the client.
+	TemplateUsed *TemplateRef `json:"template_used,omitempty"`
+
+	// Set by thread runs, which check the token limit against the new turn
+	// only: the stored history is trimmed to fit the limit instead
+	tokensChecked bool
 }
 
 // Helper: Extract Key from Header
@@ -49,92 +66,218 @@ func GenerateHash(input string) string {
 
 func HandleChat(w http.ResponseWriter, r *http.Request) {
 	cfg := config.LoadConfig()
-	ctx := context.Background()
 	userKey := getAPIKey(r) // Get the key for logging
 
 	// 1. Parse Request
 	var userReq ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&userReq); err != nil {
+		if le := BodyLimitError(cfg, userKey, err); le != nil {
+			RefundRequest(userKey) // Cut off without a Content-Length, after the charge
+			le.Write(w)
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	// Templates are rendered up front, so async requests are stored rendered
+	if t, err := ApplyTemplate(r.Context(), &userReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if t != nil {
+		w.Header().Set("X-Nexus-Template", t.Ref())
+	}
+
+	// Async: queue it and return the request id right away
+	if userReq.Async {
+		HandleAsyncChat(w, r, cfg, userKey, userReq)
+		return
+	}
+
+	responseText, err := CompleteChat(r.Context(), cfg, w, r, userKey, userReq)
+	if err != nil {
+		if err.Limit != nil {
+			RefundRequest(userKey)
+		}
+		err.Write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"choices": []map[string]any{
+			{ "message": map[string]string{ "content": responseText } },
+		},
+	})
+}
+
+// ChatError is a failed chat request and the HTTP status it maps to
+type ChatError struct {
+	Status  int
+	Message string
+	Limit   *LimitError // Set for pre-flight 413s, which have a structured body
+}
+
+func (e *ChatError) Error() string { return e.Message }
+
+// Write sends the error as the response
+func (e *ChatError) Write(w http.ResponseWriter) {
+	if e.Limit != nil {
+		e.Limit.Write(w)
+		return
+	}
+	http.Error(w, e.Message, e.Status)
+}
+
+// CompleteChat answers one chat request through the cache tiers and the
+// provider, setting the X-Nexus-* headers on w. HandleChat and batch jobs
+// share it; the caller writes the body. HTTP callers pass r.Context(), so a
+// client that goes away cancels its upstream call.
+func CompleteChat(ctx context.Context, cfg *config.Config, w http.ResponseWriter, r *http.Request, userKey string, userReq ChatRequest) (string, *ChatError) {
 	if userReq.Model == "" {
 		userReq.Model = "gpt-3.5-turbo"
 	}
 
-	// 2. Generate Embedding
-	log.Println("🧠 Generating Embedding...")
-	vector, err := GetEmbedding(userReq.Message, cfg.OpenAIKey)
+	messages := userReq.Conversation()
+	if err := ValidateConversation(messages); err != nil {
+		return "", &ChatError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := CheckTextOnly(userReq); err != nil {
+		return "", &ChatError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	// Pre-flight: the key's token limit applies to the request as sent
+	limits := LimitsFor(cfg, userKey)
+	if !userReq.tokensChecked {
+		if le := limits.CheckTokens(userReq.Model, messages, userReq.Tools); le != nil {
+			return "", &ChatError{Status: http.StatusRequestEntityTooLarge, Message: le.Message, Limit: le}
+		}
+	}
+
+	// Long histories are trimmed to the model's context window (and the
+	// token limit) first
+	fit, err := FitContext(ctx, cfg, r, userKey, userReq.Model, messages, limits.MaxTokens)
+	if err != nil {
+		return "", &ChatError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	messages = fit.Messages
+	w.Header().Set("X-Nexus-Context-Trimmed", fit.Header())
+
+	cacheOpts, err := ResolveCacheOptions(r, cfg, userKey, userReq)
 	if err != nil {
-		log.Printf("Embedding Warning: %v", err)
-	}
-
-	// 3. SEMANTIC SEARCH (Cache Hit)
-	if vector != nil && cfg.PineconeKey != "" {
-		cachedAnswer, score, err := SearchPinecone(cfg.PineconeHost, cfg.PineconeKey, vector)
-		if err == nil {
-			log.Printf("🔍 Similarity Score: %.2f", score)
-			
-			if score > 0.85 {
-				log.Println("⚡ SEMANTIC HIT: Serving from Pinecone")
-				
-				client := GetClient()
-				if client != nil { client.Incr(ctx, "stats:cache_hits") }
-
-				// --- LOGGING (HIT) ---
-				LogRequest(userKey, userReq.Model, 200, true)
-				// ---------------------
-
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]any{
-					"choices": []map[string]any{
-						{ "message": map[string]string{ "content": cachedAnswer } },
-					},
-				})
-				return
-			}
+		return "", &ChatError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	// Policy rules (per key, org and global) can rule out reads and/or writes
+	if rule := ApplyCachePolicy(cfg, userKey, NewPolicyInput(r, userReq, messages), &cacheOpts); rule != "" {
+		w.Header().Set("X-Nexus-Cache-Policy", rule)
+	}
+
+	// The cache key covers the system prompt and recent turns, not just the
+	// last message; long histories skip the semantic tier entirely
+	cacheKey, keyOK, skipReason := CacheKeyText(cfg, messages)
+	if !keyOK {
+		log.Printf("⏭️ Skipping semantic cache: %s", skipReason)
+		cacheOpts.Read, cacheOpts.Write = false, false
+	}
+
+	// 2. Cache lookup: embedding, semantic search, near-hit adaptation
+	lookup := NewCacheLookup(cfg, userKey, cacheKey, cacheOpts)
+
+	// Latency-sensitive keys start the provider call alongside the lookup;
+	// anything other than a plain miss cancels it on the way out
+	var spec *SpeculativeCall
+	lookupStart := time.Now()
+	if lookup.CanRead() && IsSpeculative(cfg, userKey) {
+		if provider, err := GetProvider(userReq.Model, cfg.OpenAIKey, cfg.AnthropicKey); err == nil {
+			spec = StartSpeculativeCall(provider, userReq.Model, messages, SendOptions{Temperature: userReq.Temperature, Tools: userReq.Tools})
+			defer spec.Abandon()
 		}
 	}
 
+	lookup.Run(cfg, userReq.Model, messages)
+
+	// 3. Cache Hit (or adapted near-hit)
+	if lookup.Served() {
+		// --- LOGGING (HIT) ---
+		LogRequest(userKey, userReq.Model, 200, lookup.Status == CacheHit)
+		// ---------------------
+
+		lookup.Respond(cfg, w, userKey, userReq.Model, lookup.EntryID)
+		userReq.logTemplateUse(userKey)
+		return lookup.Answer, nil
+	}
+
 	// 4. ROUTER (Cache Miss)
-	log.Printf("🐢 CACHE MISS: Routing request to %s...", userReq.Model)
+	log.Printf("🐢 CACHE %s: Routing request to %s...", lookup.Status, userReq.Model)
 	
 	client := GetClient()
 	if client != nil { client.Incr(ctx, "stats:cache_misses") }
 
-	provider, err := GetProvider(userReq.Model, cfg.OpenAIKey, cfg.AnthropicKey)
-	if err != nil {
-		http.Error(w, "Invalid Model", http.StatusBadRequest)
-		return
+	// Identical requests already waiting on the LLM share its answer
+	var flight *Flight
+	leader := true
+	if key := FlightKey(cfg, lookup.Logical, userReq, cacheKey, cacheOpts); key != "" {
+		flight, leader = JoinFlight(ctx, cfg, key)
 	}
 
-	responseText, err := provider.Send(userReq.Message)
+	// The leader's call ends with its client, unless followers still wait
+	callCtx, cancel := flight.CallContext(ctx)
+	defer cancel()
+
+	var responseText string
+	if leader && spec != nil {
+		responseText, err = spec.Result(callCtx, time.Since(lookupStart))
+		if flight != nil {
+			if err == nil { flight.Publish(responseText) }
+			flight.Finish(responseText, err)
+		}
+	} else if leader {
+		var provider AIProvider
+		provider, err = GetProvider(userReq.Model, cfg.OpenAIKey, cfg.AnthropicKey)
+		if err != nil {
+			if flight != nil { flight.Finish("", err) }
+			return "", &ChatError{Status: http.StatusBadRequest, Message: "Invalid Model"}
+		}
+		responseText, err = provider.Send(callCtx, messages, SendOptions{Temperature: userReq.Temperature, Tools: userReq.Tools})
+		if flight != nil {
+			if err == nil { flight.Publish(responseText) }
+			flight.Finish(responseText, err)
+		}
+	} else {
+		if spec != nil { spec.Abandon() }
+		log.Println("🤝 Coalesced with an identical in-flight request")
+		w.Header().Set("X-Nexus-Coalesced", "true")
+		responseText, err = flight.Wait(ctx)
+	}
 	if err != nil {
 		log.Printf("Provider Error: %v", err)
+
+		// The provider refusing an oversized prompt is the client's error
+		if IsContextOverflow(err) {
+			LogRequest(userKey, userReq.Model, 400, false)
+			return "", &ChatError{Status: http.StatusBadRequest, Message: "Conversation exceeds the model's context window: " + err.Error()}
+		}
 		
 		// --- LOGGING (ERROR) ---
 		LogRequest(userKey, userReq.Model, 500, false)
 		// -----------------------
 
-		http.Error(w, "AI Provider Error: "+err.Error(), http.StatusBadGateway)
-		return
+		return "", &ChatError{Status: http.StatusBadGateway, Message: "AI Provider Error: " + err.Error()}
 	}
 
-	// 5. Save to Pinecone
-	if vector != nil && cfg.PineconeKey != "" {
-		id := GenerateHash(userReq.Message)
-		SaveToPinecone(cfg.PineconeHost, cfg.PineconeKey, id, vector, responseText)
+	// 5. Save to the vector store (queued; the background writer batches upserts)
+	// Coalesced followers got the leader's answer, which the leader saves
+	entryID := lookup.WritableID()
+	if leader {
+		lookup.Save(cfg, userReq.Model, responseText, nil)
 	}
 
 	// --- LOGGING (MISS / SUCCESS) ---
 	LogRequest(userKey, userReq.Model, 200, false)
 	// --------------------------------
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"choices": []map[string]any{
-			{ "message": map[string]string{ "content": responseText } },
-		},
-	})
-}
\ No newline at end of file
+	lookup.Respond(cfg, w, userKey, userReq.Model, entryID)
+	userReq.logTemplateUse(userKey)
+	return responseText, nil
+}
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Context windows: a conversation over the model's limit loses its oldest
+// turns before it goes upstream, so it doesn't come back as a 400 from the
+// provider. The strategy (CONTEXT_STRATEGY, or X-Nexus-Context-Strategy per
+// request) either drops them or folds them into a summary, and
+// X-Nexus-Context-Trimmed on the response says what happened.
+
+var (
+	contextTruncated  = Counter("nexus_context_truncated_total", "Requests whose oldest turns were dropped to fit the context window")
+	contextSummarized = Counter("nexus_context_summarized_total", "Requests whose oldest turns were summarized to fit the context window")
+)
+
+// modelContextWindows is each model's context limit in tokens. Unknown
+// models get gpt-3.5-turbo's, matching the provider fallback.
+var modelContextWindows = map[string]int{
+	"gpt-3.5-turbo":            16385,
+	"gpt-4":                    8192,
+	"gpt-4o":                   128000,
+	"gpt-4o-mini":              128000,
+	"claude-3-opus-20240229":   200000,
+	"claude-3-sonnet-20240229": 200000,
+	"claude-3-haiku-20240307":  200000,
+}
+
+// tokenProfile calibrates the token estimate for one tokenizer family.
+// The ratios lean low so estimates err on the side of too many tokens.
+type tokenProfile struct {
+	CharsPerToken float64 // ASCII text; every other rune counts as a token
+	PerMessage    int     // Role and framing tokens around each message
+	PerRequest    int     // Priming for the reply
+}
+
+var (
+	cl100kProfile    = tokenProfile{CharsPerToken: 3.7, PerMessage: 4, PerRequest: 3}
+	o200kProfile     = tokenProfile{CharsPerToken: 3.9, PerMessage: 4, PerRequest: 3}
+	anthropicProfile = tokenProfile{CharsPerToken: 3.4, PerMessage: 5, PerRequest: 8}
+
+	modelTokenProfiles = map[string]tokenProfile{
+		"gpt-3.5-turbo":            cl100kProfile,
+		"gpt-4":                    cl100kProfile,
+		"gpt-4o":                   o200kProfile,
+		"gpt-4o-mini":              o200kProfile,
+		"claude-3-opus-20240229":   anthropicProfile,
+		"claude-3-sonnet-20240229": anthropicProfile,
+		"claude-3-haiku-20240307":  anthropicProfile,
+	}
+)
+
+// contextOverflowMarkers identify a provider's "prompt too long" error
+var contextOverflowMarkers = []string{"context_length_exceeded", "maximum context length", "prompt is too long", "context window"}
+
+// summaryMaxTokens is the room a summary of the dropped turns may take
+const summaryMaxTokens = 512
+
+const summarySystemPrompt = `You condense the earlier part of a conversation so it can continue without it.
+Write a factual summary in at most 300 words: the user's goals, decisions made, facts and numbers given, and open questions.
+Do not add anything that was not said. Reply with the summary only.`
+
+func ContextWindow(model string) int {
+	if n, ok := modelContextWindows[model]; ok {
+		return n
+	}
+	return modelContextWindows["gpt-3.5-turbo"]
+}
+
+func tokenProfileFor(model string) tokenProfile {
+	if p, ok := modelTokenProfiles[model]; ok {
+		return p
+	}
+	return modelTokenProfiles["gpt-3.5-turbo"]
+}
+
+// CountTokens estimates how many tokens model's tokenizer makes of text
+func CountTokens(model, text string) int {
+	ascii, other := 0, 0
+	for _, c := range text {
+		if c < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(float64(ascii)/tokenProfileFor(model).CharsPerToken+0.999) + other
+}
+
+// CountMessageTokens estimates the prompt tokens of a whole request
+func CountMessageTokens(model string, messages []Message) int {
+	p := tokenProfileFor(model)
+	total := p.PerRequest
+	for _, m := range messages {
+		total += messageTokens(model, m)
+	}
+	return total
+}
+
+func messageTokens(model string, m Message) int {
+	return CountTokens(model, m.Content) + tokenProfileFor(model).PerMessage
+}
+
+// ContextFit is a conversation after FitContext
+type ContextFit struct {
+	Messages []Message
+	Strategy string // What trimmed it: "truncate" or "summarize" ("" if nothing did)
+	Removed  int    // Messages dropped or folded into the summary
+	Tokens   int    // Estimated prompt tokens
+}
+
+// Header is the X-Nexus-Context-Trimmed value: "none", or what was done to
+// how many messages, e.g. "summarized; messages=6"
+func (f ContextFit) Header() string {
+	switch f.Strategy {
+	case "truncate":
+		return fmt.Sprintf("truncated; messages=%d", f.Removed)
+	case "summarize":
+		return fmt.Sprintf("summarized; messages=%d", f.Removed)
+	}
+	return "none"
+}
+
+// FitContext makes a conversation fit model's window with
+// ContextReserveTokens left for the reply, and within maxTokens if that is
+// lower (the key's token limit, for histories kept server-side). System
+// prompts and the latest ContextKeepTurns messages (reaching back to a
+// user turn) are never touched, and what is kept always starts with a user
+// turn; an error means even they don't fit (or the strategy header is
+// invalid), which is the client's to fix. A summary is charged to apiKey.
+func FitContext(reqCtx context.Context, cfg *config.Config, r *http.Request, apiKey, model string, messages []Message, maxTokens int) (ContextFit, error) {
+	fit := ContextFit{Messages: messages, Tokens: CountMessageTokens(model, messages)}
+
+	strategy := cfg.ContextStrategy
+	if raw := r.Header.Get("X-Nexus-Context-Strategy"); raw != "" {
+		strategy = raw
+	}
+	switch strategy {
+	case "truncate", "summarize", "off":
+	default:
+		return fit, fmt.Errorf("invalid X-Nexus-Context-Strategy: %q", strategy)
+	}
+
+	budget := ContextWindow(model) - cfg.ContextReserveTokens
+	if maxTokens > 0 {
+		budget = min(budget, maxTokens)
+	}
+	if strategy == "off" || fit.Tokens <= budget {
+		return fit, nil
+	}
+
+	// 1. Droppable: non-system turns before the protected tail, oldest first.
+	// The tail reaches back to a user turn, so it never opens with a reply.
+	var candidates []int
+	protected, tailUser := 0, false
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "system" {
+			continue
+		}
+		if protected < max(cfg.ContextKeepTurns, 1) || !tailUser {
+			protected++
+			tailUser = messages[i].Role == "user"
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	slices.Reverse(candidates)
+
+	// 2. Drop until it fits, leaving room for a summary if one is wanted
+	target := budget
+	if strategy == "summarize" {
+		target -= summaryMaxTokens
+	}
+	drop := make([]bool, len(messages))
+	total := fit.Tokens
+	for _, i := range candidates {
+		if total <= target {
+			break
+		}
+		drop[i] = true
+		fit.Removed++
+		total -= messageTokens(model, messages[i])
+	}
+	// Providers refuse a conversation that opens with an assistant turn, so
+	// the replies left at the front go too, up to the next user turn
+	for _, i := range candidates {
+		if drop[i] {
+			continue
+		}
+		if fit.Removed == 0 || messages[i].Role == "user" {
+			break
+		}
+		drop[i] = true
+		fit.Removed++
+		total -= messageTokens(model, messages[i])
+	}
+	if total > budget {
+		return fit, fmt.Errorf("conversation needs ~%d tokens but fits in %d (%s, with %d kept for the reply), even after dropping older turns",
+			total, budget, model, cfg.ContextReserveTokens)
+	}
+
+	var dropped, kept []Message
+	summaryAt := -1
+	for i, m := range messages {
+		if drop[i] {
+			if summaryAt < 0 {
+				summaryAt = len(kept)
+			}
+			dropped = append(dropped, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	fit.Messages, fit.Tokens, fit.Strategy = kept, total, "truncate"
+
+	// 3. Summarize: the summary takes the dropped turns' place. Without room
+	// for it, or if the summary model fails, the turns are just dropped.
+	if strategy == "summarize" && total <= target {
+		summary, err := summarizeTurns(reqCtx, cfg, apiKey, dropped)
+		if err != nil {
+			log.Printf("⚠️ Context summary failed, dropping %d turns instead: %v", len(dropped), err)
+		} else {
+			note := Message{Role: "system", Content: "Summary of the earlier conversation:\n" + summary}
+			if total+messageTokens(model, note) <= budget {
+				fit.Messages = slices.Insert(kept, summaryAt, note)
+				fit.Tokens = total + messageTokens(model, note)
+				fit.Strategy = "summarize"
+			}
+		}
+	}
+
+	if fit.Strategy == "summarize" {
+		contextSummarized.Add(1)
+		log.Printf("🗜️ Summarized %d oldest messages to fit %s (~%d tokens)", fit.Removed, model, fit.Tokens)
+	} else {
+		contextTruncated.Add(1)
+		log.Printf("✂️ Dropped %d oldest messages to fit %s (~%d tokens)", fit.Removed, model, fit.Tokens)
+	}
+	return fit, nil
+}
+
+// summarizeTurns asks the summary model to condense turns. Summaries are
+// cached in Redis, so retries and replays of a conversation reuse them; a
+// new one is charged to apiKey like any other call it makes.
+func summarizeTurns(reqCtx context.Context, cfg *config.Config, apiKey string, turns []Message) (string, error) {
+	provider, err := GetProvider(cfg.ContextSummaryModel, cfg.OpenAIKey, cfg.AnthropicKey)
+	if err != nil {
+		return "", err
+	}
+
+	// The transcript keeps its latest part if it overflows the summary model too
+	budget := ContextWindow(cfg.ContextSummaryModel) - summaryMaxTokens - CountTokens(cfg.ContextSummaryModel, summarySystemPrompt) - 64
+	var lines []string
+	for i := len(turns) - 1; i >= 0; i-- {
+		line := turns[i].Role + ": " + turns[i].Content
+		if budget -= CountTokens(cfg.ContextSummaryModel, line) + 1; budget < 0 {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("turns too long for %s", cfg.ContextSummaryModel)
+	}
+	slices.Reverse(lines)
+	transcript := strings.Join(lines, "\n\n")
+
+	cacheKey := "context:summary:" + GenerateHash(cfg.ContextSummaryModel+"|"+transcript)
+	client := GetClient()
+	if client != nil {
+		if summary, err := client.Get(ctx, cacheKey).Result(); err == nil {
+			return summary, nil
+		}
+	}
+
+	summaryMessages := []Message{
+		{Role: "system", Content: summarySystemPrompt},
+		{Role: "user", Content: transcript},
+	}
+	summary, err := provider.Send(reqCtx, summaryMessages, SendOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	// The call is billed whether or not its summary is usable
+	usage := TokenUsage{
+		PromptTokens:     CountMessageTokens(cfg.ContextSummaryModel, summaryMessages),
+		CompletionTokens: CountTokens(cfg.ContextSummaryModel, summary),
+		Estimated:        true,
+	}
+	ChargeStreamUsage(apiKey, cfg.ContextSummaryModel, usage, http.StatusOK)
+	cost := EstimateCost(cfg.ContextSummaryModel, usage.PromptTokens, usage.CompletionTokens)
+	log.Printf("🗜️ Summary by %s cost ~$%.6f", cfg.ContextSummaryModel, cost)
+
+	if summary = strings.TrimSpace(summary); summary == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	if client != nil {
+		client.Set(ctx, cacheKey, summary, 24*time.Hour)
+	}
+	return summary, nil
+}
+
+// IsContextOverflow reports whether an upstream error is the provider
+// refusing a prompt that is too long for the model
+func IsContextOverflow(err error) bool {
+	var status int
+	var text string
+	var pe *ProviderError
+	var se *StreamError
+	switch {
+	case errors.As(err, &pe):
+		status, text = pe.Status, pe.Body
+	case errors.As(err, &se):
+		status, text = se.Status, se.Code+" "+se.Message
+	default:
+		return false
+	}
+	if status != http.StatusBadRequest && status != http.StatusRequestEntityTooLarge {
+		return false
+	}
+	text = strings.ToLower(text)
+	for _, marker := range contextOverflowMarkers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamFailureStatus is the status a failed upstream call is reported
+// with: the client's 400 for an oversized prompt, otherwise 502
+func UpstreamFailureStatus(err error) int {
+	if IsContextOverflow(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
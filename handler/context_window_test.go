@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{"gpt-4", "", 0},
+		{"gpt-4", "hello world", 3},                   // 11 chars at 3.7 per token, rounded up
+		{"gpt-4o", "hello world", 3},                  // 3.9 per token
+		{"claude-3-haiku-20240307", "hello world", 4}, // 3.4 per token
+		{"unknown-model", "hello world", 3},           // Falls back to gpt-3.5-turbo
+		{"gpt-4", "héllo", 3},                         // Non-ASCII runes count one each
+		{"gpt-4", "日本語", 3},
+		{"gpt-4", strings.Repeat("a", 370), 100},
+	}
+	for _, tt := range tests {
+		if got := CountTokens(tt.model, tt.text); got != tt.want {
+			t.Errorf("CountTokens(%q, %q) = %d, want %d", tt.model, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCountMessageTokens(t *testing.T) {
+	messages := []Message{{Role: "system", Content: "hello world"}, {Role: "user", Content: "hello world"}}
+	// 3 priming + 2 × (3 content + 4 framing)
+	if got := CountMessageTokens("gpt-4", messages); got != 17 {
+		t.Errorf("CountMessageTokens = %d, want 17", got)
+	}
+	// 8 priming + 2 × (4 content + 5 framing)
+	if got := CountMessageTokens("claude-3-haiku-20240307", messages); got != 26 {
+		t.Errorf("CountMessageTokens (anthropic) = %d, want 26", got)
+	}
+}
+
+func TestFitContext(t *testing.T) {
+	// Every turn is 10 content + 4 framing tokens for gpt-4; requests add 3
+	turn := func(role string, n int) Message {
+		return Message{Role: role, Content: strings.Repeat(string(rune('a'+n)), 37)}
+	}
+	system := Message{Role: "system", Content: "be brief"}
+	conversation := []Message{system, turn("user", 1), turn("assistant", 2), turn("user", 3), turn("assistant", 4), turn("user", 5)}
+
+	tests := []struct {
+		name         string
+		messages     []Message
+		keepTurns    int
+		maxTokens    int
+		header       string
+		wantKept     []Message
+		wantStrategy string
+		wantHeader   string
+		wantErr      bool
+	}{
+		{
+			name:     "fits as is",
+			messages: conversation, keepTurns: 2, maxTokens: 1000,
+			wantKept: conversation, wantHeader: "none",
+		},
+		{
+			name:     "oldest turns dropped, system prompt kept",
+			messages: conversation, keepTurns: 3, maxTokens: 60,
+			wantKept:     []Message{system, conversation[3], conversation[4], conversation[5]},
+			wantStrategy: "truncate", wantHeader: "truncated; messages=2",
+		},
+		{
+			name:     "a leading assistant turn goes too",
+			messages: conversation, keepTurns: 1, maxTokens: 75,
+			wantKept:     []Message{system, conversation[3], conversation[4], conversation[5]},
+			wantStrategy: "truncate", wantHeader: "truncated; messages=2",
+		},
+		{
+			name:     "the protected tail reaches back to a user turn",
+			messages: conversation, keepTurns: 2, maxTokens: 40,
+			wantErr: true, // user 3, assistant 4 and user 5 stay: 52 tokens with the system prompt
+		},
+		{
+			name:     "off sends everything",
+			messages: conversation, keepTurns: 1, maxTokens: 20, header: "off",
+			wantKept: conversation, wantHeader: "none",
+		},
+		{
+			name:     "invalid strategy header",
+			messages: conversation, keepTurns: 1, maxTokens: 1000, header: "shrink",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{ContextStrategy: "truncate", ContextKeepTurns: tt.keepTurns}
+			r := httptest.NewRequest("POST", "/api/chat", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Nexus-Context-Strategy", tt.header)
+			}
+
+			fit, err := FitContext(context.Background(), cfg, r, "nk-test", "gpt-4", tt.messages, tt.maxTokens)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("FitContext kept %d messages, want an error", len(fit.Messages))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FitContext: %v", err)
+			}
+			if !equalMessages(fit.Messages, tt.wantKept) {
+				t.Errorf("kept %v, want %v", roles(fit.Messages), roles(tt.wantKept))
+			}
+			if fit.Strategy != tt.wantStrategy || fit.Header() != tt.wantHeader {
+				t.Errorf("strategy %q / header %q, want %q / %q", fit.Strategy, fit.Header(), tt.wantStrategy, tt.wantHeader)
+			}
+			if want := CountMessageTokens("gpt-4", fit.Messages); fit.Tokens != want {
+				t.Errorf("Tokens = %d, want %d", fit.Tokens, want)
+			}
+		})
+	}
+}
+
+func equalMessages(a, b []Message) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func roles(messages []Message) []string {
+	out := make([]string, len(messages))
+	for i, m := range messages {
+		out[i] = m.Role
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"fmt"
+	"strings"
+)
+
+// Conversation returns the request as a message list. "message" alone is a
+// single user turn; with "messages" it is appended as the final user turn.
+func (req ChatRequest) Conversation() []Message {
+	messages := append([]Message(nil), req.Messages...)
+	if req.Message != "" {
+		messages = append(messages, Message{Role: "user", Content: req.Message})
+	}
+	return messages
+}
+
+// ValidateConversation checks the roles and that the last turn is the user's
+func ValidateConversation(messages []Message) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("message or messages is required")
+	}
+	for i, m := range messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+	}
+	if messages[len(messages)-1].Role != "user" {
+		return fmt.Errorf("the last message must come from the user")
+	}
+	return nil
+}
+
+// CheckTextOnly refuses tools where the answer is plain text (/api/chat,
+// async requests, batches, thread runs): a tool call would come back as an
+// empty answer. Streams carry tool_calls deltas, so tools belong there.
+func CheckTextOnly(req ChatRequest) error {
+	if len(req.Tools) > 0 {
+		return fmt.Errorf("tools are only supported on /api/chat/stream and /api/ws, which return tool calls")
+	}
+	return nil
+}
+
+// CacheKeyText builds the text that is embedded and hashed for the cache:
+// every system prompt plus the last user turn and up to CacheContextTurns
+// turns before it, assistant turns included, in a canonical form. A lone
+// user message is keyed by its own text, as before multi-turn requests.
+//
+// ok=false means the request should skip the semantic tier because it has
+// more history than a cached answer can be matched against reliably.
+func CacheKeyText(cfg *config.Config, messages []Message) (key string, ok bool, reason string) {
+	var system, turns []Message
+	for _, m := range messages {
+		if m.Role == "system" {
+			system = append(system, m)
+		} else {
+			turns = append(turns, m)
+		}
+	}
+
+	prior := len(turns) - 1
+	if cfg.CacheMaxHistoryTurns >= 0 && prior > cfg.CacheMaxHistoryTurns {
+		return "", false, fmt.Sprintf("history of %d turns exceeds %d", prior, cfg.CacheMaxHistoryTurns)
+	}
+
+	if len(system) == 0 && len(turns) == 1 {
+		return canonicalText(turns[0].Content), true, ""
+	}
+
+	window := turns
+	if keep := max(cfg.CacheContextTurns, 0) + 1; len(window) > keep {
+		window = window[len(window)-keep:]
+	}
+
+	var b strings.Builder
+	for _, m := range append(system, window...) {
+		b.WriteString(m.Role)
+		b.WriteString(": ")
+		b.WriteString(canonicalText(m.Content))
+		b.WriteString("\n")
+	}
+	key = strings.TrimSuffix(b.String(), "\n")
+
+	if cfg.CacheMaxKeyChars > 0 && len(key) > cfg.CacheMaxKeyChars {
+		return "", false, fmt.Sprintf("cache key of %d chars exceeds %d", len(key), cfg.CacheMaxKeyChars)
+	}
+	return key, true, ""
+}
+
+// canonicalText collapses whitespace so formatting noise doesn't change the key
+func canonicalText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -5,22 +5,28 @@ import (
 	"log"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var db *pgx.Conn
+// A pool, not a single connection: request logging and batch workers
+// query concurrently
+var db *pgxpool.Pool
 
 func InitializeDB(connString string) {
 	// 1. Parse Config
-	config, err := pgx.ParseConfig(connString)
+	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
 		log.Fatalf("❌ Invalid DB URL: %v", err)
 	}
 
 	// 2. FORCE Simple Protocol (Crucial for Supabase Pooler)
-	config.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
 
 	// 3. Connect
-	db, err = pgx.ConnectConfig(context.Background(), config)
+	db, err = pgxpool.NewWithConfig(context.Background(), config)
+	if err == nil {
+		err = db.Ping(context.Background()) // The pool connects lazily
+	}
 	if err != nil {
 		log.Fatalf("❌ Unable to connect to database: %v", err)
 	}
@@ -75,14 +81,52 @@ func IncrementUsage(apiKey string) {
 	}()
 }
 
+// RefundUsage takes back a +1 from IncrementUsage
+func RefundUsage(apiKey string) {
+	if db == nil { return }
+
+	go func() {
+		_, err := db.Exec(context.Background(), "UPDATE users SET requests_used = requests_used - 1 WHERE api_key=$1", apiKey)
+		if err != nil {
+			log.Printf("Failed to refund usage: %v", err)
+		}
+	}()
+}
+
+// ChargeTokens adds an upstream call's tokens to the user's token meter
+func ChargeTokens(apiKey string, tokens int) {
+	if db == nil || tokens <= 0 { return }
+
+	go func() {
+		_, err := db.Exec(context.Background(), "UPDATE users SET tokens_used = tokens_used + $2 WHERE api_key=$1", apiKey, tokens)
+		if err != nil {
+			log.Printf("Failed to charge tokens: %v", err)
+		}
+	}()
+}
+
+// ProRequestLimit is the request limit a paid upgrade sets
+const ProRequestLimit = 10000
+
+// UserPlan names the key's plan: "pro" once upgraded, otherwise "free"
+func UserPlan(apiKey string) string {
+	if db == nil { return "free" }
+
+	var limit int
+	err := db.QueryRow(context.Background(), "SELECT request_limit FROM users WHERE api_key=$1", apiKey).Scan(&limit)
+	if err != nil || limit < ProRequestLimit {
+		return "free"
+	}
+	return "pro"
+}
 
 // UpgradeUser boosts the limit to 10,000
 func UpgradeUser(apiKey string) error {
 	if db == nil { return nil }
 
 	// Set limit to 10,000 AND reset their usage to 0 (Fresh start)
-	query := `UPDATE users SET request_limit = 10000, requests_used = 0 WHERE api_key=$1`
-	_, err := db.Exec(context.Background(), query, apiKey)
+	query := `UPDATE users SET request_limit = $2, requests_used = 0 WHERE api_key=$1`
+	_, err := db.Exec(context.Background(), query, apiKey, ProRequestLimit)
 	
 	if err != nil {
 		log.Printf("❌ Failed to upgrade user: %v", err)
@@ -1,38 +1,122 @@
 package handler
 
 import (
+	"NexusGateway/config"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
-    // "io" <--- Removed this unused import
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+// 1. THE CONTRACT
+type Embedder interface {
+	// Name identifies the backend and model, e.g. "openai:text-embedding-3-small".
+	// Vectors from different names must never share a namespace.
+	Name() string
+	Embed(texts []string) ([][]float32, error)
+}
+
+// 2. THE FACTORY
+// A spec is "backend[:model]": "openai", "openai:text-embedding-3-large",
+// "ollama:nomic-embed-text" or "hash:256". EMBEDDER sets the default and
+// EMBEDDER_NAMESPACES="faq=ollama:nomic-embed-text" overrides per namespace.
+// A namespace filled by a re-embedding migration keeps the migration's embedder.
+func GetEmbedder(cfg *config.Config, namespace string) (Embedder, error) {
+	spec := cfg.Embedder
+	if s, ok := cfg.EmbedderNamespaces[namespace]; ok {
+		spec = s
+	}
+	if s := embedderSpecOverride(namespace); s != "" {
+		spec = s
+	}
+	return NewEmbedder(cfg, spec)
+}
+
+func NewEmbedder(cfg *config.Config, spec string) (Embedder, error) {
+	backend, model, _ := strings.Cut(spec, ":")
+	switch backend {
+	case "openai", "":
+		if cfg.OpenAIKey == "" {
+			return nil, fmt.Errorf("embedder %q needs OPENAI_API_KEY", spec)
+		}
+		if model == "" {
+			model = "text-embedding-3-small"
+		}
+		return &OpenAIEmbedder{APIKey: cfg.OpenAIKey, Model: model}, nil
+	case "ollama":
+		if model == "" {
+			model = "nomic-embed-text"
+		}
+		return &OllamaEmbedder{Host: cfg.OllamaHost, Model: model}, nil
+	case "hash":
+		dim := 256
+		if model != "" {
+			d, err := strconv.Atoi(model)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid hash embedder dimension %q", model)
+			}
+			dim = d
+		}
+		return &HashEmbedder{Dim: dim}, nil
+	default:
+		return nil, fmt.Errorf("unknown embedder %q", spec)
+	}
+}
+
+// EmbedOne converts a single text -> vector
+func EmbedOne(e Embedder, text string) ([]float32, error) {
+	vectors, err := e.Embed([]string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// ---------------------------
+// 3. OPENAI IMPLEMENTATION
+// ---------------------------
+type OpenAIEmbedder struct {
+	APIKey string
+	Model  string
+}
+
 type EmbeddingRequest struct {
-	Input string `json:"input"`
-	Model string `json:"model"`
+	Input []string `json:"input"`
+	Model string   `json:"model"`
 }
 
 type EmbeddingResponse struct {
 	Data []struct {
+		Index     int       `json:"index"`
 		Embedding []float32 `json:"embedding"`
 	} `json:"data"`
 }
 
-// GetEmbedding converts text -> vector
-func GetEmbedding(text string, apiKey string) ([]float32, error) {
+func (e *OpenAIEmbedder) Name() string { return "openai:" + e.Model }
+
+// Embed converts many texts -> vectors in a single API call
+func (e *OpenAIEmbedder) Embed(texts []string) ([][]float32, error) {
 	url := "https://api.openai.com/v1/embeddings"
-	
+
 	payload := EmbeddingRequest{
-		Input: text,
-		Model: "text-embedding-3-small", 
+		Input: texts,
+		Model: e.Model,
 	}
 
 	jsonPayload, _ := json.Marshal(payload)
 
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Authorization", "Bearer "+e.APIKey)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -50,9 +134,200 @@ func GetEmbedding(text string, apiKey string) ([]float32, error) {
 		return nil, err
 	}
 
-	if len(result.Data) == 0 {
-		return nil, fmt.Errorf("no embedding data returned")
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(result.Data))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// ---------------------------
+// 4. OLLAMA / LOCAL HTTP IMPLEMENTATION
+// ---------------------------
+type OllamaEmbedder struct {
+	Host  string // e.g. http://localhost:11434
+	Model string
+}
+
+func (e *OllamaEmbedder) Name() string { return "ollama:" + e.Model }
+
+func (e *OllamaEmbedder) Embed(texts []string) ([][]float32, error) {
+	payload := map[string]any{"model": e.Model, "input": texts}
+	jsonPayload, _ := json.Marshal(payload)
+
+	req, _ := http.NewRequest("POST", strings.TrimRight(e.Host, "/")+"/api/embed", bytes.NewBuffer(jsonPayload))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Ollama Embedding Error: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(result.Embeddings))
+	}
+	return result.Embeddings, nil
+}
+
+// ---------------------------
+// 5. DETERMINISTIC TEST IMPLEMENTATION
+// ---------------------------
+// HashEmbedder hashes words into a fixed number of buckets. It needs no API
+// key and always returns the same vector for the same text, so it suits
+// tests and local development. Texts sharing words land close together.
+type HashEmbedder struct {
+	Dim int
+}
+
+func (e *HashEmbedder) Name() string { return "hash:" + strconv.Itoa(e.Dim) }
+
+func (e *HashEmbedder) Embed(texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, e.Dim)
+		for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+			sum := sha256.Sum256([]byte(word))
+			bucket := binary.BigEndian.Uint32(sum[:4]) % uint32(e.Dim)
+			if sum[4]&1 == 0 {
+				v[bucket]++
+			} else {
+				v[bucket]--
+			}
+		}
+
+		var norm float64
+		for _, x := range v {
+			norm += float64(x) * float64(x)
+		}
+		if norm > 0 {
+			scale := float32(1 / math.Sqrt(norm))
+			for j := range v {
+				v[j] *= scale
+			}
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+// ---------------------------
+// 6. DIMENSION GUARD
+// ---------------------------
+// Each namespace is bound to the first embedder that writes to it, recorded
+// as "name:dimension" in Redis (or in memory without Redis). The dimension
+// is fixed per index, not per namespace, so each index is bound to the
+// first dimension written to any of its namespaces. Reads and writes from a
+// different embedder or dimension are refused, so vectors from different
+// models never mix. CheckEmbedderConfig runs the same check at startup.
+var (
+	embedderBindingsMu sync.Mutex
+	embedderBindings   = map[string]string{} // Binding key → value, without Redis
+)
+
+func embedderBindingKey(namespace string) string {
+	return "cache:ns_embedder:" + namespace
+}
+
+func indexDimensionKey(index string) string {
+	return "cache:index_dim:" + index
+}
+
+func embedderBinding(name string, dim int) string {
+	return name + ":" + strconv.Itoa(dim)
+}
+
+// bindEmbedderKey returns the value bound to key, binding want first if
+// bind is set and the key is free
+func bindEmbedderKey(key, want string, bind bool) string {
+	if client := GetClient(); client != nil {
+		if bind {
+			client.SetNX(context.Background(), key, want, 0)
+		}
+		bound, _ := client.Get(context.Background(), key).Result()
+		return bound
+	}
+	embedderBindingsMu.Lock()
+	defer embedderBindingsMu.Unlock()
+	if _, ok := embedderBindings[key]; !ok && bind {
+		embedderBindings[key] = want
+	}
+	return embedderBindings[key]
+}
+
+// CheckEmbedderBinding verifies (and on first use records) which embedder
+// owns a namespace and which dimension its index holds (see
+// CacheRoute.Index). bind=false only checks, for read paths.
+func CheckEmbedderBinding(index, namespace, name string, dim int, bind bool) error {
+	if bound := bindEmbedderKey(indexDimensionKey(index), strconv.Itoa(dim), bind); bound != "" && bound != strconv.Itoa(dim) {
+		return fmt.Errorf("index %q holds %s-dimensional vectors, refusing %s", index, bound, embedderBinding(name, dim))
+	}
+	want := embedderBinding(name, dim)
+	if bound := bindEmbedderKey(embedderBindingKey(namespace), want, bind); bound != "" && bound != want {
+		return fmt.Errorf("namespace %q holds %s vectors, refusing %s", namespace, bound, want)
 	}
+	return nil
+}
 
-	return result.Data[0].Embedding, nil
-}
\ No newline at end of file
+// CheckEmbedderConfig checks every configured embedder (EMBEDDER and
+// EMBEDDER_NAMESPACES) against what its namespace and index already hold,
+// so a mismatch is refused at startup rather than on every write. The
+// dimension comes from embedding a probe; an embedder that can't be
+// reached is only warned about, and checked again when it writes.
+func CheckEmbedderConfig(cfg *config.Config) error {
+	if GetVectorStore(cfg) == nil {
+		return nil
+	}
+	namespaces := []string{cfg.CacheNamespace}
+	for namespace := range cfg.EmbedderNamespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	slices.Sort(namespaces)
+
+	for _, logical := range slices.Compact(namespaces) {
+		route := ResolveCacheRoute(logical)
+		embedder, err := GetEmbedder(cfg, route.Namespace)
+		if err != nil {
+			return fmt.Errorf("namespace %q: %v", logical, err)
+		}
+		vector, err := EmbedOne(embedder, "dimension probe")
+		if err != nil {
+			log.Printf("⚠️ Could not probe embedder %s for namespace %q: %v", embedder.Name(), logical, err)
+			continue
+		}
+		if err := CheckEmbedderBinding(route.Index(cfg), route.Namespace, embedder.Name(), len(vector), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearEmbedderBinding forgets a namespace's embedder (after it is wiped).
+// Its index keeps its dimension: other namespaces may still use it.
+func ClearEmbedderBinding(namespace string) {
+	if client := GetClient(); client != nil {
+		client.Del(context.Background(), embedderBindingKey(namespace))
+		return
+	}
+	embedderBindingsMu.Lock()
+	delete(embedderBindings, embedderBindingKey(namespace))
+	embedderBindingsMu.Unlock()
+}
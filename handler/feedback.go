@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every chat response gets an X-Nexus-Response-Id. The id maps (in Redis, for
+// CacheFeedbackWindow) to the cache entry that produced or stored the answer,
+// so clients can later rate it with POST /api/feedback.
+
+// ResponseRecord is what a response id points to
+type ResponseRecord struct {
+	APIKey    string  `json:"api_key"`
+	Namespace string  `json:"namespace"`      // Physical namespace holding the entry
+	Logical   string  `json:"logical"`        // Logical namespace, for precision stats
+	Host      string  `json:"host,omitempty"` // Pinecone host of the physical namespace, if routed to another index
+	EntryID   string  `json:"entry_id"`       // "" when the answer was not cached
+	Cache     string  `json:"cache"`          // HIT, MISS or BYPASS
+	Score     float64 `json:"score"`
+	Model     string  `json:"model"`
+	At        int64   `json:"at"`
+}
+
+type FeedbackRequest struct {
+	ResponseID string `json:"response_id"`
+	Rating     string `json:"rating"` // "good" or "bad"
+	Comment    string `json:"comment"`
+}
+
+func responseKey(id string) string          { return "response:" + id }
+func feedbackGivenKey(id string) string     { return "feedback:given:" + id }
+func entryFeedbackKey(ns, id string) string { return "cache:feedback:" + ns + ":" + id }
+func precisionKey(logical string) string    { return "cache:precision:" + logical }
+
+// scoreBucket groups similarity scores in steps of 0.05 ("0.85" = 0.85-0.90)
+func scoreBucket(score float64) string {
+	return strconv.FormatFloat(math.Floor(score*20)/20, 'f', 2, 64)
+}
+
+// RecordResponse issues a response id and remembers what it refers to.
+// Served hits are also counted per score bucket for the precision dashboard.
+func RecordResponse(cfg *config.Config, w http.ResponseWriter, record ResponseRecord) {
+	client := GetClient()
+	if client == nil {
+		return
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	id := "resp_" + hex.EncodeToString(b)
+	record.At = time.Now().Unix()
+
+	data, _ := json.Marshal(record)
+	if err := client.Set(ctx, responseKey(id), data, cfg.CacheFeedbackWindow).Err(); err != nil {
+		log.Printf("⚠️ Response record failed: %v", err)
+		return
+	}
+	w.Header().Set("X-Nexus-Response-Id", id)
+
+	if record.Cache == CacheHit {
+		client.HIncrBy(ctx, precisionKey(record.Logical), scoreBucket(record.Score)+":hits", 1)
+	}
+}
+
+// HandleFeedback rates a response: POST /api/feedback
+// Only the API key that received the response may rate it, once.
+func HandleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	client := GetClient()
+	if client == nil {
+		http.Error(w, "Feedback needs Redis", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResponseID == "" {
+		http.Error(w, "response_id is required", http.StatusBadRequest)
+		return
+	}
+	req.Rating = strings.ToLower(req.Rating)
+	if req.Rating != "good" && req.Rating != "bad" {
+		http.Error(w, `rating must be "good" or "bad"`, http.StatusBadRequest)
+		return
+	}
+
+	// 1. Look up the response
+	data, err := client.Get(ctx, responseKey(req.ResponseID)).Bytes()
+	if err != nil {
+		http.Error(w, "Unknown or expired response_id", http.StatusNotFound)
+		return
+	}
+	var record ResponseRecord
+	json.Unmarshal(data, &record)
+	if apiKey := getAPIKey(r); apiKey == "" || apiKey != record.APIKey {
+		http.Error(w, "Unknown or expired response_id", http.StatusNotFound)
+		return
+	}
+	if ok, _ := client.SetNX(ctx, feedbackGivenKey(req.ResponseID), req.Rating, cfg.CacheFeedbackWindow).Result(); !ok {
+		http.Error(w, "Feedback already recorded for this response", http.StatusConflict)
+		return
+	}
+
+	// 2. Precision stats (semantic hits only)
+	if record.Cache == CacheHit {
+		client.HIncrBy(ctx, precisionKey(record.Logical), scoreBucket(record.Score)+":"+req.Rating, 1)
+	}
+	LogCacheFeedback(req.ResponseID, record, req.Rating, req.Comment)
+
+	// 3. Per-entry tally, evicting entries that collect too many bad ratings
+	resp := map[string]any{"response_id": req.ResponseID, "rating": req.Rating}
+	if record.EntryID != "" {
+		good, bad, evicted := applyEntryFeedback(cfg, record, req.Rating)
+		resp["entry_good"], resp["entry_bad"], resp["evicted"] = good, bad, evicted
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// applyEntryFeedback counts a rating against a cache entry and mirrors the
+// totals into its metadata. Once bad ratings outnumber good ones by
+// CacheFeedbackEvictAt, the entry is deleted.
+func applyEntryFeedback(cfg *config.Config, record ResponseRecord, rating string) (good, bad int64, evicted bool) {
+	client := GetClient()
+	key := entryFeedbackKey(record.Namespace, record.EntryID)
+	client.HIncrBy(ctx, key, rating, 1)
+	client.Expire(ctx, key, 30*24*time.Hour)
+	good, _ = client.HGet(ctx, key, "good").Int64()
+	bad, _ = client.HGet(ctx, key, "bad").Int64()
+
+	// The entry lives where it was served from, even if the logical
+	// namespace has been migrated since
+	store := CacheRoute{Logical: record.Logical, Namespace: record.Namespace, Host: record.Host}.Store(cfg)
+	if store == nil {
+		return good, bad, false
+	}
+
+	if cfg.CacheFeedbackEvictAt > 0 && bad-good >= int64(cfg.CacheFeedbackEvictAt) {
+		if err := store.Delete(record.Namespace, []string{record.EntryID}); err != nil {
+			log.Printf("⚠️ Feedback eviction failed: %v", err)
+			return good, bad, false
+		}
+		client.Del(ctx, key)
+		ForgetCacheHits(record.Namespace, record.EntryID)
+		MirrorDeleteToMigration(cfg, record.Namespace, []string{record.EntryID})
+		LogCacheAudit("feedback", "evict_entry", record.Namespace, record.EntryID, map[string]any{"good": good, "bad": bad})
+		return good, bad, true
+	}
+
+	fields := map[string]interface{}{"feedback_good": good, "feedback_bad": bad}
+	if err := store.UpdateMetadata(record.Namespace, record.EntryID, fields); err != nil {
+		log.Printf("⚠️ Feedback metadata update failed: %v", err)
+	}
+	return good, bad, false
+}
+
+// PrecisionBucket is one row of the precision dashboard
+type PrecisionBucket struct {
+	MinScore  float64  `json:"min_score"`
+	Hits      int64    `json:"hits"`
+	Good      int64    `json:"good"`
+	Bad       int64    `json:"bad"`
+	Precision *float64 `json:"precision"` // good / (good + bad); null without ratings
+}
+
+// HandleAdminCachePrecision shows rated hit quality per score bucket, and the
+// lowest threshold whose hits meet a target precision:
+// GET /api/admin/cache/precision?namespace=&target=0.95&min_ratings=20
+func HandleAdminCachePrecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := config.LoadConfig()
+	client := GetClient()
+	if client == nil {
+		http.Error(w, "Precision stats need Redis", http.StatusServiceUnavailable)
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	target, err := strconv.ParseFloat(r.URL.Query().Get("target"), 64)
+	if err != nil || target <= 0 || target > 1 {
+		target = 0.95
+	}
+	minRatings, err := strconv.Atoi(r.URL.Query().Get("min_ratings"))
+	if err != nil || minRatings < 1 {
+		minRatings = 20
+	}
+
+	counts, err := client.HGetAll(ctx, precisionKey(namespace)).Result()
+	if err != nil {
+		http.Error(w, "Redis Error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// 1. Fold "0.85:hits" / "0.85:good" / "0.85:bad" fields into buckets
+	byBucket := map[string]*PrecisionBucket{}
+	for field, value := range counts {
+		bucket, kind, _ := strings.Cut(field, ":")
+		minScore, err := strconv.ParseFloat(bucket, 64)
+		if err != nil {
+			continue
+		}
+		b, ok := byBucket[bucket]
+		if !ok {
+			b = &PrecisionBucket{MinScore: minScore}
+			byBucket[bucket] = b
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch kind {
+		case "hits":
+			b.Hits = n
+		case "good":
+			b.Good = n
+		case "bad":
+			b.Bad = n
+		}
+	}
+	buckets := make([]PrecisionBucket, 0, len(byBucket))
+	for _, b := range byBucket {
+		if rated := b.Good + b.Bad; rated > 0 {
+			p := float64(b.Good) / float64(rated)
+			b.Precision = &p
+		}
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].MinScore < buckets[j].MinScore })
+
+	// 2. Suggest the lowest threshold whose hits, taken together, meet the target
+	var suggested *float64
+	var good, bad int64
+	for i := len(buckets) - 1; i >= 0; i-- {
+		good += buckets[i].Good
+		bad += buckets[i].Bad
+		if good+bad >= int64(minRatings) && float64(good)/float64(good+bad) >= target {
+			t := buckets[i].MinScore
+			suggested = &t
+		}
+	}
+
+	threshold := cfg.CacheThreshold
+	writeJSON(w, http.StatusOK, map[string]any{
+		"namespace":           namespace,
+		"current_threshold":   threshold,
+		"target_precision":    target,
+		"min_ratings":         minRatings,
+		"suggested_threshold": suggested,
+		"buckets":             buckets,
+	})
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Pre-flight limits: a request's body size and estimated prompt tokens are
+// checked against the key's limits before anything goes upstream. Oversized
+// bodies are refused in AuthMiddleware, before they cost a credit.
+
+var requestsTooLarge = Counter("nexus_requests_too_large_total", "Requests refused by the pre-flight size or token limits")
+
+// RequestLimits are the limits that apply to one key, and where they came from
+type RequestLimits struct {
+	MaxBytes    int
+	MaxTokens   int    // 0 = only the model's context window
+	BytesScope  string // key, plan or default
+	TokensScope string
+	Plan        string
+}
+
+// LimitError is the body of a 413: {"error": {...}}
+type LimitError struct {
+	Type    string `json:"type"` // Always request_too_large
+	Code    string `json:"code"` // max_request_bytes or max_prompt_tokens
+	Message string `json:"message"`
+	Limit   int    `json:"limit"`
+	Actual  int    `json:"actual,omitempty"` // Unknown when a body is cut off at the limit
+	Scope   string `json:"scope"`            // Which limit applied: key, plan or default
+	Plan    string `json:"plan,omitempty"`
+}
+
+func (e *LimitError) Error() string { return e.Message }
+
+// Write sends the structured 413
+func (e *LimitError) Write(w http.ResponseWriter) {
+	writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{"error": e})
+}
+
+// LimitsFor resolves a key's limits: per-key settings, then its plan's,
+// then the defaults. The plan is only looked up if plan limits are set.
+func LimitsFor(cfg *config.Config, apiKey string) RequestLimits {
+	limits := RequestLimits{
+		MaxBytes: cfg.RequestMaxBytes, MaxTokens: cfg.RequestMaxTokens,
+		BytesScope: "default", TokensScope: "default",
+	}
+	if len(cfg.RequestMaxBytesPlans) > 0 || len(cfg.RequestMaxTokensPlans) > 0 {
+		limits.Plan = UserPlan(apiKey)
+		if n, ok := cfg.RequestMaxBytesPlans[limits.Plan]; ok {
+			limits.MaxBytes, limits.BytesScope = n, "plan"
+		}
+		if n, ok := cfg.RequestMaxTokensPlans[limits.Plan]; ok {
+			limits.MaxTokens, limits.TokensScope = n, "plan"
+		}
+	}
+	if n, ok := cfg.RequestMaxBytesKeys[apiKey]; ok {
+		limits.MaxBytes, limits.BytesScope = n, "key"
+	}
+	if n, ok := cfg.RequestMaxTokensKeys[apiKey]; ok {
+		limits.MaxTokens, limits.TokensScope = n, "key"
+	}
+	return limits
+}
+
+func (l RequestLimits) bytesError(actual int) *LimitError {
+	requestsTooLarge.Add(1)
+	message := fmt.Sprintf("request body is over the %d byte limit", l.MaxBytes)
+	if actual > 0 {
+		message = fmt.Sprintf("request body is %d bytes, over the %d byte limit", actual, l.MaxBytes)
+	}
+	return &LimitError{
+		Type: "request_too_large", Code: "max_request_bytes", Message: message,
+		Limit: l.MaxBytes, Actual: actual, Scope: l.BytesScope, Plan: l.Plan,
+	}
+}
+
+// CheckBytes refuses a body (or batch line) of n bytes over the limit
+func (l RequestLimits) CheckBytes(n int) *LimitError {
+	if l.MaxBytes > 0 && n > l.MaxBytes {
+		return l.bytesError(n)
+	}
+	return nil
+}
+
+// CheckTokens estimates a request's prompt tokens for its model (messages
+// and tool definitions) and refuses it if they are over the limit
+func (l RequestLimits) CheckTokens(model string, messages []Message, tools []json.RawMessage) *LimitError {
+	if l.MaxTokens <= 0 {
+		return nil
+	}
+	tokens := CountMessageTokens(model, messages)
+	for _, tool := range tools {
+		tokens += CountTokens(model, string(tool))
+	}
+	if tokens <= l.MaxTokens {
+		return nil
+	}
+	requestsTooLarge.Add(1)
+	return &LimitError{
+		Type: "request_too_large", Code: "max_prompt_tokens",
+		Message: fmt.Sprintf("prompt is ~%d tokens for %s, over the %d token limit", tokens, model, l.MaxTokens),
+		Limit:   l.MaxTokens, Actual: tokens, Scope: l.TokensScope, Plan: l.Plan,
+	}
+}
+
+// LimitBody refuses a body whose Content-Length is over the key's limit and
+// caps the rest, so decoding fails at the limit instead of reading on
+func LimitBody(w http.ResponseWriter, r *http.Request, cfg *config.Config, apiKey string) *LimitError {
+	limits := LimitsFor(cfg, apiKey)
+	if limits.MaxBytes <= 0 {
+		return nil
+	}
+	if r.ContentLength > int64(limits.MaxBytes) {
+		return limits.bytesError(int(r.ContentLength))
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limits.MaxBytes))
+	return nil
+}
+
+// LimitBatchBody is LimitBody for batch uploads, capped at BatchMaxBytes
+// in total (each line is still checked against the key's own limit)
+func LimitBatchBody(w http.ResponseWriter, r *http.Request, cfg *config.Config, apiKey string) *LimitError {
+	if cfg.BatchMaxBytes <= 0 {
+		return nil
+	}
+	if r.ContentLength > int64(cfg.BatchMaxBytes) {
+		return batchBytesError(cfg, int(r.ContentLength))
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.BatchMaxBytes))
+	return nil
+}
+
+func batchBytesError(cfg *config.Config, actual int) *LimitError {
+	requestsTooLarge.Add(1)
+	message := fmt.Sprintf("batch upload is over the %d byte limit", cfg.BatchMaxBytes)
+	if actual > 0 {
+		message = fmt.Sprintf("batch upload is %d bytes, over the %d byte limit", actual, cfg.BatchMaxBytes)
+	}
+	return &LimitError{
+		Type: "request_too_large", Code: "max_batch_bytes", Message: message,
+		Limit: cfg.BatchMaxBytes, Actual: actual, Scope: "default",
+	}
+}
+
+func batchLinesError(cfg *config.Config, lineNo int) *LimitError {
+	requestsTooLarge.Add(1)
+	return &LimitError{
+		Type: "request_too_large", Code: "max_batch_lines",
+		Message: fmt.Sprintf("line %d: batch upload is over the %d line limit", lineNo, cfg.BatchMaxLines),
+		Limit:   cfg.BatchMaxLines, Scope: "default",
+	}
+}
+
+// BodyLimitError turns a decode error from a body LimitBody cut off into
+// its 413, or returns nil for any other error
+func BodyLimitError(cfg *config.Config, apiKey string, err error) *LimitError {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return nil
+	}
+	return LimitsFor(cfg, apiKey).bytesError(0)
+}
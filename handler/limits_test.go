@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitsFor(t *testing.T) {
+	// Without a database every key is on the free plan
+	tests := []struct {
+		name string
+		cfg  config.Config
+		key  string
+		want RequestLimits
+	}{
+		{
+			name: "defaults",
+			cfg:  config.Config{RequestMaxBytes: 1 << 20},
+			key:  "nk-a",
+			want: RequestLimits{MaxBytes: 1 << 20, BytesScope: "default", TokensScope: "default"},
+		},
+		{
+			name: "plan limits",
+			cfg: config.Config{
+				RequestMaxBytes: 1 << 20, RequestMaxTokens: 4000,
+				RequestMaxBytesPlans: map[string]int{"free": 64 << 10}, RequestMaxTokensPlans: map[string]int{"pro": 32000},
+			},
+			key:  "nk-a",
+			want: RequestLimits{MaxBytes: 64 << 10, MaxTokens: 4000, BytesScope: "plan", TokensScope: "default", Plan: "free"},
+		},
+		{
+			name: "key limits beat plan limits",
+			cfg: config.Config{
+				RequestMaxBytes: 1 << 20, RequestMaxTokens: 4000,
+				RequestMaxBytesPlans: map[string]int{"free": 64 << 10}, RequestMaxTokensPlans: map[string]int{"free": 2000},
+				RequestMaxBytesKeys: map[string]int{"nk-a": 8 << 20}, RequestMaxTokensKeys: map[string]int{"nk-a": 0},
+			},
+			key:  "nk-a",
+			want: RequestLimits{MaxBytes: 8 << 20, MaxTokens: 0, BytesScope: "key", TokensScope: "key", Plan: "free"},
+		},
+		{
+			name: "other keys keep the defaults",
+			cfg: config.Config{
+				RequestMaxBytes: 1 << 20, RequestMaxTokens: 4000,
+				RequestMaxBytesKeys: map[string]int{"nk-a": 8 << 20},
+			},
+			key:  "nk-b",
+			want: RequestLimits{MaxBytes: 1 << 20, MaxTokens: 4000, BytesScope: "default", TokensScope: "default"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LimitsFor(&tt.cfg, tt.key); got != tt.want {
+				t.Errorf("LimitsFor(%q) = %+v, want %+v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBytes(t *testing.T) {
+	limits := RequestLimits{MaxBytes: 100, BytesScope: "plan", Plan: "free"}
+	tests := []struct {
+		size     int
+		wantCode string
+	}{
+		{50, ""},
+		{100, ""},
+		{101, "max_request_bytes"},
+	}
+	for _, tt := range tests {
+		le := limits.CheckBytes(tt.size)
+		switch {
+		case tt.wantCode == "" && le != nil:
+			t.Errorf("CheckBytes(%d) = %v, want nil", tt.size, le)
+		case tt.wantCode != "" && (le == nil || le.Code != tt.wantCode || le.Actual != tt.size || le.Scope != "plan"):
+			t.Errorf("CheckBytes(%d) = %+v, want code %s", tt.size, le, tt.wantCode)
+		}
+	}
+	if le := (RequestLimits{}).CheckBytes(1 << 30); le != nil {
+		t.Errorf("CheckBytes without a limit = %v, want nil", le)
+	}
+}
+
+func TestCheckTokens(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "hello world"}} // 10 tokens for gpt-4
+	tests := []struct {
+		name      string
+		maxTokens int
+		tools     int
+		wantLimit bool
+	}{
+		{"no limit", 0, 0, false},
+		{"under", 10, 0, false},
+		{"over", 9, 0, true},
+		{"tools count too", 10, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tools []json.RawMessage
+			for range tt.tools {
+				tools = append(tools, json.RawMessage(`{"type":"function","function":{"name":"lookup"}}`))
+			}
+			le := RequestLimits{MaxTokens: tt.maxTokens}.CheckTokens("gpt-4", messages, tools)
+			if (le != nil) != tt.wantLimit {
+				t.Errorf("CheckTokens = %v, want a limit error: %v", le, tt.wantLimit)
+			}
+			if le != nil && le.Code != "max_prompt_tokens" {
+				t.Errorf("code = %q, want max_prompt_tokens", le.Code)
+			}
+		})
+	}
+}
+
+func TestBodyLimitError(t *testing.T) {
+	cfg := &config.Config{RequestMaxBytes: 64}
+	// No Content-Length: the body is cut off while decoding
+	r := httptest.NewRequest("POST", "/api/chat", strings.NewReader(`{"message":"`+strings.Repeat("a", 100)+`"}`))
+	r.ContentLength = -1
+	if le := LimitBody(httptest.NewRecorder(), r, cfg, "nk-a"); le != nil {
+		t.Fatalf("LimitBody refused a body of unknown length: %v", le)
+	}
+	var req ChatRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if le := BodyLimitError(cfg, "nk-a", err); le == nil || le.Code != "max_request_bytes" || le.Limit != 64 {
+		t.Errorf("BodyLimitError(%v) = %+v, want max_request_bytes", err, le)
+	}
+	if le := BodyLimitError(cfg, "nk-a", errors.New("invalid character")); le != nil {
+		t.Errorf("BodyLimitError for a syntax error = %+v, want nil", le)
+	}
+}
+
+func TestBatchLinesError(t *testing.T) {
+	le := batchLinesError(&config.Config{BatchMaxLines: 2}, 3)
+	if le.Code != "max_batch_lines" || le.Limit != 2 || !strings.Contains(le.Message, "line 3") {
+		t.Errorf("batchLinesError = %+v", le)
+	}
+}
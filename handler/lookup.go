@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"log"
+	"net/http"
+)
+
+// CacheLookup carries one request through the cache tiers shared by the
+// plain and streaming chat handlers: namespace routing, embedding, semantic
+// search with verification, and near-hit adaptation.
+type CacheLookup struct {
+	Key       string // Canonical cache key text
+	Opts      CacheOptions
+	Logical   string // The key's logical namespace
+	Route     CacheRoute
+	Namespace string // Physical namespace the route points at
+	Store     VectorStore
+	Embedder  Embedder
+	Vector    []float32
+
+	Status   string  // HIT, ADAPTED, MISS or BYPASS
+	Score    float64 // Best similarity seen (or of the served entry)
+	Looked   bool    // The vector store was actually searched
+	Rejected string  // Why verification refused the best candidate, if it did
+	Answer   string  // Served answer for HIT and ADAPTED
+	EntryID  string  // Entry served (HIT) or written (ADAPTED)
+}
+
+// NewCacheLookup resolves where a key's cache lives. The key's logical
+// namespace may have been migrated to a new physical one.
+func NewCacheLookup(cfg *config.Config, apiKey, cacheKey string, opts CacheOptions) *CacheLookup {
+	logical := ResolveCacheNamespace(cfg, apiKey)
+	route := ResolveCacheRoute(logical)
+	return &CacheLookup{
+		Key:       cacheKey,
+		Opts:      opts,
+		Logical:   logical,
+		Route:     route,
+		Namespace: route.Namespace,
+		Store:     route.Store(cfg),
+		Status:    CacheBypass,
+	}
+}
+
+// CanRead reports whether Run will search the cache
+func (l *CacheLookup) CanRead() bool {
+	return l.Opts.Read && l.Store != nil
+}
+
+// Served reports whether Run produced an answer (HIT or ADAPTED)
+func (l *CacheLookup) Served() bool {
+	return l.Status == CacheHit || l.Status == CacheAdapted
+}
+
+// Run embeds the key and searches the cache. model and messages are the
+// request being answered, for savings accounting and adaptation.
+func (l *CacheLookup) Run(cfg *config.Config, model string, messages []Message) {
+	// 1. Generate Embedding (skipped entirely when the client bypasses the cache)
+	if (l.Opts.Read || l.Opts.Write) && l.Store != nil {
+		log.Println("🧠 Generating Embedding...")
+		var err error
+		l.Vector, l.Embedder, err = EmbedForCache(cfg, l.Route, l.Key, l.Opts.Write)
+		if err != nil {
+			log.Printf("Embedding Warning: %v", err)
+		}
+	}
+	if !l.Opts.Read || l.Vector == nil || l.Store == nil {
+		return
+	}
+
+	// 2. SEMANTIC SEARCH
+	// Entries older than the namespace TTL are filtered out by the store
+	filter := CacheFreshnessFilter(cfg, l.Logical)
+	matches, err := l.Store.Query(l.Namespace, l.Vector, max(cfg.CacheVerifyTopK, 1), filter)
+	if err != nil {
+		log.Printf("Vector Store Warning: %v", err)
+		return
+	}
+	l.Looked = true
+	l.Status = CacheMiss
+	if len(matches) > 0 {
+		l.Score = matches[0].Score
+	}
+	log.Printf("🔍 Similarity Score: %.2f (threshold %.2f)", l.Score, l.Opts.Threshold)
+
+	// Only serve a candidate that passes verification
+	client := GetClient()
+	match, reason := SelectVerifiedMatch(cfg, l.Key, l.Embedder.Name(), matches, l.Opts.Threshold)
+	if match == nil && reason != "below_threshold" {
+		l.Rejected = reason
+		if client != nil {
+			client.Incr(ctx, "stats:cache_rejected")
+		}
+	}
+
+	if match != nil {
+		log.Println("⚡ SEMANTIC HIT: Serving from vector cache")
+		if client != nil {
+			client.Incr(ctx, "stats:cache_hits")
+		}
+		RecordCacheHit(l.Store, l.Namespace, match)
+		RecordHitSavings(model, messages, match.Answer)
+
+		l.Status, l.Score, l.Answer, l.EntryID = CacheHit, match.Score, match.Answer, match.ID
+		return
+	}
+
+	// 3. Near-hit: a cheap model adapts the closest answer instead of a full call
+	near := SelectAdaptCandidate(cfg, l.Embedder.Name(), matches)
+	if near == nil {
+		return
+	}
+	adapted, err := AdaptCachedAnswer(cfg, model, messages, l.Key, near)
+	if err != nil {
+		log.Printf("Adaptation Warning: %v", err)
+		return
+	}
+	log.Printf("🪄 ADAPTED HIT: Rewrote entry %s (score %.2f)", near.ID, near.Score)
+
+	// The adapted answer becomes the entry for this request
+	l.Status, l.Score, l.Answer = CacheAdapted, near.Score, adapted
+	l.EntryID = l.Save(cfg, model, adapted, map[string]interface{}{"source": "adapted", "adapted_from": near.ID})
+}
+
+// WritableID is the id a fresh answer will be stored under ("" when this
+// request may not write to the cache)
+func (l *CacheLookup) WritableID() string {
+	if !l.Opts.Write || l.Vector == nil || l.Store == nil {
+		return ""
+	}
+	return GenerateHash(l.Key)
+}
+
+// Save queues an answer for the background writer and returns its entry id.
+// extra is merged into the entry metadata.
+func (l *CacheLookup) Save(cfg *config.Config, model, answer string, extra map[string]interface{}) string {
+	id := l.WritableID()
+	if id == "" {
+		return ""
+	}
+	metadata := NewCacheMetadata(model, l.Key, answer, l.Embedder.Name())
+	for k, v := range extra {
+		metadata[k] = v
+	}
+	EnqueueCacheWrite(cfg, CacheWrite{
+		Route:  l.Route,
+		Record: VectorRecord{ID: id, Values: l.Vector, Metadata: metadata},
+	})
+	return id
+}
+
+// Respond sets the cache headers and the response id for an answer about to
+// be sent. entryID is the entry the answer is (or will be) stored as.
+func (l *CacheLookup) Respond(cfg *config.Config, w http.ResponseWriter, apiKey, model, entryID string) {
+	if l.Rejected != "" {
+		w.Header().Set("X-Nexus-Cache-Rejected", l.Rejected)
+	}
+	RecordResponse(cfg, w, ResponseRecord{
+		APIKey: apiKey, Namespace: l.Namespace, Logical: l.Logical, Host: l.Route.Host,
+		EntryID: entryID, Cache: l.Status, Score: l.Score, Model: model,
+	})
+	SetCacheHeaders(w, l.Status, l.Score, l.Looked)
+}
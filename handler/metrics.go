@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// In-process metrics, served in the Prometheus text format at /api/metrics.
+// Counters only go up; gauges are read from a function at scrape time.
+var (
+	metricsMu sync.Mutex
+	counters  = map[string]*atomic.Int64{}
+	gauges    = map[string]func() float64{}
+	help      = map[string]string{}
+)
+
+// Counter returns the named counter, registering it on first use
+func Counter(name, description string) *atomic.Int64 {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	c, ok := counters[name]
+	if !ok {
+		c = &atomic.Int64{}
+		counters[name] = c
+		help[name] = description
+	}
+	return c
+}
+
+// RegisterGauge exposes a value computed at scrape time
+func RegisterGauge(name, description string, read func() float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gauges[name] = read
+	help[name] = description
+}
+
+// HandleMetrics writes every counter and gauge
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	names := make([]string, 0, len(counters)+len(gauges))
+	for name := range counters {
+		names = append(names, name)
+	}
+	for name := range gauges {
+		names = append(names, name)
+	}
+	metricsMu.Unlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		metricsMu.Lock()
+		c, isCounter := counters[name]
+		read := gauges[name]
+		description := help[name]
+		metricsMu.Unlock()
+
+		fmt.Fprintf(w, "# HELP %s %s\n", name, description)
+		if isCounter {
+			fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, c.Load())
+		} else {
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %g\n", name, name, read())
+		}
+	}
+}
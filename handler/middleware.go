@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"NexusGateway/config"
+	"crypto/subtle"
 	"log"
 	"net"
 	"net/http"
@@ -35,27 +37,79 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 		// <--- END FIX --->
 
-		// C. Check Quota (Do they have credits?)
-		allowed, err := CheckUserLimit(token)
-		if err != nil {
-			log.Printf("DB Error: %v", err)
-			http.Error(w, "Server Error", http.StatusInternalServerError)
+		// Reconnecting to a buffered stream doesn't cost another credit
+		if r.URL.Path == "/api/chat/stream" && r.Header.Get("Last-Event-ID") != "" {
+			next(w, r)
 			return
 		}
-		
-		if !allowed {
-			http.Error(w, "402 - Quota Exceeded. Upgrade your plan.", http.StatusPaymentRequired)
+
+		// Pre-flight: an oversized body is refused before it costs a credit
+		// (batch uploads have their own total cap; lines are checked one by one)
+		limitBody := LimitBody
+		if r.URL.Path == "/api/batches" {
+			limitBody = LimitBatchBody
+		}
+		if le := limitBody(w, r, config.LoadConfig(), token); le != nil {
+			le.Write(w)
 			return
 		}
 
-		// D. Increment Usage (Charge them 1 credit)
-		IncrementUsage(token)
+		// C + D. Check Quota and charge 1 credit
+		if status, message := ChargeRequest(token); status != http.StatusOK {
+			http.Error(w, message, status)
+			return
+		}
 
 		// E. Pass
 		next(w, r)
 	}
 }
 
+// RefundRequest gives back the credit ChargeRequest took, for a request
+// refused at pre-flight after it was charged: the token limit needs the
+// parsed body, so it is only checked in the handler. A 413 never costs a
+// credit, whichever limit refused it.
+func RefundRequest(token string) {
+	RefundUsage(token)
+}
+
+// ChargeRequest checks the key's quota and charges one credit. It returns
+// http.StatusOK, or the status and message to refuse the request with.
+func ChargeRequest(token string) (int, string) {
+	allowed, err := CheckUserLimit(token)
+	if err != nil {
+		log.Printf("DB Error: %v", err)
+		return http.StatusInternalServerError, "Server Error"
+	}
+
+	if !allowed {
+		return http.StatusPaymentRequired, "402 - Quota Exceeded. Upgrade your plan."
+	}
+
+	IncrementUsage(token)
+	return http.StatusOK, ""
+}
+
+// ADMIN MIDDLEWARE
+// Admin routes take the ADMIN_API_KEY instead of a user's nk- key
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.LoadConfig()
+		if cfg.AdminKey == "" {
+			http.Error(w, "Admin API disabled (ADMIN_API_KEY missing)", http.StatusServiceUnavailable)
+			return
+		}
+
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminKey)) != 1 {
+			http.Error(w, "Invalid Admin Key", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 // 2. RATE LIMIT MIDDLEWARE
 func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -64,31 +118,38 @@ func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			ip = r.RemoteAddr
 		}
 
-		key := "rate:" + ip
-		limit := 10 
-
-		client := GetClient()
-		if client != nil {
-			count, err := client.Incr(ctx, key).Result()
-			if err != nil {
-				next(w, r)
-				return
-			}
-
-			if count == 1 {
-				client.Expire(ctx, key, 1*time.Minute)
-			}
-
-			if count > int64(limit) {
-				log.Printf("🚫 BLOCKED IP: %s", ip)
-				http.Error(w, "429 - Too Many Requests", http.StatusTooManyRequests)
-				return
-			}
+		if !AllowRate(ip) {
+			http.Error(w, "429 - Too Many Requests", http.StatusTooManyRequests)
+			return
 		}
 		next(w, r)
 	}
 }
 
+// AllowRate counts a request against the IP's per-minute limit
+func AllowRate(ip string) bool {
+	key := "rate:" + ip
+	limit := 10 
+
+	client := GetClient()
+	if client != nil {
+		count, err := client.Incr(ctx, key).Result()
+		if err != nil {
+			return true
+		}
+
+		if count == 1 {
+			client.Expire(ctx, key, 1*time.Minute)
+		}
+
+		if count > int64(limit) {
+			log.Printf("🚫 BLOCKED IP: %s", ip)
+			return false
+		}
+	}
+	return true
+}
+
 
 
 
@@ -100,7 +161,8 @@ func CORSMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		
 		// 2. Allow specific methods and headers
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Cache-Control, X-Nexus-Cache-Threshold, X-Nexus-Cache-Refresh, X-Nexus-Tags, X-Nexus-Context-Strategy, Last-Event-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Nexus-Cache, X-Nexus-Cache-Score, X-Nexus-Cache-Rejected, X-Nexus-Cache-Policy, X-Nexus-Coalesced, X-Nexus-Response-Id, X-Nexus-Stream-Id, X-Nexus-Context-Trimmed, X-Nexus-Template")
 
 		// 3. Handle "Preflight" requests (Browsers ask "Can I?" before doing it)
 		if r.Method == "OPTIONS" {
@@ -0,0 +1,439 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ---------------------------
+// NAMESPACE ROUTES
+// ---------------------------
+// Clients always address a logical namespace. A route (stored in Redis) says
+// which physical namespace, and optionally which Pinecone index, currently
+// serves it. A migration switches over by rewriting the route in one SET.
+
+type CacheRoute struct {
+	Logical   string `json:"logical"`
+	Namespace string `json:"namespace"`      // Physical namespace
+	Host      string `json:"host,omitempty"` // Pinecone host override (new index)
+}
+
+func cacheRouteKey(logical string) string       { return "cache:ns_route:" + logical }
+func cacheLogicalKey(physical string) string    { return "cache:ns_logical:" + physical }
+func embedderSpecKey(physical string) string    { return "cache:ns_spec:" + physical }
+func cacheMigrationKey(id string) string        { return "cache:migration:" + id }
+func cacheMigrationLockKey(id string) string    { return "cache:migration_lock:" + id }
+func activeMigrationKey(physical string) string { return "cache:migration_active:" + physical }
+func migrationDeletesKey(id string) string      { return "cache:migration_deletes:" + id }
+
+// ResolveCacheRoute looks up where a logical namespace lives today
+func ResolveCacheRoute(logical string) CacheRoute {
+	route := CacheRoute{Logical: logical, Namespace: logical}
+	client := GetClient()
+	if client == nil {
+		return route
+	}
+	raw, err := client.Get(ctx, cacheRouteKey(logical)).Result()
+	if err != nil {
+		return route
+	}
+	if json.Unmarshal([]byte(raw), &route) != nil {
+		return CacheRoute{Logical: logical, Namespace: logical}
+	}
+	return route
+}
+
+// Store returns the vector store the route points at
+func (rt CacheRoute) Store(cfg *config.Config) VectorStore {
+	store := GetVectorStore(cfg)
+	if _, ok := store.(*PineconeStore); ok && rt.Host != "" {
+		return &PineconeStore{Host: rt.Host, APIKey: cfg.PineconeKey}
+	}
+	return store
+}
+
+// Index names the index the route's vectors live in, which fixes their
+// dimension: the Pinecone host, or the in-memory store
+func (rt CacheRoute) Index(cfg *config.Config) string {
+	if _, ok := GetVectorStore(cfg).(*PineconeStore); ok {
+		if rt.Host != "" {
+			return rt.Host
+		}
+		return cfg.PineconeHost
+	}
+	return cfg.VectorStore
+}
+
+// LogicalNamespace maps a physical namespace back to the logical one it serves
+func LogicalNamespace(physical string) string {
+	if client := GetClient(); client != nil {
+		if logical, err := client.Get(ctx, cacheLogicalKey(physical)).Result(); err == nil {
+			return logical
+		}
+	}
+	return physical
+}
+
+// embedderSpecOverride returns the embedder a migration bound to a physical namespace
+func embedderSpecOverride(physical string) string {
+	if client := GetClient(); client != nil {
+		if spec, err := client.Get(ctx, embedderSpecKey(physical)).Result(); err == nil {
+			return spec
+		}
+	}
+	return ""
+}
+
+// SetEmbedderSpec pins the embedder for a physical namespace, overriding
+// EMBEDDER / EMBEDDER_NAMESPACES
+func SetEmbedderSpec(physical, spec string) {
+	client := GetClient()
+	if client == nil {
+		return
+	}
+	if err := client.Set(ctx, embedderSpecKey(physical), spec, 0).Err(); err != nil {
+		log.Printf("⚠️ Failed to pin embedder for %q: %v", physical, err)
+	}
+}
+
+// ---------------------------
+// RE-EMBEDDING MIGRATIONS
+// ---------------------------
+
+type CacheMigration struct {
+	ID          string     `json:"id"`
+	Logical     string     `json:"logical"`
+	Source      CacheRoute `json:"source"`
+	Target      CacheRoute `json:"target"`
+	Embedder    string     `json:"embedder"` // Target embedder spec
+	Status      string     `json:"status"`   // running, completed, failed
+	Cursor      string     `json:"cursor"`   // Next page of the source namespace
+	Total       int        `json:"total"`
+	Processed   int        `json:"processed"`
+	Skipped     int        `json:"skipped"` // Entries without a stored prompt can't be re-embedded
+	Error       string     `json:"error,omitempty"`
+	StartedAt   int64      `json:"started_at"`
+	UpdatedAt   int64      `json:"updated_at"`
+	CompletedAt int64      `json:"completed_at,omitempty"`
+}
+
+type StartMigrationRequest struct {
+	Namespace       string `json:"namespace"`        // Logical namespace to migrate
+	TargetNamespace string `json:"target_namespace"` // New physical namespace
+	TargetHost      string `json:"target_host"`      // Optional: new Pinecone index
+	Embedder        string `json:"embedder"`         // New embedder spec
+}
+
+// StartCacheMigration validates and launches a migration in the background
+func StartCacheMigration(cfg *config.Config, req StartMigrationRequest) (*CacheMigration, error) {
+	client := GetClient()
+	if client == nil {
+		return nil, fmt.Errorf("migrations need Redis to track progress")
+	}
+	if GetVectorStore(cfg) == nil {
+		return nil, fmt.Errorf("vector store not configured")
+	}
+	if _, err := NewEmbedder(cfg, req.Embedder); err != nil {
+		return nil, err
+	}
+
+	source := ResolveCacheRoute(req.Namespace)
+	target := CacheRoute{Logical: req.Namespace, Namespace: req.TargetNamespace, Host: req.TargetHost}
+	if target.Namespace == "" || target.Namespace == source.Namespace {
+		return nil, fmt.Errorf("target_namespace must be set and differ from the current namespace %q", source.Namespace)
+	}
+
+	// Only one migration per source at a time
+	id := GenerateHash(fmt.Sprintf("%s|%s|%d", req.Namespace, req.TargetNamespace, time.Now().UnixNano()))[:16]
+	ok, err := client.SetNX(ctx, activeMigrationKey(source.Namespace), id, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("namespace %q already has a migration running", req.Namespace)
+	}
+
+	counts, _ := source.Store(cfg).Namespaces()
+	now := time.Now().Unix()
+	m := &CacheMigration{
+		ID:        id,
+		Logical:   req.Namespace,
+		Source:    source,
+		Target:    target,
+		Embedder:  req.Embedder,
+		Status:    "running",
+		Total:     counts[source.Namespace],
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if err := saveMigration(m); err != nil {
+		client.Del(ctx, activeMigrationKey(source.Namespace))
+		return nil, err
+	}
+	client.SAdd(ctx, "cache:migrations", id)
+
+	go runCacheMigration(cfg, id)
+	return m, nil
+}
+
+// ResumeCacheMigrations restarts every migration left running by a previous
+// process. Call once at startup.
+func ResumeCacheMigrations(cfg *config.Config) {
+	for _, m := range ListCacheMigrations() {
+		if m.Status == "running" {
+			log.Printf("🔁 Resuming cache migration %s (%d/%d)", m.ID, m.Processed, m.Total)
+			go runCacheMigration(cfg, m.ID)
+		}
+	}
+}
+
+// ResumeCacheMigration restarts a failed (or orphaned running) migration
+// from its last cursor. It is a no-op while another instance holds the lock.
+func ResumeCacheMigration(cfg *config.Config, id string) (*CacheMigration, error) {
+	m, err := GetCacheMigration(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status == "completed" {
+		return nil, fmt.Errorf("migration already completed")
+	}
+	m.Status = "running"
+	m.Error = ""
+	if err := saveMigration(m); err != nil {
+		return nil, err
+	}
+	go runCacheMigration(cfg, id)
+	return m, nil
+}
+
+func GetCacheMigration(id string) (*CacheMigration, error) {
+	client := GetClient()
+	if client == nil {
+		return nil, fmt.Errorf("migrations need Redis to track progress")
+	}
+	raw, err := client.Get(ctx, cacheMigrationKey(id)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("migration %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m CacheMigration
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListCacheMigrations returns every known migration, newest first
+func ListCacheMigrations() []CacheMigration {
+	migrations := []CacheMigration{}
+	client := GetClient()
+	if client == nil {
+		return migrations
+	}
+	ids, _ := client.SMembers(ctx, "cache:migrations").Result()
+	for _, id := range ids {
+		if m, err := GetCacheMigration(id); err == nil {
+			migrations = append(migrations, *m)
+		}
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].StartedAt > migrations[j].StartedAt })
+	return migrations
+}
+
+func saveMigration(m *CacheMigration) error {
+	m.UpdatedAt = time.Now().Unix()
+	raw, _ := json.Marshal(m)
+	return GetClient().Set(ctx, cacheMigrationKey(m.ID), raw, 0).Err()
+}
+
+// runCacheMigration copies the source namespace page by page, saving the
+// cursor after every page so a restart picks up where it left off. The
+// source keeps serving traffic until the final switch-over.
+func runCacheMigration(cfg *config.Config, id string) {
+	client := GetClient()
+
+	// Only one instance works on a migration; the lock is refreshed per page
+	lockKey := cacheMigrationLockKey(id)
+	if ok, _ := client.SetNX(ctx, lockKey, "1", time.Minute).Result(); !ok {
+		return
+	}
+	defer client.Del(ctx, lockKey)
+
+	m, err := GetCacheMigration(id)
+	if err != nil {
+		log.Printf("⚠️ Cache migration %s: %v", id, err)
+		return
+	}
+	fail := func(err error) {
+		m.Status = "failed"
+		m.Error = err.Error()
+		saveMigration(m)
+		log.Printf("❌ Cache migration %s failed: %v", id, err)
+	}
+
+	embedder, err := NewEmbedder(cfg, m.Embedder)
+	if err != nil {
+		fail(err)
+		return
+	}
+	source, target := m.Source.Store(cfg), m.Target.Store(cfg)
+
+	// 1. Copy page by page
+	for {
+		ids, next, err := source.List(m.Source.Namespace, m.Cursor)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if len(ids) > 0 {
+			records, err := source.Fetch(m.Source.Namespace, ids)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if err := migrateRecords(cfg, m, embedder, target, records); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		m.Cursor = next
+		if err := saveMigration(m); err != nil {
+			log.Printf("⚠️ Cache migration %s: progress not saved: %v", id, err)
+		}
+		client.Expire(ctx, lockKey, time.Minute)
+		if next == "" {
+			break
+		}
+	}
+
+	// 2. Delete again what was deleted from the source during the copy: a
+	// page fetched just before a delete may have copied the entry back
+	if deleted, _ := client.SMembers(ctx, migrationDeletesKey(id)).Result(); len(deleted) > 0 {
+		if err := target.Delete(m.Target.Namespace, deleted); err != nil {
+			fail(fmt.Errorf("replaying %d deletes failed: %v", len(deleted), err))
+			return
+		}
+	}
+
+	// 3. Switch over: bind the new embedder, then flip the route in one SET
+	SetEmbedderSpec(m.Target.Namespace, m.Embedder)
+	client.Set(ctx, cacheLogicalKey(m.Target.Namespace), m.Logical, 0)
+	route, _ := json.Marshal(m.Target)
+	if err := client.Set(ctx, cacheRouteKey(m.Logical), route, 0).Err(); err != nil {
+		fail(fmt.Errorf("switch-over failed: %v", err))
+		return
+	}
+	client.Del(ctx, activeMigrationKey(m.Source.Namespace), migrationDeletesKey(id))
+
+	m.Status = "completed"
+	m.CompletedAt = time.Now().Unix()
+	saveMigration(m)
+	log.Printf("✅ Cache migration %s complete: %q now served from %q (%d copied, %d skipped)", id, m.Logical, m.Target.Namespace, m.Processed, m.Skipped)
+}
+
+// migrateRecords re-embeds one page of entries from their stored prompts
+func migrateRecords(cfg *config.Config, m *CacheMigration, embedder Embedder, target VectorStore, records map[string]VectorRecord) error {
+	var prompts []string
+	var batch []VectorRecord
+	for id, record := range records {
+		prompt, _ := record.Metadata["prompt"].(string)
+		if prompt == "" {
+			m.Skipped++
+			continue
+		}
+		prompts = append(prompts, prompt)
+		batch = append(batch, VectorRecord{ID: id, Metadata: copyMetadata(record.Metadata)})
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	vectors, err := embedder.Embed(prompts)
+	if err != nil {
+		return err
+	}
+	if err := CheckEmbedderBinding(m.Target.Index(cfg), m.Target.Namespace, embedder.Name(), len(vectors[0]), true); err != nil {
+		return err
+	}
+	for i := range batch {
+		batch[i].Values = vectors[i]
+		batch[i].Metadata["embedder"] = embedder.Name()
+	}
+	if err := target.Upsert(m.Target.Namespace, batch); err != nil {
+		return err
+	}
+	m.Processed += len(batch)
+	return nil
+}
+
+// MirrorToMigration copies freshly written entries (cache writes, imports,
+// restores) into the target of a running migration, so entries written after
+// the cursor passed them aren't lost.
+func MirrorToMigration(cfg *config.Config, physical string, records []VectorRecord) {
+	m := activeMigration(physical)
+	if m == nil || m.Status != "running" || len(records) == 0 {
+		return
+	}
+	// Copied now: callers reuse their slices
+	pending := make(map[string]VectorRecord, len(records))
+	for _, record := range records {
+		pending[record.ID] = VectorRecord{ID: record.ID, Metadata: copyMetadata(record.Metadata)}
+	}
+
+	go func() {
+		embedder, err := NewEmbedder(cfg, m.Embedder)
+		if err != nil {
+			return
+		}
+		if err := migrateRecords(cfg, &CacheMigration{Target: m.Target}, embedder, m.Target.Store(cfg), pending); err != nil {
+			log.Printf("⚠️ Mirror to migration %s failed: %v", m.ID, err)
+		}
+	}()
+}
+
+// MirrorDeleteToMigration deletes entries from the target of a migration of
+// their namespace too, and records them so the switch-over deletes them again
+// should the copy have raced the delete.
+func MirrorDeleteToMigration(cfg *config.Config, physical string, ids []string) {
+	m := activeMigration(physical)
+	if m == nil || len(ids) == 0 {
+		return
+	}
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	if err := GetClient().SAdd(ctx, migrationDeletesKey(m.ID), members...).Err(); err != nil {
+		log.Printf("⚠️ Recording deletes for migration %s failed: %v", m.ID, err)
+	}
+	if err := m.Target.Store(cfg).Delete(m.Target.Namespace, ids); err != nil {
+		log.Printf("⚠️ Mirror delete to migration %s failed: %v", m.ID, err)
+	}
+}
+
+// activeMigration returns the migration copying a physical namespace, if any.
+// A failed one still counts: it can be resumed.
+func activeMigration(physical string) *CacheMigration {
+	client := GetClient()
+	if client == nil {
+		return nil
+	}
+	migrationID, err := client.Get(ctx, activeMigrationKey(physical)).Result()
+	if err != nil {
+		return nil
+	}
+	m, err := GetCacheMigration(migrationID)
+	if err != nil {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useMemoryStore gives the test an empty in-memory vector store
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	saved := memoryStore
+	memoryStore = &MemoryStore{namespaces: map[string]map[string]VectorRecord{}}
+	t.Cleanup(func() {
+		memoryStore = saved
+		embedderBindings = map[string]string{}
+	})
+}
+
+func seedEntries(t *testing.T, namespace string, ids ...string) {
+	t.Helper()
+	records := make([]VectorRecord, len(ids))
+	for i, id := range ids {
+		records[i] = VectorRecord{ID: id, Values: []float32{1, 0, 0, 0}, Metadata: NewCacheMetadata("gpt-4o", "question "+id, "answer "+id, "hash:4")}
+	}
+	if err := memoryStore.Upsert(namespace, records); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+}
+
+// startTestMigration records a running migration of faq → faq-v2 without
+// launching it, so the test decides when it runs
+func startTestMigration(t *testing.T, cursor string) *CacheMigration {
+	t.Helper()
+	m := &CacheMigration{
+		ID:       "mig-test",
+		Logical:  "faq",
+		Source:   CacheRoute{Logical: "faq", Namespace: "faq"},
+		Target:   CacheRoute{Logical: "faq", Namespace: "faq-v2"},
+		Embedder: "hash:8",
+		Status:   "running",
+		Cursor:   cursor,
+	}
+	if err := saveMigration(m); err != nil {
+		t.Fatalf("save migration: %v", err)
+	}
+	GetClient().Set(ctx, activeMigrationKey("faq"), m.ID, 0)
+	GetClient().SAdd(ctx, "cache:migrations", m.ID)
+	return m
+}
+
+func targetIDs(t *testing.T) map[string]bool {
+	t.Helper()
+	set := map[string]bool{}
+	err := ScanStore(memoryStore, "faq-v2", func(records map[string]VectorRecord) error {
+		for id := range records {
+			set[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scan target: %v", err)
+	}
+	return set
+}
+
+func TestMigrationDeletes(t *testing.T) {
+	useFakeRedis(t)
+	useMemoryStore(t)
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("VECTOR_STORE", "memory")
+	cfg := &config.Config{VectorStore: "memory"}
+
+	seedEntries(t, "faq", "a", "b", "c")
+	startTestMigration(t, "")
+	// The copy already passed b
+	memoryStore.Upsert("faq-v2", []VectorRecord{{ID: "b", Values: make([]float32, 8), Metadata: map[string]interface{}{"prompt": "question b"}}})
+
+	// 1. An admin delete reaches the target too
+	r := httptest.NewRequest(http.MethodDelete, "/api/admin/cache/entries/b?namespace=faq", nil)
+	r.SetPathValue("id", "b")
+	w := httptest.NewRecorder()
+	HandleAdminCacheEntry(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if targetIDs(t)["b"] {
+		t.Fatal("deleted entry still in the migration target")
+	}
+
+	// 2. A page fetched before the delete copies b back; the switch-over
+	// deletes it again
+	memoryStore.Upsert("faq-v2", []VectorRecord{{ID: "b", Values: make([]float32, 8), Metadata: map[string]interface{}{"prompt": "question b"}}})
+	runCacheMigration(cfg, "mig-test")
+
+	m, err := GetCacheMigration("mig-test")
+	if err != nil || m.Status != "completed" {
+		t.Fatalf("migration = %+v, %v; want completed", m, err)
+	}
+	if got := targetIDs(t); len(got) != 2 || !got["a"] || !got["c"] {
+		t.Errorf("target holds %v, want a and c", got)
+	}
+	if route := ResolveCacheRoute("faq"); route.Namespace != "faq-v2" {
+		t.Errorf("route = %+v, want faq-v2", route)
+	}
+	if n, _ := GetClient().Exists(ctx, activeMigrationKey("faq")).Result(); n != 0 {
+		t.Error("migration still marked active")
+	}
+}
+
+func TestMigrationRefusesNamespaceWipe(t *testing.T) {
+	useFakeRedis(t)
+	useMemoryStore(t)
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("VECTOR_STORE", "memory")
+
+	seedEntries(t, "faq", "a")
+	startTestMigration(t, "")
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/admin/cache/namespace?namespace=faq", nil)
+	w := httptest.NewRecorder()
+	HandleAdminCacheNamespace(w, r)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wipe during migration: %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestResumeCacheMigrations(t *testing.T) {
+	useFakeRedis(t)
+	useMemoryStore(t)
+	cfg := &config.Config{VectorStore: "memory"}
+
+	// Two and a half pages; the first was copied before the restart
+	var ids []string
+	for i := range memoryPageSize*2 + memoryPageSize/2 {
+		ids = append(ids, fmt.Sprintf("entry-%03d", i))
+	}
+	seedEntries(t, "faq", ids...)
+	m := startTestMigration(t, ids[memoryPageSize-1])
+	m.Processed = memoryPageSize
+	saveMigration(m)
+
+	// Another instance holds the lock: nothing happens
+	GetClient().Set(ctx, cacheMigrationLockKey(m.ID), "1", 0)
+	runCacheMigration(cfg, m.ID)
+	if got := targetIDs(t); len(got) != 0 {
+		t.Fatalf("copied %d entries without the lock", len(got))
+	}
+	GetClient().Del(ctx, cacheMigrationLockKey(m.ID))
+
+	ResumeCacheMigrations(cfg)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, _ = GetCacheMigration(m.ID)
+		if m.Status != "running" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Status != "completed" {
+		t.Fatalf("status = %q (%s), want completed", m.Status, m.Error)
+	}
+	if m.Processed != len(ids) {
+		t.Errorf("processed = %d, want %d", m.Processed, len(ids))
+	}
+	// Only the pages after the cursor were copied
+	got := targetIDs(t)
+	if len(got) != len(ids)-memoryPageSize || got[ids[0]] || !got[ids[len(ids)-1]] {
+		t.Errorf("target holds %d entries, want the %d after the cursor", len(got), len(ids)-memoryPageSize)
+	}
+}
@@ -6,96 +6,198 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 )
 
-type PineconeVector struct {
-	ID       string                 `json:"id"`
-	Values   []float32              `json:"values"`
-	Metadata map[string]interface{} `json:"metadata"`
-}
-
 type UpsertRequest struct {
-	Vectors []PineconeVector `json:"vectors"`
+	Vectors   []VectorRecord `json:"vectors"`
+	Namespace string         `json:"namespace,omitempty"`
 }
 
 type QueryRequest struct {
-	Vector          []float32 `json:"vector"`
-	TopK            int       `json:"topK"`
-	IncludeMetadata bool      `json:"includeMetadata"`
+	Vector          []float32              `json:"vector"`
+	TopK            int                    `json:"topK"`
+	IncludeMetadata bool                   `json:"includeMetadata"`
+	Namespace       string                 `json:"namespace,omitempty"`
+	Filter          map[string]interface{} `json:"filter,omitempty"`
 }
 
 type QueryResponse struct {
 	Matches []struct {
+		ID       string                 `json:"id"`
 		Score    float64                `json:"score"`
 		Metadata map[string]interface{} `json:"metadata"`
 	} `json:"matches"`
 }
 
-// SaveToPinecone stores the vector and the answer
-func SaveToPinecone(host, apiKey, id string, vector []float32, answer string) error {
+// UpsertPinecone stores vectors together with their metadata (the text
+// answer lives inside Pinecone under "response")
+func UpsertPinecone(host, apiKey, namespace string, vectors []VectorRecord) error {
 	url := fmt.Sprintf("https://%s/vectors/upsert", host)
 
-	payload := UpsertRequest{
-		Vectors: []PineconeVector{
-			{
-				ID:     id,
-				Values: vector,
-				Metadata: map[string]interface{}{
-					"response": answer, // We store the text answer inside Pinecone
-				},
-			},
-		},
+	// Pinecone accepts at most 1000 vectors per upsert
+	for start := 0; start < len(vectors); start += 1000 {
+		end := min(start+1000, len(vectors))
+		payload := UpsertRequest{Vectors: vectors[start:end], Namespace: namespace}
+		if err := pineconePost(url, apiKey, payload, nil); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	body, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	req.Header.Set("Api-Key", apiKey)
-	req.Header.Set("Content-Type", "application/json")
+// QueryPinecone returns the topK nearest entries that carry a stored answer
+func QueryPinecone(host, apiKey, namespace string, vector []float32, topK int, filter map[string]interface{}) ([]CacheMatch, error) {
+	url := fmt.Sprintf("https://%s/query", host)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	payload := QueryRequest{
+		Vector:          vector,
+		TopK:            topK,
+		IncludeMetadata: true,
+		Namespace:       namespace,
+		Filter:          filter,
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("pinecone upsert failed: %s", string(b))
+	var result QueryResponse
+	if err := pineconePost(url, apiKey, payload, &result); err != nil {
+		return nil, err
+	}
+
+	matches := []CacheMatch{}
+	for _, match := range result.Matches {
+		// Retrieve the stored text answer
+		if answer, ok := match.Metadata["response"].(string); ok {
+			matches = append(matches, CacheMatch{ID: match.ID, Score: match.Score, Answer: answer, Metadata: match.Metadata})
+		}
+	}
+	return matches, nil
+}
+
+// UpdatePineconeMetadata overwrites the given metadata fields of one vector
+func UpdatePineconeMetadata(host, apiKey, namespace, id string, fields map[string]interface{}) error {
+	url := fmt.Sprintf("https://%s/vectors/update", host)
+
+	payload := map[string]interface{}{
+		"id":          id,
+		"setMetadata": fields,
+		"namespace":   namespace,
+	}
+	return pineconePost(url, apiKey, payload, nil)
+}
+
+// ListPineconeIDs returns one page of vector ids and the token for the next page
+func ListPineconeIDs(host, apiKey, namespace, paginationToken string) ([]string, string, error) {
+	params := url.Values{}
+	params.Set("namespace", namespace)
+	params.Set("limit", "100")
+	if paginationToken != "" {
+		params.Set("paginationToken", paginationToken)
+	}
+
+	var result struct {
+		Vectors []struct {
+			ID string `json:"id"`
+		} `json:"vectors"`
+		Pagination struct {
+			Next string `json:"next"`
+		} `json:"pagination"`
+	}
+	if err := pineconeGet(fmt.Sprintf("https://%s/vectors/list?%s", host, params.Encode()), apiKey, &result); err != nil {
+		return nil, "", err
+	}
+
+	ids := make([]string, 0, len(result.Vectors))
+	for _, v := range result.Vectors {
+		ids = append(ids, v.ID)
+	}
+	return ids, result.Pagination.Next, nil
+}
+
+// FetchPinecone loads vectors (values and metadata) by id
+func FetchPinecone(host, apiKey, namespace string, ids []string) (map[string]VectorRecord, error) {
+	params := url.Values{}
+	params.Set("namespace", namespace)
+	for _, id := range ids {
+		params.Add("ids", id)
+	}
+
+	var result struct {
+		Vectors map[string]VectorRecord `json:"vectors"`
+	}
+	if err := pineconeGet(fmt.Sprintf("https://%s/vectors/fetch?%s", host, params.Encode()), apiKey, &result); err != nil {
+		return nil, err
+	}
+	return result.Vectors, nil
+}
+
+// DeleteFromPinecone removes vectors by id (Pinecone accepts up to 1000 per call)
+func DeleteFromPinecone(host, apiKey, namespace string, ids []string) error {
+	url := fmt.Sprintf("https://%s/vectors/delete", host)
+
+	for start := 0; start < len(ids); start += 1000 {
+		end := min(start+1000, len(ids))
+		payload := map[string]interface{}{"ids": ids[start:end], "namespace": namespace}
+		if err := pineconePost(url, apiKey, payload, nil); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// SearchPinecone looks for similar questions
-func SearchPinecone(host, apiKey string, vector []float32) (string, float64, error) {
-	url := fmt.Sprintf("https://%s/query", host)
+// DeletePineconeNamespace removes every vector in a namespace
+func DeletePineconeNamespace(host, apiKey, namespace string) error {
+	url := fmt.Sprintf("https://%s/vectors/delete", host)
+	return pineconePost(url, apiKey, map[string]interface{}{"deleteAll": true, "namespace": namespace}, nil)
+}
 
-	payload := QueryRequest{
-		Vector:          vector,
-		TopK:            1,
-		IncludeMetadata: true,
+// PineconeNamespaces returns every namespace in the index with its vector count
+func PineconeNamespaces(host, apiKey string) (map[string]int, error) {
+	url := fmt.Sprintf("https://%s/describe_index_stats", host)
+
+	var result struct {
+		Namespaces map[string]struct {
+			VectorCount int `json:"vectorCount"`
+		} `json:"namespaces"`
+	}
+	if err := pineconePost(url, apiKey, map[string]interface{}{}, &result); err != nil {
+		return nil, err
 	}
 
+	counts := map[string]int{}
+	for name, ns := range result.Namespaces {
+		counts[name] = ns.VectorCount
+	}
+	return counts, nil
+}
+
+// pineconePost sends a JSON body and decodes the reply into out (if not nil)
+func pineconePost(url, apiKey string, payload interface{}, out interface{}) error {
 	body, _ := json.Marshal(payload)
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	req.Header.Set("Api-Key", apiKey)
 	req.Header.Set("Content-Type", "application/json")
+	return pineconeDo(req, apiKey, out)
+}
+
+func pineconeGet(url, apiKey string, out interface{}) error {
+	req, _ := http.NewRequest("GET", url, nil)
+	return pineconeDo(req, apiKey, out)
+}
+
+func pineconeDo(req *http.Request, apiKey string, out interface{}) error {
+	req.Header.Set("Api-Key", apiKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", 0, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	var result QueryResponse
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	if len(result.Matches) > 0 {
-		match := result.Matches[0]
-		// Retrieve the stored text answer
-		if answer, ok := match.Metadata["response"].(string); ok {
-			return answer, match.Score, nil
-		}
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pinecone %s failed: %s", req.URL.Path, string(b))
 	}
-
-	return "", 0, nil
-}
\ No newline at end of file
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CachePolicy decides which requests may read from or write to the cache.
+// It is loaded from CACHE_POLICY_FILE (or inline JSON in CACHE_POLICY):
+//
+//	{
+//	  "global": [{"name": "hot-temperature", "min_temperature": 0.7}],
+//	  "keys":   {"nk-123": [{"name": "opted-out"}]},
+//	  "orgs":   {"acme": {"keys": ["nk-456"], "rules": [{"name": "acme-pii", "pii": true}]}}
+//	}
+//
+// Rules are checked key first, then org (orgs in name order), then global;
+// the first rule that matches decides each direction. A request no rule matches is cacheable.
+type CachePolicy struct {
+	Global []PolicyRule            `json:"global"`
+	Keys   map[string][]PolicyRule `json:"keys"`
+	Orgs   map[string]PolicyOrg    `json:"orgs"`
+}
+
+type PolicyOrg struct {
+	Keys  []string     `json:"keys"`
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches when every condition it sets holds; a rule with no
+// conditions matches everything (e.g. a key whose owner opted out).
+type PolicyRule struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`  // "bypass" (default) or "allow"
+	Applies string `json:"applies"` // "read", "write" or "both" (default)
+
+	Models         []string `json:"models"`          // Glob patterns, e.g. "claude-*"
+	MinTemperature *float64 `json:"min_temperature"` // Matches at or above this temperature
+	Tools          *bool    `json:"tools"`           // Matches requests with (true) or without (false) tools
+	MinPromptChars int      `json:"min_prompt_chars"`
+	Pattern        string   `json:"pattern"` // Regex over the conversation text
+	PII            bool     `json:"pii"`     // Matches emails, phone, card and SSN numbers
+	Tags           []string `json:"tags"`    // Matches when the request carries any of these
+
+	pattern *regexp.Regexp
+}
+
+// PolicyInput is what rules are evaluated against
+type PolicyInput struct {
+	Model       string
+	Temperature *float64
+	HasTools    bool
+	Text        string // Every message, newline-separated
+	Tags        []string
+}
+
+// PolicyDecision is the outcome for one request. The rule fields name the
+// rule that bypassed that direction, if any.
+type PolicyDecision struct {
+	Read      bool
+	Write     bool
+	ReadRule  string
+	WriteRule string
+}
+
+// NewPolicyInput collects the request fields the rules look at. Tags come
+// from the body and the comma-separated X-Nexus-Tags header.
+func NewPolicyInput(r *http.Request, req ChatRequest, messages []Message) PolicyInput {
+	texts := make([]string, len(messages))
+	for i, m := range messages {
+		texts[i] = m.Content
+	}
+
+	tags := append([]string(nil), req.Tags...)
+	for _, tag := range strings.Split(r.Header.Get("X-Nexus-Tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return PolicyInput{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		HasTools:    len(req.Tools) > 0,
+		Text:        strings.Join(texts, "\n"),
+		Tags:        tags,
+	}
+}
+
+// Evaluate decides read and write eligibility for an API key
+func (p *CachePolicy) Evaluate(apiKey string, in PolicyInput) PolicyDecision {
+	decision := PolicyDecision{Read: true, Write: true}
+	if p == nil {
+		return decision
+	}
+
+	// Most specific scope first; a key in several orgs gets their rules in
+	// org name order
+	scopes := [][]PolicyRule{p.Keys[apiKey]}
+	for _, name := range slices.Sorted(maps.Keys(p.Orgs)) {
+		if slices.Contains(p.Orgs[name].Keys, apiKey) {
+			scopes = append(scopes, p.Orgs[name].Rules)
+		}
+	}
+	scopes = append(scopes, p.Global)
+
+	readDecided, writeDecided := false, false
+	for _, rules := range scopes {
+		for _, rule := range rules {
+			if readDecided && writeDecided {
+				return decision
+			}
+			if !rule.matches(in) {
+				continue
+			}
+			bypass := rule.Action != "allow"
+			if !readDecided && rule.Applies != "write" {
+				readDecided = true
+				if bypass {
+					decision.Read, decision.ReadRule = false, rule.Name
+				}
+			}
+			if !writeDecided && rule.Applies != "read" {
+				writeDecided = true
+				if bypass {
+					decision.Write, decision.WriteRule = false, rule.Name
+				}
+			}
+		}
+	}
+	return decision
+}
+
+func (rule PolicyRule) matches(in PolicyInput) bool {
+	if len(rule.Models) > 0 {
+		found := false
+		for _, pattern := range rule.Models {
+			if ok, _ := path.Match(pattern, in.Model); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.MinTemperature != nil && (in.Temperature == nil || *in.Temperature < *rule.MinTemperature) {
+		return false
+	}
+	if rule.Tools != nil && *rule.Tools != in.HasTools {
+		return false
+	}
+	if rule.MinPromptChars > 0 && len(in.Text) < rule.MinPromptChars {
+		return false
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(in.Text) {
+		return false
+	}
+	if rule.PII && !ContainsPII(in.Text) {
+		return false
+	}
+	if len(rule.Tags) > 0 {
+		found := false
+		for _, want := range rule.Tags {
+			for _, tag := range in.Tags {
+				if strings.EqualFold(want, tag) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ---------------------------
+// PII DETECTION
+// ---------------------------
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[\s.\-]?)?\(?\d{3}\)?[\s.\-]\d{3}[\s.\-]\d{4}\b`)
+	ssnPattern   = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	cardPattern  = regexp.MustCompile(`\b(?:\d[ \-]?){13,19}\b`)
+)
+
+// ContainsPII reports whether text looks like it holds personal data.
+// Card numbers must also pass the Luhn check to cut false positives.
+func ContainsPII(text string) bool {
+	if emailPattern.MatchString(text) || phonePattern.MatchString(text) || ssnPattern.MatchString(text) {
+		return true
+	}
+	for _, candidate := range cardPattern.FindAllString(text, -1) {
+		if luhnValid(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func luhnValid(s string) bool {
+	var digits []int
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) < 13 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// ---------------------------
+// LOADING
+// ---------------------------
+// The policy is parsed once per source (file path + modification time, or the
+// inline JSON) so it can be edited without a restart. A broken edit keeps the
+// last good policy in place.
+var (
+	cachePolicyMu     sync.Mutex
+	cachePolicySource string
+	cachePolicy       *CachePolicy
+)
+
+// LoadCachePolicy returns the configured policy (nil when none is set)
+func LoadCachePolicy(cfg *config.Config) (*CachePolicy, error) {
+	raw := []byte(cfg.CachePolicy)
+	source := "inline:" + cfg.CachePolicy
+	if cfg.CachePolicyFile != "" {
+		info, err := os.Stat(cfg.CachePolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		source = fmt.Sprintf("file:%s@%d", cfg.CachePolicyFile, info.ModTime().UnixNano())
+	}
+
+	cachePolicyMu.Lock()
+	defer cachePolicyMu.Unlock()
+	if source == cachePolicySource {
+		return cachePolicy, nil
+	}
+
+	if cfg.CachePolicyFile != "" {
+		var err error
+		if raw, err = os.ReadFile(cfg.CachePolicyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	policy, err := ParseCachePolicy(raw)
+	if err != nil {
+		return nil, err
+	}
+	cachePolicySource, cachePolicy = source, policy
+	return policy, nil
+}
+
+// ParseCachePolicy parses and validates policy JSON
+func ParseCachePolicy(raw []byte) (*CachePolicy, error) {
+	if len(strings.TrimSpace(string(raw))) == 0 {
+		return nil, nil
+	}
+
+	var policy CachePolicy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return nil, fmt.Errorf("invalid cache policy: %v", err)
+	}
+
+	compile := func(scope string, rules []PolicyRule) error {
+		for i := range rules {
+			rule := &rules[i]
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("%s[%d]", scope, i)
+			}
+			switch rule.Action {
+			case "", "bypass", "allow":
+			default:
+				return fmt.Errorf("rule %s: unknown action %q", rule.Name, rule.Action)
+			}
+			switch rule.Applies {
+			case "", "both", "read", "write":
+			default:
+				return fmt.Errorf("rule %s: unknown applies %q", rule.Name, rule.Applies)
+			}
+			for _, pattern := range rule.Models {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %s: bad model pattern %q", rule.Name, pattern)
+				}
+			}
+			if rule.Pattern != "" {
+				re, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					return fmt.Errorf("rule %s: %v", rule.Name, err)
+				}
+				rule.pattern = re
+			}
+		}
+		return nil
+	}
+
+	if err := compile("global", policy.Global); err != nil {
+		return nil, err
+	}
+	for key, rules := range policy.Keys {
+		if err := compile("key", rules); err != nil {
+			return nil, err
+		}
+		policy.Keys[key] = rules
+	}
+	for name, org := range policy.Orgs {
+		if err := compile("org:"+name, org.Rules); err != nil {
+			return nil, err
+		}
+		policy.Orgs[name] = org
+	}
+	return &policy, nil
+}
+
+// ApplyCachePolicy narrows the cache options with the policy decision and
+// logs each direction a rule turned off. Returns the name of the blocking
+// rule (reads first), or "" when the request is fully cacheable.
+func ApplyCachePolicy(cfg *config.Config, apiKey string, in PolicyInput, opts *CacheOptions) string {
+	policy, err := LoadCachePolicy(cfg)
+	if err != nil {
+		log.Printf("⚠️ Cache policy error (keeping last good policy): %v", err)
+		cachePolicyMu.Lock()
+		policy = cachePolicy
+		cachePolicyMu.Unlock()
+	}
+
+	decision := policy.Evaluate(apiKey, in)
+	if opts.Read && !decision.Read {
+		opts.Read = false
+		LogCacheBypass(apiKey, in.Model, "read", decision.ReadRule)
+	}
+	if opts.Write && !decision.Write {
+		opts.Write = false
+		LogCacheBypass(apiKey, in.Model, "write", decision.WriteRule)
+	}
+	if !decision.Read {
+		return decision.ReadRule
+	}
+	return decision.WriteRule
+}
+
+// policyBypassKey counts bypasses per rule in Redis
+func policyBypassKey(rule string) string {
+	return "stats:cache_bypass:" + rule
+}
@@ -0,0 +1,81 @@
+package handler
+
+import "testing"
+
+func TestContainsPII(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"plain question", "How do I reset my password?", false},
+		{"email", "Write to jane.doe@example.com about it", true},
+		{"phone", "Call me at (555) 123-4567 tomorrow", true},
+		{"international phone", "My number is +44 207 946 0958", true},
+		{"ssn", "SSN 123-45-6789", true},
+		{"card passing luhn", "Card 4111 1111 1111 1111 expires soon", true},
+		{"card digits failing luhn", "Order 4111 1111 1111 1112 shipped", false},
+		{"short number", "Invoice 12345 is due", false},
+		{"version string", "Upgrade from 1.2.3 to 1.2.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContainsPII(tt.text); got != tt.want {
+				t.Errorf("ContainsPII(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4111111111111111", true},
+		{"4111-1111-1111-1111", true},
+		{"5500 0000 0000 0004", true},
+		{"378282246310005", true}, // 15-digit Amex
+		{"4111111111111112", false},
+		{"0000000000000", true}, // All zeros sums to 0
+		{"411111111111", false}, // Too short to be a card
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateOrgOrder(t *testing.T) {
+	// nk-shared belongs to both orgs, whose rules disagree
+	policy := &CachePolicy{
+		Keys: map[string][]PolicyRule{"nk-own": {{Name: "own-allow", Action: "allow"}}},
+		Orgs: map[string]PolicyOrg{
+			"zeta":  {Keys: []string{"nk-shared", "nk-own"}, Rules: []PolicyRule{{Name: "zeta-bypass"}}},
+			"acme":  {Keys: []string{"nk-shared"}, Rules: []PolicyRule{{Name: "acme-allow", Action: "allow"}}},
+			"mango": {Keys: []string{"nk-shared"}, Rules: []PolicyRule{{Name: "mango-bypass"}}},
+		},
+		Global: []PolicyRule{{Name: "global-bypass"}},
+	}
+	tests := []struct {
+		key       string
+		wantRead  bool
+		wantWrite bool
+		wantRule  string
+	}{
+		{"nk-shared", true, true, ""}, // acme sorts first and allows
+		{"nk-own", true, true, ""},    // Key rules beat org rules
+		{"nk-other", false, false, "global-bypass"},
+	}
+	for _, tt := range tests {
+		// Map order varies between runs; the decision must not
+		for range 20 {
+			got := policy.Evaluate(tt.key, PolicyInput{})
+			if got.Read != tt.wantRead || got.Write != tt.wantWrite || got.ReadRule != tt.wantRule {
+				t.Fatalf("Evaluate(%q) = %+v, want read=%v write=%v rule=%q", tt.key, got, tt.wantRead, tt.wantWrite, tt.wantRule)
+			}
+		}
+	}
+}
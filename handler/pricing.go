@@ -0,0 +1,60 @@
+package handler
+
+// ModelPrice is the list price in USD per million tokens
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// modelPrices covers the models GetProvider routes to. Unknown models are
+// priced as gpt-3.5-turbo, matching the provider fallback.
+var modelPrices = map[string]ModelPrice{
+	"gpt-3.5-turbo":            {Input: 0.50, Output: 1.50},
+	"gpt-4":                    {Input: 30.00, Output: 60.00},
+	"gpt-4o":                   {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":              {Input: 0.15, Output: 0.60},
+	"claude-3-opus-20240229":   {Input: 15.00, Output: 75.00},
+	"claude-3-sonnet-20240229": {Input: 3.00, Output: 15.00},
+	"claude-3-haiku-20240307":  {Input: 0.25, Output: 1.25},
+}
+
+func PriceFor(model string) ModelPrice {
+	if p, ok := modelPrices[model]; ok {
+		return p
+	}
+	return modelPrices["gpt-3.5-turbo"]
+}
+
+// TokenUsage is what one upstream call consumed. Estimated is set when the
+// provider didn't report usage (e.g. a stream cut short).
+type TokenUsage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	Estimated        bool `json:"estimated"`
+}
+
+func (u TokenUsage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// EstimateCost prices a call in USD
+func EstimateCost(model string, inputTokens, outputTokens int) float64 {
+	p := PriceFor(model)
+	return (float64(inputTokens)*p.Input + float64(outputTokens)*p.Output) / 1e6
+}
+
+// usdMicros converts dollars to the integer micro-dollars kept in Redis counters
+func usdMicros(usd float64) int64 {
+	return int64(usd * 1e6)
+}
+
+// RecordHitSavings books what a plain cache hit saved: the full call the
+// requested model would have made for the same answer
+func RecordHitSavings(model string, messages []Message, answer string) {
+	client := GetClient()
+	if client == nil {
+		return
+	}
+	saved := EstimateCost(model, CountMessageTokens(model, messages), CountTokens(model, answer))
+	client.IncrBy(ctx, "stats:hit_savings_micros", usdMicros(saved))
+}
@@ -2,15 +2,35 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // 1. THE CONTRACT
 type AIProvider interface {
-	Send(prompt string) (string, error)
+	// Send returns the full answer; cancelling ctx aborts the upstream call
+	Send(ctx context.Context, messages []Message, opts SendOptions) (string, error)
+}
+
+// SendOptions carries the optional generation parameters a client set
+type SendOptions struct {
+	Temperature *float64          // nil = provider default
+	Tools       []json.RawMessage // Passed through in the provider's own format
+}
+
+// ProviderError is a non-200 answer from a provider's API
+type ProviderError struct {
+	Provider string
+	Status   int
+	Body     string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s API Error: %s", e.Provider, e.Body)
 }
 
 // 2. THE FACTORY
@@ -18,7 +38,7 @@ func GetProvider(modelName string, openAIKey string, anthropicKey string) (AIPro
 	switch modelName {
 	case "claude-3-opus-20240229", "claude-3-sonnet-20240229", "claude-3-haiku-20240307":
 		return &AnthropicProvider{APIKey: anthropicKey, Model: modelName}, nil
-	case "gpt-3.5-turbo", "gpt-4", "gpt-4o":
+	case "gpt-3.5-turbo", "gpt-4", "gpt-4o", "gpt-4o-mini":
 		return &OpenAIProvider{APIKey: openAIKey, Model: modelName}, nil
 	default:
 		// Default fallback
@@ -35,8 +55,10 @@ type OpenAIProvider struct {
 }
 
 type OpenAIRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Model       string            `json:"model"`
+	Messages    []Message         `json:"messages"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	Tools       []json.RawMessage `json:"tools,omitempty"`
 }
 
 type Message struct {
@@ -50,16 +72,16 @@ type OpenAIResponse struct {
 	} `json:"choices"`
 }
 
-func (p *OpenAIProvider) Send(prompt string) (string, error) {
+func (p *OpenAIProvider) Send(ctx context.Context, messages []Message, opts SendOptions) (string, error) {
 	payload := OpenAIRequest{
-		Model: p.Model,
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
+		Model:       p.Model,
+		Messages:    messages,
+		Temperature: opts.Temperature,
+		Tools:       opts.Tools,
 	}
 	jsonBody, _ := json.Marshal(payload)
 
-	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonBody))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonBody))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+p.APIKey)
 
@@ -72,7 +94,7 @@ func (p *OpenAIProvider) Send(prompt string) (string, error) {
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("OpenAI API Error: %s", string(body))
+		return "", &ProviderError{Provider: "OpenAI", Status: resp.StatusCode, Body: string(body)}
 	}
 
 	var result OpenAIResponse
@@ -94,9 +116,12 @@ type AnthropicProvider struct {
 
 // Anthropic has a slightly different JSON structure
 type AnthropicRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
+	Model       string            `json:"model"`
+	System      string            `json:"system,omitempty"` // Anthropic takes the system prompt separately
+	Messages    []Message         `json:"messages"`
+	MaxTokens   int               `json:"max_tokens"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	Tools       []json.RawMessage `json:"tools,omitempty"`
 }
 
 type AnthropicResponse struct {
@@ -105,17 +130,19 @@ type AnthropicResponse struct {
 	} `json:"content"`
 }
 
-func (p *AnthropicProvider) Send(prompt string) (string, error) {
+func (p *AnthropicProvider) Send(ctx context.Context, messages []Message, opts SendOptions) (string, error) {
+	system, turns := splitSystemPrompt(messages)
 	payload := AnthropicRequest{
-		Model: p.Model,
-		MaxTokens: 1024,
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
+		Model:       p.Model,
+		System:      system,
+		MaxTokens:   1024,
+		Messages:    turns,
+		Temperature: opts.Temperature,
+		Tools:       opts.Tools,
 	}
 	jsonBody, _ := json.Marshal(payload)
 
-	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonBody))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonBody))
 	req.Header.Set("x-api-key", p.APIKey)
 	req.Header.Set("anthropic-version", "2023-06-01") // Required header
 	req.Header.Set("Content-Type", "application/json")
@@ -129,7 +156,7 @@ func (p *AnthropicProvider) Send(prompt string) (string, error) {
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Anthropic API Error: %s", string(body))
+		return "", &ProviderError{Provider: "Anthropic", Status: resp.StatusCode, Body: string(body)}
 	}
 
 	var result AnthropicResponse
@@ -139,4 +166,19 @@ func (p *AnthropicProvider) Send(prompt string) (string, error) {
 		return result.Content[0].Text, nil
 	}
 	return "", fmt.Errorf("no response from Anthropic")
+}
+
+// splitSystemPrompt pulls system messages out of a conversation (joined
+// into one prompt) for APIs that take them as a separate field
+func splitSystemPrompt(messages []Message) (string, []Message) {
+	var system []string
+	var turns []Message
+	for _, m := range messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+		} else {
+			turns = append(turns, m)
+		}
+	}
+	return strings.Join(system, "\n\n"), turns
 }
\ No newline at end of file
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis speaks just enough RESP2 for the commands the handlers use.
+// Expiry is accepted and ignored: tests run well inside any TTL.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+}
+
+// useFakeRedis points GetClient at a fresh fakeRedis for the test
+func useFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	f := &fakeRedis{strings: map[string]string{}, sets: map[string]map[string]bool{}, hashes: map[string]map[string]string{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	redisClient = redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2, DisableIdentity: true})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = nil
+		ln.Close()
+	})
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		reply := f.exec(args)
+		f.mu.Unlock()
+		writeReply(w, reply)
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// redisError and redisStatus mark replies that aren't bulk strings
+type redisError string
+type redisStatus string
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case redisStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return redisStatus("PONG")
+	case "GET":
+		if v, ok := f.strings[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		nx := false
+		for _, opt := range args[3:] {
+			nx = nx || strings.EqualFold(opt, "NX")
+		}
+		if _, exists := f.strings[args[1]]; nx && exists {
+			return nil
+		}
+		f.strings[args[1]] = args[2]
+		return redisStatus("OK")
+	case "SETNX":
+		if _, exists := f.strings[args[1]]; exists {
+			return 0
+		}
+		f.strings[args[1]] = args[2]
+		return 1
+	case "INCRBY", "INCR":
+		by := 1
+		if len(args) > 2 {
+			by, _ = strconv.Atoi(args[2])
+		}
+		n, _ := strconv.Atoi(f.strings[args[1]])
+		n += by
+		f.strings[args[1]] = strconv.Itoa(n)
+		return n
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := f.strings[key]; ok {
+				deleted++
+			} else if _, ok := f.sets[key]; ok {
+				deleted++
+			} else if _, ok := f.hashes[key]; ok {
+				deleted++
+			}
+			delete(f.strings, key)
+			delete(f.sets, key)
+			delete(f.hashes, key)
+		}
+		return deleted
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			if _, ok := f.strings[key]; ok {
+				found++
+			}
+		}
+		return found
+	case "EXPIRE", "PEXPIRE":
+		return 1
+	case "SADD":
+		if f.sets[args[1]] == nil {
+			f.sets[args[1]] = map[string]bool{}
+		}
+		added := 0
+		for _, m := range args[2:] {
+			if !f.sets[args[1]][m] {
+				f.sets[args[1]][m] = true
+				added++
+			}
+		}
+		return added
+	case "SREM":
+		removed := 0
+		for _, m := range args[2:] {
+			if f.sets[args[1]][m] {
+				delete(f.sets[args[1]], m)
+				removed++
+			}
+		}
+		return removed
+	case "SMEMBERS":
+		members := []string{}
+		for m := range f.sets[args[1]] {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		return members
+	case "HINCRBY":
+		if f.hashes[args[1]] == nil {
+			f.hashes[args[1]] = map[string]string{}
+		}
+		by, _ := strconv.Atoi(args[3])
+		n, _ := strconv.Atoi(f.hashes[args[1]][args[2]])
+		n += by
+		f.hashes[args[1]][args[2]] = strconv.Itoa(n)
+		return n
+	case "HDEL":
+		removed := 0
+		for _, field := range args[2:] {
+			if _, ok := f.hashes[args[1]][field]; ok {
+				delete(f.hashes[args[1]], field)
+				removed++
+			}
+		}
+		return removed
+	case "HGET":
+		if v, ok := f.hashes[args[1]][args[2]]; ok {
+			return v
+		}
+		return nil
+	default:
+		return redisError("ERR unknown command '" + args[0] + "'")
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable streams (STREAM_RESUME_WINDOW): every event of a stream gets an
+// id "<stream id>:<seq>" and is appended to a Redis list for the window. A
+// client that drops re-sends the request with Last-Event-ID and receives the
+// events it missed, then the rest as the original upstream call produces it.
+
+var (
+	streamsResumed = Counter("nexus_streams_resumed_total", "Stream reconnections served from the Redis event buffer")
+	streamsExpired = Counter("nexus_streams_resume_expired_total", "Reconnections whose stream was no longer buffered")
+)
+
+func streamEventsKey(id string) string { return "stream:events:" + id }
+func streamOwnerKey(id string) string  { return "stream:owner:" + id }
+func streamAttachKey(id string) string { return "stream:attach:" + id }
+
+// StreamBuffer appends one stream's events to Redis. Append only numbers
+// and queues a frame; a background writer sends whatever has queued up in
+// one pipeline, so a slow Redis never holds up the client's stream.
+type StreamBuffer struct {
+	ID     string
+	window time.Duration
+	seq    int
+
+	mu      sync.Mutex
+	pending []interface{} // Framed events not yet in Redis, in order
+	wake    chan struct{}
+	closed  chan struct{}
+	flushed chan struct{}
+	once    sync.Once
+}
+
+// NewStreamBuffer starts a buffer owned by apiKey, or returns nil when
+// resumable streams are off or Redis is unavailable
+func NewStreamBuffer(cfg *config.Config, apiKey string) *StreamBuffer {
+	client := GetClient()
+	if cfg.StreamResumeWindow <= 0 || client == nil {
+		return nil
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	buf := &StreamBuffer{
+		ID: "strm_" + hex.EncodeToString(b), window: cfg.StreamResumeWindow,
+		wake: make(chan struct{}, 1), closed: make(chan struct{}), flushed: make(chan struct{}),
+	}
+	if err := client.Set(ctx, streamOwnerKey(buf.ID), apiKey, buf.window).Err(); err != nil {
+		log.Printf("⚠️ Stream buffer unavailable: %v", err)
+		return nil
+	}
+	go buf.run()
+	return buf
+}
+
+// Append queues an event frame and returns its event id. The frame is
+// stored with its id line so a replay is byte-for-byte the original.
+func (b *StreamBuffer) Append(frame string) string {
+	b.seq++
+	id := fmt.Sprintf("%s:%d", b.ID, b.seq)
+	b.mu.Lock()
+	b.pending = append(b.pending, "id: "+id+"\n"+frame)
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default: // A flush is already due
+	}
+	return id
+}
+
+// Close sends the events still queued and stops the writer
+func (b *StreamBuffer) Close() {
+	if b == nil {
+		return
+	}
+	b.once.Do(func() { close(b.closed) })
+	<-b.flushed
+}
+
+// run is the background writer: one pipeline per batch of queued events
+func (b *StreamBuffer) run() {
+	defer close(b.flushed)
+	for {
+		select {
+		case <-b.wake:
+			b.flush()
+		case <-b.closed:
+			b.flush()
+			return
+		}
+	}
+}
+
+func (b *StreamBuffer) flush() {
+	b.mu.Lock()
+	frames := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	client := GetClient()
+	if len(frames) == 0 || client == nil {
+		return
+	}
+	pipe := client.Pipeline()
+	pipe.RPush(ctx, streamEventsKey(b.ID), frames...)
+	pipe.Expire(ctx, streamEventsKey(b.ID), b.window)
+	pipe.Expire(ctx, streamOwnerKey(b.ID), b.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Stream buffer append failed: %v", err)
+	}
+}
+
+// Attached reports whether a reconnected client is following the stream
+func (b *StreamBuffer) Attached() bool {
+	client := GetClient()
+	if b == nil || client == nil {
+		return false
+	}
+	n, _ := client.Exists(ctx, streamAttachKey(b.ID)).Result()
+	return n > 0
+}
+
+// parseEventID splits "<stream id>:<seq>"
+func parseEventID(eventID string) (string, int, bool) {
+	id, raw, ok := strings.Cut(eventID, ":")
+	seq, err := strconv.Atoi(raw)
+	if !ok || err != nil || seq < 0 || !strings.HasPrefix(id, "strm_") {
+		return "", 0, false
+	}
+	return id, seq, true
+}
+
+// ResumeStream serves a reconnection: the buffered events after lastEventID,
+// then new ones as the original request appends them, until [DONE]
+func ResumeStream(cfg *config.Config, w http.ResponseWriter, r *http.Request, apiKey, lastEventID string) {
+	client := GetClient()
+	id, seq, ok := parseEventID(lastEventID)
+	if !ok {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+	if client == nil || cfg.StreamResumeWindow <= 0 {
+		http.Error(w, "Stream resumption is not enabled", http.StatusNotFound)
+		return
+	}
+	owner, err := client.Get(ctx, streamOwnerKey(id)).Result()
+	if err != nil {
+		streamsExpired.Add(1)
+		http.Error(w, "Stream expired or unknown", http.StatusNotFound)
+		return
+	}
+	if owner != apiKey {
+		http.Error(w, "Stream belongs to another key", http.StatusForbidden)
+		return
+	}
+
+	sse, ok := NewSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	defer sse.Close()
+	w.Header().Set("X-Nexus-Stream-Id", id)
+	sse.StartHeartbeat(cfg.StreamHeartbeatInterval)
+	streamsResumed.Add(1)
+	log.Printf("🔁 Resuming stream %s after event %d", id, seq)
+
+	// While this client follows, the original request keeps its upstream call
+	grace := max(cfg.StreamResumeGrace, time.Second)
+	defer client.Del(ctx, streamAttachKey(id))
+
+	lastNew := time.Now()
+	for {
+		client.Set(ctx, streamAttachKey(id), "1", grace)
+
+		frames, err := client.LRange(ctx, streamEventsKey(id), int64(seq), -1).Result()
+		if err != nil {
+			log.Printf("Stream buffer read failed: %v", err)
+		}
+		for _, frame := range frames {
+			sse.Raw(frame)
+			seq++
+			if strings.HasSuffix(frame, "data: [DONE]\n\n") {
+				return
+			}
+		}
+		if len(frames) > 0 {
+			lastNew = time.Now()
+		}
+
+		// The producer is gone (expired buffer, or silent for a whole window)
+		if n, _ := client.Exists(ctx, streamOwnerKey(id)).Result(); n == 0 || time.Since(lastNew) > cfg.StreamResumeWindow {
+			streamsExpired.Add(1)
+			sse.Error(&StreamError{Type: "stream_expired", Message: "the stream is no longer available"})
+			sse.Done()
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
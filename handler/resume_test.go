@@ -0,0 +1,29 @@
+package handler
+
+import "testing"
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		eventID string
+		wantID  string
+		wantSeq int
+		wantOK  bool
+	}{
+		{"strm_0123abcd:7", "strm_0123abcd", 7, true},
+		{"strm_0123abcd:0", "strm_0123abcd", 0, true},
+		{"strm_0123abcd:-1", "", 0, false},
+		{"strm_0123abcd:", "", 0, false},
+		{"strm_0123abcd", "", 0, false},
+		{"strm_0123abcd:x", "", 0, false},
+		{"strm_0123abcd:1:2", "", 0, false},
+		{"other_0123abcd:7", "", 0, false},
+		{":7", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tt := range tests {
+		id, seq, ok := parseEventID(tt.eventID)
+		if id != tt.wantID || seq != tt.wantSeq || ok != tt.wantOK {
+			t.Errorf("parseEventID(%q) = (%q, %d, %v), want (%q, %d, %v)", tt.eventID, id, seq, ok, tt.wantID, tt.wantSeq, tt.wantOK)
+		}
+	}
+}
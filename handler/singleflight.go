@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Singleflight: identical cacheable requests that miss the cache at the same
+// time share one upstream call. Within an instance the leader fans its output
+// out to followers chunk by chunk (so streaming followers stream too). Across
+// instances a Redis lock elects one leader; the others wait for the answer it
+// publishes, up to CacheCoalesceTimeout, then fall back to their own call.
+
+// Flight is one upstream call shared by every request with the same key
+type Flight struct {
+	key   string
+	token string // Redis lock token when this instance holds the lock
+
+	followers atomic.Int32 // Local requests waiting on this flight
+
+	mu     sync.Mutex
+	chunks []string
+	subs   []chan struct{} // Wake-ups for streaming followers
+	done   chan struct{}
+	text   string
+	err    error
+}
+
+var (
+	flightsMu sync.Mutex
+	flights   = map[string]*Flight{}
+
+	coalescedRequests = Counter("nexus_coalesced_requests_total", "Requests answered by another request's upstream call")
+	coalescedRemote   = Counter("nexus_coalesced_remote_total", "Requests answered by an upstream call on another instance")
+	coalesceTimeouts  = Counter("nexus_coalesce_timeouts_total", "Waits for another instance that gave up and called upstream")
+)
+
+func flightLockKey(key string) string { return "flight:lock:" + key }
+
+// flightResultKey is scoped to the leader's lock token, so a follower never
+// reads the answer of an earlier flight for the same key
+func flightResultKey(key, token string) string { return "flight:result:" + key + ":" + token }
+
+// FlightKey identifies requests that can share an answer: same namespace,
+// model, parameters and canonical conversation. It is "" when the answer
+// may not be shared (the request isn't allowed into the cache).
+func FlightKey(cfg *config.Config, logical string, req ChatRequest, cacheKey string, opts CacheOptions) string {
+	if !cfg.CacheCoalesce || !opts.Write || cacheKey == "" {
+		return ""
+	}
+	parts := []string{logical, req.Model, cacheKey}
+	if req.Temperature != nil {
+		parts = append(parts, "t="+strconv.FormatFloat(*req.Temperature, 'f', -1, 64))
+	}
+	if len(req.Tools) > 0 {
+		tools, _ := json.Marshal(req.Tools)
+		parts = append(parts, "tools="+string(tools))
+	}
+	return GenerateHash(strings.Join(parts, "\x00"))
+}
+
+// JoinFlight returns the flight for key. leader=true means the caller must
+// make the upstream call, Publish its output and Finish the flight; otherwise
+// the caller reads the leader's answer with Wait or Stream. reqCtx bounds the
+// wait for another instance's answer.
+func JoinFlight(reqCtx context.Context, cfg *config.Config, key string) (f *Flight, leader bool) {
+	// 1. Same instance: join the running flight
+	flightsMu.Lock()
+	if f, ok := flights[key]; ok {
+		f.followers.Add(1)
+		flightsMu.Unlock()
+		coalescedRequests.Add(1)
+		return f, false
+	}
+	f = &Flight{key: key, done: make(chan struct{})}
+	flights[key] = f
+	flightsMu.Unlock()
+
+	// 2. Other instances: take the Redis lock, or wait for its holder's answer
+	client := GetClient()
+	if client == nil {
+		return f, true
+	}
+	token := newFlightToken()
+	var holder string
+	for attempt := 0; attempt < 2 && holder == ""; attempt++ {
+		ok, err := client.SetNX(ctx, flightLockKey(key), token, cfg.CacheCoalesceTimeout).Result()
+		if err != nil || ok {
+			if ok {
+				f.token = token
+			}
+			return f, true
+		}
+		// Whose flight to wait for; empty if it ended in between, so try again
+		holder, _ = client.Get(ctx, flightLockKey(key)).Result()
+	}
+	if holder == "" {
+		return f, true
+	}
+
+	log.Printf("⏳ Identical request in flight on another instance, waiting (%s)", key[:12])
+	text, ok, err := awaitRemoteFlight(reqCtx, client, key, holder, cfg.CacheCoalesceTimeout)
+	if ok {
+		coalescedRequests.Add(1)
+		coalescedRemote.Add(1)
+		f.Publish(text)
+		f.Finish(text, nil)
+		return f, false
+	}
+	// Gave up (or the client left): lead the local flight. Its call is only
+	// made if local followers joined meanwhile, see CallContext.
+	if err == nil {
+		coalesceTimeouts.Add(1)
+	}
+	return f, true
+}
+
+// awaitRemoteFlight polls for the answer the holder of lock token publishes.
+// It stops early when the lock changes hands without an answer (the leader
+// failed) and when reqCtx ends, returning its error.
+func awaitRemoteFlight(reqCtx context.Context, client *redis.Client, key, token string, timeout time.Duration) (string, bool, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		if text, err := client.Get(ctx, flightResultKey(key, token)).Result(); err == nil {
+			return text, true, nil
+		}
+		if holder, _ := client.Get(ctx, flightLockKey(key)).Result(); holder != token {
+			text, err := client.Get(ctx, flightResultKey(key, token)).Result()
+			return text, err == nil, nil
+		}
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			return "", false, nil
+		case <-reqCtx.Done():
+			return "", false, reqCtx.Err()
+		}
+	}
+}
+
+// Publish records a piece of the answer and wakes every streaming follower.
+// Followers read f.chunks from their own position, so a slow one catches up
+// instead of losing chunks.
+func (f *Flight) Publish(chunk string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chunks = append(f.chunks, chunk)
+	for _, ch := range f.subs {
+		select {
+		case ch <- struct{}{}:
+		default: // Already woken; it will read this chunk too
+		}
+	}
+}
+
+// Finish records the leader's answer, releases followers and the Redis lock.
+// Only successful answers are shared with other instances.
+func (f *Flight) Finish(text string, err error) {
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		return
+	default:
+	}
+	f.text, f.err = text, err
+	for _, ch := range f.subs {
+		close(ch)
+	}
+	close(f.done)
+	f.mu.Unlock()
+
+	flightsMu.Lock()
+	if flights[f.key] == f {
+		delete(flights, f.key)
+	}
+	flightsMu.Unlock()
+
+	if client := GetClient(); client != nil && f.token != "" {
+		if err == nil {
+			client.Set(ctx, flightResultKey(f.key, f.token), text, 30*time.Second)
+		}
+		releaseFlightLock.Run(ctx, client, []string{flightLockKey(f.key)}, f.token)
+	}
+}
+
+// Followers reports how many local requests are waiting on the leader
+func (f *Flight) Followers() int {
+	return int(f.followers.Load())
+}
+
+// CallContext is the context for the leader's upstream call. It ends with
+// ctx (the leader's client went away) unless followers are waiting on the
+// answer, in which case the call runs on for them. f may be nil.
+func (f *Flight) CallContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f == nil {
+		return context.WithCancel(ctx)
+	}
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-ctx.Done():
+			if f.Followers() == 0 {
+				cancel()
+			}
+		case <-callCtx.Done():
+		}
+	}()
+	return callCtx, cancel
+}
+
+// Wait blocks until the leader finishes (or ctx ends) and returns its answer
+func (f *Flight) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.text, f.err
+	case <-ctx.Done():
+		f.followers.Add(-1) // Gave up; the leader no longer has to finish for it
+		return "", ctx.Err()
+	}
+}
+
+// Stream replays the chunks published so far, then forwards new ones as they
+// arrive, and returns the full answer once the leader finishes
+func (f *Flight) Stream(ctx context.Context, emit func(chunk string)) (string, error) {
+	wake := f.subscribe()
+	next := 0 // This follower's position in f.chunks
+	for {
+		chunks, finished := f.chunksFrom(next)
+		next += len(chunks)
+		for _, chunk := range chunks {
+			emit(chunk)
+		}
+		if finished {
+			return f.Wait(ctx)
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			f.followers.Add(-1)
+			return "", ctx.Err()
+		}
+	}
+}
+
+// subscribe returns a channel that is signalled when a chunk is published
+// and closed when the flight finishes
+func (f *Flight) subscribe() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	select {
+	case <-f.done:
+		close(ch)
+	default:
+		f.subs = append(f.subs, ch)
+	}
+	return ch
+}
+
+// chunksFrom returns the chunks published from index next on, and whether
+// the flight has finished (so no more will follow)
+func (f *Flight) chunksFrom(next int) ([]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chunks := append([]string(nil), f.chunks[next:]...)
+	select {
+	case <-f.done:
+		return chunks, true
+	default:
+		return chunks, false
+	}
+}
+
+// releaseFlightLock deletes the lock only if this instance still owns it
+var releaseFlightLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func newFlightToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJoinFlightRemote(t *testing.T) {
+	useFakeRedis(t)
+	cfg := &config.Config{CacheCoalesceTimeout: 5 * time.Second}
+	key := GenerateHash("remote flight")
+
+	// An earlier flight's answer is still around; the current one is running
+	GetClient().Set(ctx, flightResultKey(key, "earlier"), "stale answer", time.Minute)
+	GetClient().Set(ctx, flightLockKey(key), "current", time.Minute)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		GetClient().Set(ctx, flightResultKey(key, "current"), "fresh answer", time.Minute)
+		GetClient().Del(ctx, flightLockKey(key))
+	}()
+
+	f, leader := JoinFlight(context.Background(), cfg, key)
+	if leader {
+		t.Fatal("JoinFlight made the follower lead")
+	}
+	if text, err := f.Wait(context.Background()); err != nil || text != "fresh answer" {
+		t.Errorf("Wait = %q, %v; want the current flight's answer", text, err)
+	}
+}
+
+func TestJoinFlightGivesUpWithTheRequest(t *testing.T) {
+	useFakeRedis(t)
+	cfg := &config.Config{CacheCoalesceTimeout: 5 * time.Second}
+	key := GenerateHash("abandoned flight")
+	GetClient().Set(ctx, flightLockKey(key), "other", time.Minute)
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	f, leader := JoinFlight(reqCtx, cfg, key)
+	defer f.Finish("", context.Canceled)
+
+	if !leader {
+		t.Error("JoinFlight without an answer should lead")
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %s after the request ended", waited)
+	}
+}
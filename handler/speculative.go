@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Speculative mode (CACHE_SPECULATIVE_KEYS): the provider call starts at the
+// same time as the cache lookup. A hit cancels it; a miss gets its answer
+// without paying embedding + search latency first.
+
+var (
+	speculativeCalls     = Counter("nexus_speculative_calls_total", "Provider calls started alongside the cache lookup")
+	speculativeCancelled = Counter("nexus_speculative_cancelled_total", "Speculative calls cancelled because the cache answered")
+	speculativeWonMs     = Counter("nexus_speculative_latency_won_ms_total", "Milliseconds of cache lookup hidden behind speculative calls")
+	speculativeWasted    = Counter("nexus_speculative_wasted_tokens_total", "Estimated tokens billed for cancelled speculative calls")
+)
+
+// SpeculativeCall is a provider call running in the background
+type SpeculativeCall struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	started time.Time
+
+	model    string
+	messages []Message
+	text     string
+	err      error
+	elapsed  time.Duration
+
+	once sync.Once // Result or Abandon, whichever comes first
+}
+
+// IsSpeculative reports whether a key has speculative mode on ("*" = every key)
+func IsSpeculative(cfg *config.Config, apiKey string) bool {
+	return cfg.CacheSpeculativeKeys[apiKey] || cfg.CacheSpeculativeKeys["*"]
+}
+
+// StartSpeculativeCall sends the request now and keeps the answer until
+// Result or Abandon is called
+func StartSpeculativeCall(provider AIProvider, model string, messages []Message, opts SendOptions) *SpeculativeCall {
+	callCtx, cancel := context.WithCancel(context.Background())
+	s := &SpeculativeCall{cancel: cancel, done: make(chan struct{}), started: time.Now(), model: model, messages: messages}
+	speculativeCalls.Add(1)
+
+	go func() {
+		defer close(s.done)
+		s.text, s.err = provider.Send(callCtx, messages, opts)
+		s.elapsed = time.Since(s.started)
+	}()
+	return s
+}
+
+// Result waits for the answer. lookup is how long the cache lookup took;
+// the overlap between it and the provider call is the latency won.
+func (s *SpeculativeCall) Result(ctx context.Context, lookup time.Duration) (string, error) {
+	s.once.Do(func() {})
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.cancel()
+		return "", ctx.Err()
+	}
+	s.cancel()
+
+	if s.err == nil {
+		won := min(lookup, s.elapsed)
+		speculativeWonMs.Add(won.Milliseconds())
+		log.Printf("🏎️ Speculative call hid %s of cache lookup", won.Round(time.Millisecond))
+	}
+	return s.text, s.err
+}
+
+// Abandon cancels the call because the answer came from elsewhere (a hit,
+// an adapted hit or a coalesced request). It is a no-op after Result.
+// The prompt tokens are billed either way, and the output too if the call
+// had already finished.
+func (s *SpeculativeCall) Abandon() {
+	s.once.Do(func() {
+		s.cancel()
+		speculativeCancelled.Add(1)
+
+		wasted := CountMessageTokens(s.model, s.messages)
+		select {
+		case <-s.done:
+			wasted += CountTokens(s.model, s.text)
+		default:
+		}
+		speculativeWasted.Add(int64(wasted))
+		log.Printf("🗑️ Speculative call cancelled (~%d tokens wasted)", wasted)
+	})
+}
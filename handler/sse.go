@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The gateway owns the SSE protocol of /api/chat/stream: upstream chunks are
+// parsed into StreamChunk and re-emitted, never forwarded raw. Every stream
+// ends with `data: [DONE]`, preceded by an `event: error` if it failed.
+
+// StreamChunk is one OpenAI-style stream event, read from upstream and
+// written to clients
+type StreamChunk struct {
+	Model   string         `json:"model,omitempty"`
+	Choices []StreamChoice `json:"choices"`
+	Usage   *TokenUsage    `json:"usage,omitempty"` // Upstream only: the final chunk
+	Error   *upstreamError `json:"error,omitempty"` // Upstream only: a mid-stream failure
+}
+
+type StreamChoice struct {
+	Index        int         `json:"index"`
+	Delta        StreamDelta `json:"delta"`
+	FinishReason *string     `json:"finish_reason,omitempty"`
+}
+
+type StreamDelta struct {
+	Role      string            `json:"role,omitempty"`
+	Content   string            `json:"content,omitempty"`
+	ToolCalls []json.RawMessage `json:"tool_calls,omitempty"`
+}
+
+// StreamError is the payload of a terminal `event: error`
+type StreamError struct {
+	Type    string `json:"type"`           // upstream_error, upstream_unavailable, upstream_interrupted or context_length_exceeded
+	Code    string `json:"code,omitempty"` // The provider's error code, when it sent one
+	Message string `json:"message"`
+	Status  int    `json:"status,omitempty"` // Upstream HTTP status
+}
+
+func (e *StreamError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s (%d): %s", e.Type, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// upstreamError is OpenAI's error object; its code may be a string, a number or null
+type upstreamError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    any    `json:"code"`
+}
+
+func (e *upstreamError) streamError(status int) *StreamError {
+	se := &StreamError{Type: "upstream_error", Message: e.Message, Status: status}
+	if e.Code != nil {
+		se.Code = fmt.Sprint(e.Code)
+	} else {
+		se.Code = e.Type
+	}
+	if se.Message == "" {
+		se.Message = "upstream request failed"
+	}
+	return se
+}
+
+// ParseUpstreamError turns a non-200 upstream body into a StreamError,
+// falling back to the raw body when it isn't an OpenAI error object
+func ParseUpstreamError(status int, body []byte) *StreamError {
+	var parsed struct {
+		Error *upstreamError `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error != nil {
+		return parsed.Error.streamError(status)
+	}
+	message := string(body)
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &StreamError{Type: "upstream_error", Message: message, Status: status}
+}
+
+// AsStreamError wraps any error for an `event: error`
+func AsStreamError(err error) *StreamError {
+	if se, ok := err.(*StreamError); ok {
+		return se
+	}
+	return &StreamError{Type: "upstream_error", Message: err.Error()}
+}
+
+// SSEWriter serialises everything written to one event stream, so
+// heartbeats never interleave with events
+type SSEWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	buffer *StreamBuffer // Set for resumable streams
+
+	mu     sync.Mutex
+	done   bool
+	stop   chan struct{}
+	ticker sync.WaitGroup
+}
+
+// NewSSEWriter returns false when w can't stream
+func NewSSEWriter(w http.ResponseWriter) (*SSEWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	return &SSEWriter{w: w, flusher: flusher}, true
+}
+
+// Resumable gives every following event an id and buffers it for reconnects
+func (s *SSEWriter) Resumable(buffer *StreamBuffer) {
+	s.buffer = buffer
+}
+
+// StartHeartbeat sends a comment line every interval until Done or Close.
+// Call it once the response headers are final: the first beat sends them.
+func (s *SSEWriter) StartHeartbeat(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if interval <= 0 || s.stop != nil || s.done {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.ticker.Add(1)
+	go func() {
+		defer s.ticker.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.write(": heartbeat\n\n")
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *SSEWriter) write(frame string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	fmt.Fprint(s.w, frame)
+	s.flusher.Flush()
+}
+
+// writeEvent is write for events, which resumable streams number and queue
+// for the buffer (Append doesn't wait on Redis)
+func (s *SSEWriter) writeEvent(frame string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	if s.buffer != nil {
+		frame = "id: " + s.buffer.Append(frame) + "\n" + frame
+	}
+	fmt.Fprint(s.w, frame)
+	s.flusher.Flush()
+}
+
+// Raw writes an already framed event (a buffered one being replayed)
+func (s *SSEWriter) Raw(frame string) {
+	s.write(frame)
+}
+
+// Event writes a chunk as a `data:` event
+func (s *SSEWriter) Event(chunk StreamChunk) {
+	chunk.Usage, chunk.Error = nil, nil
+	data, _ := json.Marshal(chunk)
+	s.writeEvent(fmt.Sprintf("data: %s\n\n", data))
+}
+
+// Delta writes a text delta
+func (s *SSEWriter) Delta(content string) {
+	s.Event(StreamChunk{Choices: []StreamChoice{{Delta: StreamDelta{Content: content}}}})
+}
+
+// Finish writes the closing chunk carrying the finish reason
+func (s *SSEWriter) Finish(reason string) {
+	s.Event(StreamChunk{Choices: []StreamChoice{{FinishReason: &reason}}})
+}
+
+// Error writes a terminal `event: error`. Done must still follow.
+func (s *SSEWriter) Error(se *StreamError) {
+	data, _ := json.Marshal(map[string]*StreamError{"error": se})
+	s.writeEvent(fmt.Sprintf("event: error\ndata: %s\n\n", data))
+}
+
+// Done ends the stream with `data: [DONE]`; later writes are dropped
+func (s *SSEWriter) Done() {
+	s.writeEvent("data: [DONE]\n\n")
+	s.Close()
+}
+
+// Close stops the heartbeat without ending the stream (the client is gone)
+// and flushes the buffered events. The handler must not return before it does.
+func (s *SSEWriter) Close() {
+	s.mu.Lock()
+	already, stop := s.done, s.stop
+	s.done = true
+	s.mu.Unlock()
+	if !already && stop != nil {
+		close(stop)
+	}
+	s.ticker.Wait()
+	s.buffer.Close()
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseUpstreamError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   StreamError
+	}{
+		{
+			"openai error with string code", http.StatusBadRequest,
+			`{"error": {"message": "This model's maximum context length is 8192 tokens", "type": "invalid_request_error", "code": "context_length_exceeded"}}`,
+			StreamError{Type: "upstream_error", Code: "context_length_exceeded", Message: "This model's maximum context length is 8192 tokens", Status: 400},
+		},
+		{
+			"numeric code", http.StatusTooManyRequests,
+			`{"error": {"message": "Rate limit reached", "type": "requests", "code": 429}}`,
+			StreamError{Type: "upstream_error", Code: "429", Message: "Rate limit reached", Status: 429},
+		},
+		{
+			"null code falls back to the type", http.StatusInternalServerError,
+			`{"error": {"message": "The server had an error", "type": "server_error", "code": null}}`,
+			StreamError{Type: "upstream_error", Code: "server_error", Message: "The server had an error", Status: 500},
+		},
+		{
+			"empty message", http.StatusBadGateway,
+			`{"error": {"type": "server_error"}}`,
+			StreamError{Type: "upstream_error", Code: "server_error", Message: "upstream request failed", Status: 502},
+		},
+		{
+			"not json", http.StatusServiceUnavailable,
+			`upstream connect error`,
+			StreamError{Type: "upstream_error", Message: "upstream connect error", Status: 503},
+		},
+		{
+			"json without an error object", http.StatusBadRequest,
+			`{"detail": "bad"}`,
+			StreamError{Type: "upstream_error", Message: `{"detail": "bad"}`, Status: 400},
+		},
+		{
+			"empty body", http.StatusUnauthorized,
+			``,
+			StreamError{Type: "upstream_error", Message: "Unauthorized", Status: 401},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseUpstreamError(tt.status, []byte(tt.body))
+			if *got != tt.want {
+				t.Errorf("ParseUpstreamError(%d, %q) = %+v, want %+v", tt.status, tt.body, *got, tt.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,10 @@ import (
 type StatsResponse struct {
 	TotalRequests int64       `json:"total_requests"`
 	CacheHits     int64       `json:"cache_hits"`
+	HitSavingsUSD float64     `json:"hit_savings_usd"`
+	AdaptedHits   int64       `json:"adapted_hits"`    // Near-hits rewritten by the cheap model
+	AdaptCostUSD  float64     `json:"adapt_cost_usd"`  // What the rewrites cost
+	AdaptSavedUSD float64     `json:"adapt_saved_usd"` // Full-model cost avoided, net of AdaptCostUSD
 	GraphData     []GraphPoint `json:"graph_data"` // <--- NEW
 }
 
@@ -21,10 +25,14 @@ type GraphPoint struct {
 func HandleStats(w http.ResponseWriter, r *http.Request) {
 	// 1. Get Counters from Redis (Fast)
 	client := GetClient()
-	var total, hits int64
+	var total, hits, hitSavings, adapted, adaptCost, adaptSaved int64
 	if client != nil {
 		total, _ = client.Get(ctx, "stats:total_requests").Int64()
 		hits, _ = client.Get(ctx, "stats:cache_hits").Int64()
+		hitSavings, _ = client.Get(ctx, "stats:hit_savings_micros").Int64()
+		adapted, _ = client.Get(ctx, "stats:cache_adapted").Int64()
+		adaptCost, _ = client.Get(ctx, "stats:adapt_cost_micros").Int64()
+		adaptSaved, _ = client.Get(ctx, "stats:adapt_savings_micros").Int64()
 	}
 
 	// 2. Get Graph Data from Postgres (Slow but detailed)
@@ -54,6 +62,10 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 	resp := StatsResponse{
 		TotalRequests: total,
 		CacheHits:     hits,
+		HitSavingsUSD: float64(hitSavings) / 1e6,
+		AdaptedHits:   adapted,
+		AdaptCostUSD:  float64(adaptCost) / 1e6,
+		AdaptSavedUSD: float64(adaptSaved) / 1e6,
 		GraphData:     graphData,
 	}
 
@@ -4,21 +4,40 @@ import (
 	"NexusGateway/config"
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // We need a specific request struct for streaming (OpenAI format)
 type StreamRequestPayload struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"` // <--- THIS IS THE KEY
+	Model       string            `json:"model"`
+	Messages    []Message         `json:"messages"`
+	Stream      bool              `json:"stream"` // <--- THIS IS THE KEY
+	Temperature *float64          `json:"temperature,omitempty"`
+	Tools       []json.RawMessage `json:"tools,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// StreamOptions asks OpenAI to report token usage in a final chunk
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
+// StreamClientCancelled is logged when the client hangs up mid-stream
+// (nginx's "client closed request")
+const StreamClientCancelled = 499
+
+var streamsCancelled = Counter("nexus_streams_cancelled_total", "Streams whose upstream call was cancelled by a client disconnect")
+
 func HandleStreamChat(w http.ResponseWriter, r *http.Request) {
 	cfg := config.LoadConfig()
+	userKey := getAPIKey(r)
 
 	// 1. Set Headers for Streaming (Crucial)
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -26,61 +45,364 @@ func HandleStreamChat(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	// A dropped client reconnecting to a buffered stream
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		ResumeStream(cfg, w, r, userKey, lastEventID)
+		return
+	}
+
 	// 2. Parse User Request
 	var userReq ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&userReq); err != nil {
+		if le := BodyLimitError(cfg, userKey, err); le != nil {
+			RefundRequest(userKey) // Cut off without a Content-Length, after the charge
+			le.Write(w)
+			return
+		}
 		http.Error(w, "Invalid body", http.StatusBadRequest)
 		return
 	}
+	if t, err := ApplyTemplate(r.Context(), &userReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if t != nil {
+		w.Header().Set("X-Nexus-Template", t.Ref())
+	}
 	if userReq.Model == "" { userReq.Model = "gpt-3.5-turbo" }
+	messages := userReq.Conversation()
+	if err := ValidateConversation(messages); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := LimitsFor(cfg, userKey)
+	if le := limits.CheckTokens(userReq.Model, messages, userReq.Tools); le != nil {
+		RefundRequest(userKey) // Like the byte limit, a 413 costs no credit
+		le.Write(w)
+		return
+	}
+	fit, err := FitContext(r.Context(), cfg, r, userKey, userReq.Model, messages, limits.MaxTokens)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages = fit.Messages
+	w.Header().Set("X-Nexus-Context-Trimmed", fit.Header())
+
+	sse, ok := NewSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	defer sse.Close()
+
+	// 3. Cache lookup: the same tiers as /api/chat
+	cacheOpts, err := ResolveCacheOptions(r, cfg, userKey, userReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule := ApplyCachePolicy(cfg, userKey, NewPolicyInput(r, userReq, messages), &cacheOpts); rule != "" {
+		w.Header().Set("X-Nexus-Cache-Policy", rule)
+	}
+	cacheKey, keyOK, skipReason := CacheKeyText(cfg, messages)
+	if !keyOK {
+		log.Printf("⏭️ Skipping semantic cache: %s", skipReason)
+		cacheOpts.Read, cacheOpts.Write = false, false
+	}
+
+	lookup := NewCacheLookup(cfg, userKey, cacheKey, cacheOpts)
+	lookup.Run(cfg, userReq.Model, messages)
+
+	// Resumable streams: event ids let a dropped client pick up where it left off
+	buffer := NewStreamBuffer(cfg, userKey)
+	if buffer != nil {
+		w.Header().Set("X-Nexus-Stream-Id", buffer.ID)
+		sse.Resumable(buffer)
+	}
+
+	// Hit: replay the cached answer as a chunked stream
+	if lookup.Served() {
+		LogRequest(userKey, userReq.Model, 200, lookup.Status == CacheHit)
+		userReq.logTemplateUse(userKey)
+		lookup.Respond(cfg, w, userKey, userReq.Model, lookup.EntryID)
+		for _, chunk := range replayChunks(lookup.Answer) {
+			sse.Delta(chunk)
+		}
+		sse.Finish("stop")
+		sse.Done()
+		return
+	}
 
-	// 3. Prepare Request to OpenAI
+	log.Printf("🐢 CACHE %s: Streaming request from %s...", lookup.Status, userReq.Model)
+	if rc := GetClient(); rc != nil {
+		rc.Incr(ctx, "stats:cache_misses")
+	}
+	lookup.Respond(cfg, w, userKey, userReq.Model, lookup.WritableID())
+
+	// Identical cacheable requests streaming right now share one upstream call
+	var flight *Flight
+	if key := FlightKey(cfg, lookup.Logical, userReq, cacheKey, cacheOpts); key != "" {
+		var leader bool
+		if flight, leader = JoinFlight(r.Context(), cfg, key); !leader {
+			log.Println("🤝 Coalesced stream with an identical in-flight request")
+			w.Header().Set("X-Nexus-Coalesced", "true")
+			sse.StartHeartbeat(cfg.StreamHeartbeatInterval)
+			_, err := flight.Stream(r.Context(), sse.Delta)
+			if r.Context().Err() != nil {
+				LogRequest(userKey, userReq.Model, StreamClientCancelled, false)
+				return
+			}
+			if err != nil {
+				sse.Error(AsStreamError(err))
+				LogRequest(userKey, userReq.Model, 502, false)
+			} else {
+				sse.Finish("stop")
+				LogRequest(userKey, userReq.Model, 200, false)
+				userReq.logTemplateUse(userKey)
+			}
+			sse.Done()
+			return
+		}
+	}
+
+	// Headers are final: from here on, silences are filled with heartbeats
+	sse.StartHeartbeat(cfg.StreamHeartbeatInterval)
+
+	// The upstream call lives as long as someone reads it. A disconnect
+	// cancels it, unless coalesced followers are still waiting on the answer
+	// or (resumable streams) the client reconnects within the grace period.
+	upstreamCtx, cancelUpstream := context.WithCancel(context.Background())
+	defer cancelUpstream()
+	go func() {
+		select {
+		case <-r.Context().Done():
+		case <-upstreamCtx.Done():
+			return
+		}
+		recheck := time.Second
+		if buffer != nil && cfg.StreamResumeGrace > 0 {
+			recheck = cfg.StreamResumeGrace
+			log.Printf("📴 Client dropped stream %s, holding upstream for %s", buffer.ID, recheck)
+		} else if flight == nil || flight.Followers() == 0 {
+			cancelUpstream()
+			return
+		}
+		for {
+			select {
+			case <-upstreamCtx.Done():
+				return
+			case <-time.After(recheck):
+			}
+			if (flight == nil || flight.Followers() == 0) && !buffer.Attached() {
+				cancelUpstream()
+				return
+			}
+		}
+	}()
+
+	// The wrap-up (5.) is deferred, so a panic can't leave coalesced
+	// followers, the Redis flight lock or the client's stream hanging
+	var result UpstreamStream
+	var delivered strings.Builder
+	defer func() {
+		p := recover()
+		if p != nil {
+			log.Printf("💥 Stream handler panicked: %v", p)
+			result = UpstreamStream{
+				Started: delivered.Len() > 0,
+				Answer:  delivered.String(),
+				Usage:   TokenUsage{PromptTokens: CountMessageTokens(userReq.Model, messages), CompletionTokens: CountTokens(userReq.Model, delivered.String()), Estimated: true},
+				Err:     &StreamError{Type: "server_error", Message: "the gateway failed mid-stream"},
+			}
+		}
+		finishStream(cfg, sse, r, userKey, userReq, lookup, flight, result)
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	// 4. THE PIPELINE (Read from OpenAI -> parse -> write to user)
+	result = streamUpstream(upstreamCtx, cfg, userReq, messages, func(chunk StreamChunk) {
+		sse.Event(chunk)
+		if content := chunk.Choices[0].Delta.Content; content != "" {
+			delivered.WriteString(content)
+			if flight != nil {
+				flight.Publish(content)
+			}
+		}
+	})
+}
+
+// 5. finishStream wraps up: close the client's stream, cache, log and
+// charge. Written even when the client is gone: a resumed stream replays them.
+func finishStream(cfg *config.Config, sse *SSEWriter, r *http.Request, userKey string, userReq ChatRequest, lookup *CacheLookup, flight *Flight, result UpstreamStream) {
+	model := userReq.Model
+	clientGone := r.Context().Err() != nil
+
+	// Upstream never started (unreachable or refused): relay its error
+	if !result.Started {
+		if flight != nil {
+			flight.Finish("", result.Err)
+		}
+		if clientGone {
+			LogRequest(userKey, model, StreamClientCancelled, false)
+		} else {
+			LogRequest(userKey, model, UpstreamFailureStatus(result.Err), false)
+		}
+		sse.Error(result.Err)
+		sse.Done()
+		return
+	}
+
+	if !result.Finished {
+		sse.Error(result.Err)
+	}
+	sse.Done()
+
+	// Only a complete answer is cached or shared with coalesced followers
+	if result.Finished && result.Answer != "" { // Tool-call-only streams have nothing to cache
+		lookup.Save(cfg, model, result.Answer, nil)
+	}
+	if flight != nil {
+		if result.Finished {
+			flight.Finish(result.Answer, nil)
+		} else {
+			flight.Finish(result.Answer, result.Err)
+		}
+	}
+
+	// A client that left is logged as cancelled, even if the stream went on
+	// to finish for coalesced followers
+	status := http.StatusOK
+	if clientGone {
+		status = StreamClientCancelled
+	} else if !result.Finished {
+		status = http.StatusBadGateway
+	}
+	LogRequest(userKey, model, status, false)
+	if status == http.StatusOK {
+		userReq.logTemplateUse(userKey)
+	}
+	if !result.Finished && clientGone {
+		streamsCancelled.Add(1)
+		log.Printf("🔌 Client disconnected mid-stream: upstream cancelled after ~%d tokens", result.Usage.Total())
+	}
+	ChargeStreamUsage(userKey, model, result.Usage, status)
+}
+
+// UpstreamStream is the outcome of one streamed OpenAI call
+type UpstreamStream struct {
+	Started  bool         // Upstream accepted the request (HTTP 200)
+	Finished bool         // The stream reached [DONE]
+	Answer   string       // Text deltas, concatenated
+	Usage    TokenUsage   // Reported by OpenAI, or estimated for cut-short streams
+	Err      *StreamError // Why it didn't finish
+}
+
+// streamUpstream streams a chat completion from OpenAI, calling emit with
+// every chunk that carries choices. Cancelling ctx stops the upstream call.
+func streamUpstream(ctx context.Context, cfg *config.Config, userReq ChatRequest, messages []Message, emit func(StreamChunk)) UpstreamStream {
 	payload := StreamRequestPayload{
-		Model: userReq.Model,
-		Messages: []Message{
-			{Role: "user", Content: userReq.Message},
-		},
-		Stream: true, // Tell OpenAI to stream
+		Model:       userReq.Model,
+		Messages:    messages,
+		Stream:      true, // Tell OpenAI to stream
+		Temperature: userReq.Temperature,
+		Tools:       userReq.Tools,
+
+		StreamOptions: &StreamOptions{IncludeUsage: true},
 	}
 	jsonBody, _ := json.Marshal(payload)
 
-	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonBody))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonBody))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+cfg.OpenAIKey)
 
-	// 4. Execute Request
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Fprintf(w, "data: Error connecting to OpenAI\n\n")
-		return
+		return UpstreamStream{Err: &StreamError{Type: "upstream_unavailable", Message: "Error connecting to OpenAI"}}
 	}
 	defer resp.Body.Close()
 
-	// 5. THE PIPELINE (Read from OpenAI -> Write to User)
-	reader := bufio.NewReader(resp.Body)
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
+	// Upstream refused the request: relay its error instead of an empty stream
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		streamErr := ParseUpstreamError(resp.StatusCode, body)
+		if IsContextOverflow(streamErr) {
+			streamErr.Type = "context_length_exceeded"
+		}
+		log.Printf("OpenAI Stream Error: %v", streamErr)
+		return UpstreamStream{Err: streamErr}
 	}
 
+	result := UpstreamStream{Started: true}
+	reader := bufio.NewReader(resp.Body)
+	var answer strings.Builder
+	var usage *TokenUsage
 	for {
-		// Read a line from OpenAI
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			break // End of stream
+			break // End of stream (or the upstream call was cancelled)
+		}
+
+		// Only data lines carry events; blank lines and comments are framing
+		data, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			result.Finished = true
+			break
 		}
 
-		// OpenAI sends lines like: "data: { ... json ... }"
-		// We just forward them directly to the user
-		lineStr := string(line)
-		
-		if strings.HasPrefix(lineStr, "data: ") {
-			// Write to our client
-			w.Write(line)
-			// FLUSH instantly (Don't wait for buffer to fill)
-			flusher.Flush()
+		var chunk StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			log.Printf("Skipping malformed stream chunk: %v", err)
+			continue
+		}
+		if chunk.Error != nil {
+			result.Err = chunk.Error.streamError(0)
+			break
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage // The usage-only chunk we asked for isn't forwarded
 		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		answer.WriteString(chunk.Choices[0].Delta.Content)
+		emit(chunk)
+	}
+
+	result.Answer = answer.String()
+	if !result.Finished && result.Err == nil {
+		result.Err = &StreamError{Type: "upstream_interrupted", Message: "upstream stream ended early"}
 	}
-}
\ No newline at end of file
+
+	// The provider bills whatever it generated, so a cut-short stream is
+	// estimated from the prompt and the deltas received
+	if usage == nil {
+		usage = &TokenUsage{PromptTokens: CountMessageTokens(userReq.Model, messages), CompletionTokens: CountTokens(userReq.Model, result.Answer), Estimated: true}
+	}
+	result.Usage = *usage
+	return result
+}
+
+// ChargeStreamUsage charges and logs the tokens of a streamed call
+func ChargeStreamUsage(apiKey, model string, usage TokenUsage, status int) {
+	ChargeTokens(apiKey, usage.Total())
+	LogTokenUsage(apiKey, model, usage, status)
+}
+
+// replayChunks splits a cached answer into small word groups so a hit
+// streams like a live answer. Joined back together they equal text.
+func replayChunks(text string) []string {
+	const wordsPerChunk = 4
+	var chunks []string
+	words := strings.SplitAfter(text, " ")
+	for i := 0; i < len(words); i += wordsPerChunk {
+		chunks = append(chunks, strings.Join(words[i:min(i+wordsPerChunk, len(words))], ""))
+	}
+	return chunks
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"log"
+	"sort"
+	"time"
+)
+
+// cacheEntryStat is the slice of metadata the sweeper needs to rank entries
+type cacheEntryStat struct {
+	ID        string
+	Hits      int64
+	LastHitAt int64
+	CreatedAt int64
+}
+
+// StartCacheSweeper runs SweepCache on a fixed interval in the background
+func StartCacheSweeper(cfg *config.Config) {
+	if GetVectorStore(cfg) == nil || cfg.CacheSweepInterval <= 0 {
+		return
+	}
+
+	go func() {
+		// One pass at startup stamps legacy entries, so lookups find them
+		SweepCache(cfg)
+		ticker := time.NewTicker(cfg.CacheSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			SweepCache(cfg)
+		}
+	}()
+	log.Printf("🧹 Cache sweeper running every %s", cfg.CacheSweepInterval)
+}
+
+// SweepCache deletes expired entries in every namespace, then evicts the
+// least-used entries of any namespace still above CacheMaxEntries.
+func SweepCache(cfg *config.Config) {
+	store := GetVectorStore(cfg)
+	if store == nil {
+		return
+	}
+	namespaces, err := store.Namespaces()
+	if err != nil {
+		log.Printf("⚠️ Cache sweep failed: %v", err)
+		return
+	}
+
+	for namespace := range namespaces {
+		stamped, expired, evicted, err := sweepNamespace(cfg, store, namespace)
+		if err != nil {
+			log.Printf("⚠️ Cache sweep of namespace %q failed: %v", namespace, err)
+			continue
+		}
+		if stamped > 0 {
+			log.Printf("🧹 Namespace %q: stamped %d entries with no created_at", namespace, stamped)
+		}
+		if expired > 0 || evicted > 0 {
+			log.Printf("🧹 Namespace %q: removed %d expired, evicted %d least-used", namespace, expired, evicted)
+		}
+	}
+}
+
+func sweepNamespace(cfg *config.Config, store VectorStore, namespace string) (int, int, int, error) {
+	ttl := CacheTTL(cfg, LogicalNamespace(namespace))
+	now := time.Now().Unix()
+	hitCounts := CacheHitCounts(namespace)
+
+	// 1. Walk every entry, splitting expired from live. Entries from before
+	// stamping existed get created_at=now once, so the TTL starts today.
+	var expired, unstamped []string
+	var live []cacheEntryStat
+	err := ScanStore(store, namespace, func(vectors map[string]VectorRecord) error {
+		for id, v := range vectors {
+			if IsCacheEntryExpired(v.Metadata, ttl) {
+				expired = append(expired, id)
+				continue
+			}
+			stat := cacheEntryStat{
+				ID:        id,
+				Hits:      metaInt(v.Metadata, "hits"),
+				LastHitAt: metaInt(v.Metadata, "last_hit_at"),
+				CreatedAt: metaInt(v.Metadata, "created_at"),
+			}
+			if n, ok := hitCounts[id]; ok {
+				stat.Hits = n // Redis holds the exact count
+			}
+			if stat.CreatedAt == 0 {
+				unstamped = append(unstamped, id)
+				stat.CreatedAt = now
+			}
+			if IsCacheEntryPinned(v.Metadata) {
+				continue // Pinned entries don't count towards the cap
+			}
+			live = append(live, stat)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	stamped := 0
+	for _, id := range unstamped {
+		if err := store.UpdateMetadata(namespace, id, map[string]interface{}{"created_at": now}); err != nil {
+			log.Printf("⚠️ Cache stamp of %s/%s failed: %v", namespace, id, err)
+			continue
+		}
+		stamped++
+	}
+
+	if err := store.Delete(namespace, expired); err != nil {
+		return stamped, 0, 0, err
+	}
+	ForgetCacheHits(namespace, expired...)
+	MirrorDeleteToMigration(cfg, namespace, expired)
+
+	// 2. Enforce the size cap: fewest hits go first, oldest activity breaks ties
+	if cfg.CacheMaxEntries <= 0 || len(live) <= cfg.CacheMaxEntries {
+		return stamped, len(expired), 0, nil
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Hits != live[j].Hits {
+			return live[i].Hits < live[j].Hits
+		}
+		return max(live[i].LastHitAt, live[i].CreatedAt) < max(live[j].LastHitAt, live[j].CreatedAt)
+	})
+
+	overflow := live[:len(live)-cfg.CacheMaxEntries]
+	evict := make([]string, 0, len(overflow))
+	for _, e := range overflow {
+		evict = append(evict, e.ID)
+	}
+	if err := store.Delete(namespace, evict); err != nil {
+		return stamped, len(expired), 0, err
+	}
+	ForgetCacheHits(namespace, evict...)
+	MirrorDeleteToMigration(cfg, namespace, evict)
+	return stamped, len(expired), len(evict), nil
+}
@@ -0,0 +1,327 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Prompt templates: named, versioned message lists with {{variable}}
+// placeholders, a default model and default parameters, kept in the
+// prompt_templates table and managed through the admin API. A chat request
+// names one with "template": {"id", "version", "variables"}; the rendered
+// messages go before the request's own, and everything downstream (cache
+// key included) sees only the rendered prompt. Versions are immutable:
+// saving a template adds a version.
+
+var (
+	templatesRendered = Counter("nexus_templates_rendered_total", "Chat requests rendered from a prompt template")
+
+	templateIDPattern   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+	templatePlaceholder = regexp.MustCompile(`\{\{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\}\}`)
+)
+
+// TemplateRef is the "template" field of a chat request
+type TemplateRef struct {
+	ID        string            `json:"id"`
+	Version   int               `json:"version,omitempty"` // 0 = latest
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// PromptTemplate is one version of a template
+type PromptTemplate struct {
+	ID          string             `json:"id"`
+	Version     int                `json:"version"`
+	Description string             `json:"description,omitempty"`
+	Messages    []Message          `json:"messages"`
+	Variables   map[string]*string `json:"variables,omitempty"` // Name → default; null = required
+	Model       string             `json:"model,omitempty"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	Tools       []json.RawMessage  `json:"tools,omitempty"` // Refused, see validate
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+// Ref is how responses and logs name a version: "id@v3"
+func (t *PromptTemplate) Ref() string {
+	return fmt.Sprintf("%s@v%d", t.ID, t.Version)
+}
+
+// validate checks a new version: a usable id, valid roles, and every
+// placeholder declared as a variable. Tools are refused: most endpoints a
+// template can be used from answer with text only (see CheckTextOnly).
+func (t *PromptTemplate) validate() error {
+	if !templateIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("id must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+	if len(t.Messages) == 0 {
+		return fmt.Errorf("messages is required")
+	}
+	if len(t.Tools) > 0 {
+		return fmt.Errorf("tools can't be part of a template; send them with the request")
+	}
+	for i, m := range t.Messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+		for _, match := range templatePlaceholder.FindAllStringSubmatch(m.Content, -1) {
+			if _, ok := t.Variables[match[1]]; !ok {
+				return fmt.Errorf("messages[%d]: {{%s}} is not a declared variable", i, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+// Render fills in the placeholders. Every variable passed must be declared,
+// and every required one passed.
+func (t *PromptTemplate) Render(variables map[string]string) ([]Message, error) {
+	values := map[string]string{}
+	for name, def := range t.Variables {
+		if v, ok := variables[name]; ok {
+			values[name] = v
+		} else if def != nil {
+			values[name] = *def
+		} else {
+			return nil, fmt.Errorf("template %s: variable %q is required", t.Ref(), name)
+		}
+	}
+	for name := range variables {
+		if _, ok := t.Variables[name]; !ok {
+			return nil, fmt.Errorf("template %s: unknown variable %q (declared: %s)", t.Ref(), name, strings.Join(templateNames(t), ", "))
+		}
+	}
+
+	rendered := make([]Message, len(t.Messages))
+	for i, m := range t.Messages {
+		rendered[i] = Message{Role: m.Role, Content: templatePlaceholder.ReplaceAllStringFunc(m.Content, func(p string) string {
+			return values[templatePlaceholder.FindStringSubmatch(p)[1]]
+		})}
+	}
+	return rendered, nil
+}
+
+// LoadTemplate returns one version of a template (0 = the latest)
+func LoadTemplate(reqCtx context.Context, id string, version int) (*PromptTemplate, error) {
+	if db == nil {
+		return nil, fmt.Errorf("templates need the database")
+	}
+	var t PromptTemplate
+	var messages, variables string
+	err := db.QueryRow(reqCtx, `
+		SELECT id, version, description, messages, variables, model, temperature, created_at
+		FROM prompt_templates
+		WHERE id = $1 AND ($2 = 0 OR version = $2) AND deleted_at IS NULL
+		ORDER BY version DESC LIMIT 1
+	`, id, version).Scan(&t.ID, &t.Version, &t.Description, &messages, &variables, &t.Model, &t.Temperature, &t.CreatedAt)
+	if err == pgx.ErrNoRows {
+		if version > 0 {
+			return nil, fmt.Errorf("template %s version %d not found", id, version)
+		}
+		return nil, fmt.Errorf("template %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(messages), &t.Messages)
+	json.Unmarshal([]byte(variables), &t.Variables)
+	return &t, nil
+}
+
+// ApplyTemplate renders the request's template, if it names one, in front
+// of its own messages and fills in the template's model and parameters
+// where the request left them unset. The reference is cleared, so the
+// request can be stored or answered as is; the version used is returned
+// for the caller to report.
+func ApplyTemplate(reqCtx context.Context, userReq *ChatRequest) (*PromptTemplate, error) {
+	userReq.TemplateUsed = nil
+	ref := userReq.Template
+	if ref == nil {
+		return nil, nil
+	}
+	if ref.ID == "" {
+		return nil, fmt.Errorf("template.id is required")
+	}
+	t, err := LoadTemplate(reqCtx, ref.ID, ref.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Apply(userReq); err != nil {
+		return nil, err
+	}
+	log.Printf("🧩 Rendered template %s", t.Ref())
+	return t, nil
+}
+
+// Apply is ApplyTemplate with the version already loaded (batch uploads
+// load each one once). The use is logged once the request is answered.
+func (t *PromptTemplate) Apply(userReq *ChatRequest) error {
+	rendered, err := t.Render(userReq.Template.Variables)
+	if err != nil {
+		return err
+	}
+
+	userReq.Messages, userReq.Message = append(rendered, userReq.Conversation()...), ""
+	if userReq.Model == "" {
+		userReq.Model = t.Model
+	}
+	if userReq.Temperature == nil {
+		userReq.Temperature = t.Temperature
+	}
+	userReq.Template = nil
+	userReq.TemplateUsed = &TemplateRef{ID: t.ID, Version: t.Version}
+
+	templatesRendered.Add(1)
+	return nil
+}
+
+// logTemplateUse records the template an answered request was rendered from
+func (req ChatRequest) logTemplateUse(apiKey string) {
+	if t := req.TemplateUsed; t != nil {
+		LogTemplateUse(apiKey, t.ID, t.Version, req.Model)
+	}
+}
+
+// HandleAdminTemplates lists every template at its latest version (GET) or
+// saves a new version (POST, the body is a PromptTemplate minus version):
+// /api/admin/templates
+func HandleAdminTemplates(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Templates need the database", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(r.Context(), `
+			SELECT DISTINCT ON (id) id, version, description, model, created_at
+			FROM prompt_templates WHERE deleted_at IS NULL ORDER BY id, version DESC
+		`)
+		if err != nil {
+			http.Error(w, "Failed to list templates", http.StatusInternalServerError)
+			return
+		}
+		templates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PromptTemplate, error) {
+			var t PromptTemplate
+			err := row.Scan(&t.ID, &t.Version, &t.Description, &t.Model, &t.CreatedAt)
+			return t, err
+		})
+		if err != nil {
+			http.Error(w, "Failed to list templates", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"templates": templates})
+
+	case http.MethodPost:
+		var t PromptTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := t.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		messages, _ := json.Marshal(t.Messages)
+		variables, _ := json.Marshal(t.Variables)
+
+		// The next version number, counting deleted versions so a number is
+		// never reused; the primary key turns a race into a retryable error
+		err := db.QueryRow(r.Context(), `
+			INSERT INTO prompt_templates (id, version, description, messages, variables, model, temperature)
+			SELECT $1, COALESCE(max(version), 0) + 1, $2, $3, $4, $5, $6
+			FROM prompt_templates WHERE id = $1
+			RETURNING version, created_at
+		`, t.ID, t.Description, string(messages), string(variables), t.Model, t.Temperature).Scan(&t.Version, &t.CreatedAt)
+		if err != nil {
+			log.Printf("Template save error: %v", err)
+			http.Error(w, "Failed to save template", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("🧩 Saved template %s", t.Ref())
+		writeJSON(w, http.StatusCreated, t)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleAdminTemplate shows a version with the list of all versions (GET)
+// or deletes one version, or the whole template without ?version= (DELETE):
+// /api/admin/templates/{id}?version=. Deleted versions are only marked, so
+// their numbers stay taken and template_usage keeps pointing at them.
+func HandleAdminTemplate(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Templates need the database", http.StatusServiceUnavailable)
+		return
+	}
+	id := r.PathValue("id")
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil && r.URL.Query().Get("version") != "" {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		t, err := LoadTemplate(r.Context(), id, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		rows, err := db.Query(r.Context(), "SELECT version FROM prompt_templates WHERE id = $1 AND deleted_at IS NULL ORDER BY version", id)
+		if err != nil {
+			http.Error(w, "Failed to load versions", http.StatusInternalServerError)
+			return
+		}
+		versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			http.Error(w, "Failed to load versions", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"template": t, "versions": versions})
+
+	case http.MethodDelete:
+		tag, err := db.Exec(r.Context(), `
+			UPDATE prompt_templates SET deleted_at = now()
+			WHERE id = $1 AND ($2 = 0 OR version = $2) AND deleted_at IS NULL
+		`, id, version)
+		if err != nil {
+			http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		deleted := map[string]any{"deleted": id, "versions": tag.RowsAffected()}
+		if version > 0 {
+			deleted["version"] = version
+		}
+		log.Printf("🧩 Deleted template %s (%d versions)", id, tag.RowsAffected())
+		writeJSON(w, http.StatusOK, deleted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// templateNames lists a template's declared variables, for error messages
+func templateNames(t *PromptTemplate) []string {
+	names := make([]string, 0, len(t.Variables))
+	for name := range t.Variables {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
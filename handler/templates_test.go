@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	product := "Nexus"
+	tmpl := &PromptTemplate{
+		ID:      "support-reply",
+		Version: 2,
+		Messages: []Message{
+			{Role: "system", Content: "You support {{product}} customers. Tone: {{ tone }}."},
+			{Role: "user", Content: "Greet {{name}} and sign as {{product}} support."},
+		},
+		Variables: map[string]*string{"product": &product, "tone": nil, "name": nil},
+	}
+
+	tests := []struct {
+		name      string
+		variables map[string]string
+		want      []string // Rendered contents, in order
+		wantErr   string
+	}{
+		{
+			name:      "defaults fill unset variables",
+			variables: map[string]string{"tone": "warm", "name": "Ada"},
+			want:      []string{"You support Nexus customers. Tone: warm.", "Greet Ada and sign as Nexus support."},
+		},
+		{
+			name:      "a passed value beats the default",
+			variables: map[string]string{"product": "Acme", "tone": "dry", "name": "Bo"},
+			want:      []string{"You support Acme customers. Tone: dry.", "Greet Bo and sign as Acme support."},
+		},
+		{
+			name:      "values are not rendered again",
+			variables: map[string]string{"tone": "{{name}}", "name": "Cy"},
+			want:      []string{"You support Nexus customers. Tone: {{name}}.", "Greet Cy and sign as Nexus support."},
+		},
+		{
+			name:      "missing required variable",
+			variables: map[string]string{"name": "Ada"},
+			wantErr:   `variable "tone" is required`,
+		},
+		{
+			name:      "unknown variable",
+			variables: map[string]string{"tone": "warm", "name": "Ada", "team": "billing"},
+			wantErr:   `unknown variable "team" (declared: name, product, tone)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := tmpl.Render(tt.variables)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Render error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if len(rendered) != len(tt.want) {
+				t.Fatalf("rendered %d messages, want %d", len(rendered), len(tt.want))
+			}
+			for i, m := range rendered {
+				if m.Role != tmpl.Messages[i].Role || m.Content != tt.want[i] {
+					t.Errorf("messages[%d] = %s: %q, want %s: %q", i, m.Role, m.Content, tmpl.Messages[i].Role, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRecordsTemplateUsed(t *testing.T) {
+	tmpl := &PromptTemplate{
+		ID: "greeting", Version: 3, Model: "gpt-4o",
+		Messages: []Message{{Role: "system", Content: "Be kind."}},
+	}
+	req := ChatRequest{Message: "hi", Template: &TemplateRef{ID: "greeting"}}
+	if err := tmpl.Apply(&req); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if req.Template != nil {
+		t.Error("Apply left the template reference in place")
+	}
+	if req.TemplateUsed == nil || req.TemplateUsed.ID != "greeting" || req.TemplateUsed.Version != 3 {
+		t.Errorf("TemplateUsed = %+v, want greeting v3", req.TemplateUsed)
+	}
+	if req.Model != "gpt-4o" || len(req.Messages) != 2 || req.Messages[1].Content != "hi" {
+		t.Errorf("applied request = %+v", req)
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    PromptTemplate
+		wantErr string
+	}{
+		{"valid", PromptTemplate{ID: "greeting", Messages: []Message{{Role: "system", Content: "Hi {{name}}"}}, Variables: map[string]*string{"name": nil}}, ""},
+		{"bad id", PromptTemplate{ID: "no spaces", Messages: []Message{{Role: "system", Content: "Hi"}}}, "id must be"},
+		{"undeclared variable", PromptTemplate{ID: "greeting", Messages: []Message{{Role: "system", Content: "Hi {{name}}"}}}, "not a declared variable"},
+		{"tools", PromptTemplate{ID: "greeting", Messages: []Message{{Role: "system", Content: "Hi"}}, Tools: []json.RawMessage{json.RawMessage(`{"type":"function"}`)}}, "tools can't be part of a template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tmpl.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTemplateVersionsNeverReused(t *testing.T) {
+	useTestDB(t)
+	save := func() int {
+		body := `{"id": "greeting", "messages": [{"role": "system", "content": "Be kind."}]}`
+		w := httptest.NewRecorder()
+		HandleAdminTemplates(w, httptest.NewRequest(http.MethodPost, "/api/admin/templates", strings.NewReader(body)))
+		var saved PromptTemplate
+		if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &saved) != nil {
+			t.Fatalf("save: %d %s", w.Code, w.Body.String())
+		}
+		return saved.Version
+	}
+	save()
+	save()
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/admin/templates/greeting?version=2", nil)
+	r.SetPathValue("id", "greeting")
+	w := httptest.NewRecorder()
+	HandleAdminTemplate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+
+	if v := save(); v != 3 {
+		t.Errorf("saved version %d after deleting v2, want 3", v)
+	}
+	if _, err := LoadTemplate(ctx, "greeting", 2); err == nil {
+		t.Error("deleted version still loads")
+	}
+	if latest, err := LoadTemplate(ctx, "greeting", 0); err != nil || latest.Version != 3 {
+		t.Errorf("latest = %+v, %v; want v3", latest, err)
+	}
+}
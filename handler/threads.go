@@ -0,0 +1,412 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Conversation threads: the history lives in Postgres (threads,
+// thread_messages), so clients send only the new turn. Running a thread
+// answers its history through the normal chat path and appends the reply.
+// Everything but running (which costs a credit) is free and scoped to the key.
+
+type Thread struct {
+	ID           string          `json:"id"`
+	Title        string          `json:"title,omitempty"`
+	Model        string          `json:"model,omitempty"` // Default model for runs
+	MessageCount int             `json:"message_count"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	Messages     []ThreadMessage `json:"messages,omitempty"`
+}
+
+type ThreadMessage struct {
+	ID        int64     `json:"id"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateThreadRequest struct {
+	Title    string    `json:"title"`
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"` // Optional starting history (e.g. a system prompt)
+}
+
+type AppendMessagesRequest struct {
+	Role     string    `json:"role"` // With content: one message, "user" by default
+	Content  string    `json:"content"`
+	Messages []Message `json:"messages"`
+}
+
+// threadKey returns the caller's key if it may use the thread API
+func threadKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if db == nil {
+		http.Error(w, "Threads need the database", http.StatusServiceUnavailable)
+		return "", false
+	}
+	userKey := getAPIKey(r)
+	if !ValidateAPIKey(userKey) {
+		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+		return "", false
+	}
+	return userKey, true
+}
+
+func validateThreadMessages(messages []Message) error {
+	for i, m := range messages {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+		if m.Content == "" {
+			return fmt.Errorf("messages[%d]: content is required", i)
+		}
+	}
+	return nil
+}
+
+// HandleThreads lists the key's threads (GET, newest first; ?limit=&offset=)
+// or creates one (POST)
+func HandleThreads(w http.ResponseWriter, r *http.Request) {
+	userKey, ok := threadKey(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 100 {
+			limit = 50
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		rows, err := db.Query(r.Context(), `
+			SELECT t.id, t.title, t.model, t.created_at, t.updated_at,
+				(SELECT count(*) FROM thread_messages m WHERE m.thread_id = t.id)
+			FROM threads t WHERE t.api_key = $1
+			ORDER BY t.updated_at DESC LIMIT $2 OFFSET $3
+		`, userKey, limit, max(offset, 0))
+		if err != nil {
+			http.Error(w, "Failed to list threads", http.StatusInternalServerError)
+			return
+		}
+		threads, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Thread, error) {
+			var t Thread
+			err := row.Scan(&t.ID, &t.Title, &t.Model, &t.CreatedAt, &t.UpdatedAt, &t.MessageCount)
+			return t, err
+		})
+		if err != nil {
+			http.Error(w, "Failed to list threads", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"threads": threads})
+
+	case http.MethodPost:
+		var req CreateThreadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateThreadMessages(req.Messages); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := "thr_" + GenerateHash(fmt.Sprintf("%s|%d", userKey, time.Now().UnixNano()))[:24]
+		if err := createThread(r.Context(), id, userKey, req); err != nil {
+			log.Printf("Thread create error: %v", err)
+			http.Error(w, "Failed to create thread", http.StatusInternalServerError)
+			return
+		}
+		thread, err := loadThread(r.Context(), id, userKey, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, thread)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createThread(reqCtx context.Context, id, apiKey string, req CreateThreadRequest) error {
+	tx, err := db.Begin(reqCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(reqCtx)
+
+	if _, err := tx.Exec(reqCtx, "INSERT INTO threads (id, api_key, title, model) VALUES ($1, $2, $3, $4)", id, apiKey, req.Title, req.Model); err != nil {
+		return err
+	}
+	if err := insertThreadMessages(reqCtx, tx, id, req.Messages); err != nil {
+		return err
+	}
+	return tx.Commit(reqCtx)
+}
+
+// insertThreadMessages appends messages in order and touches the thread
+func insertThreadMessages(reqCtx context.Context, tx pgx.Tx, threadID string, messages []Message) error {
+	for _, m := range messages {
+		if _, err := tx.Exec(reqCtx, "INSERT INTO thread_messages (thread_id, role, content) VALUES ($1, $2, $3)", threadID, m.Role, m.Content); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(reqCtx, "UPDATE threads SET updated_at = now() WHERE id = $1", threadID)
+	return err
+}
+
+// loadThread returns the thread if it belongs to apiKey, optionally with its messages
+func loadThread(reqCtx context.Context, id, apiKey string, withMessages bool) (*Thread, error) {
+	var t Thread
+	var owner string
+	err := db.QueryRow(reqCtx, `
+		SELECT id, api_key, title, model, created_at, updated_at,
+			(SELECT count(*) FROM thread_messages WHERE thread_id = $1)
+		FROM threads WHERE id = $1
+	`, id).Scan(&t.ID, &owner, &t.Title, &t.Model, &t.CreatedAt, &t.UpdatedAt, &t.MessageCount)
+	if err != nil || owner != apiKey {
+		return nil, fmt.Errorf("thread %s not found", id)
+	}
+	if !withMessages {
+		return &t, nil
+	}
+
+	rows, err := db.Query(reqCtx, "SELECT id, role, content, created_at FROM thread_messages WHERE thread_id = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	t.Messages, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ThreadMessage, error) {
+		var m ThreadMessage
+		err := row.Scan(&m.ID, &m.Role, &m.Content, &m.CreatedAt)
+		return m, err
+	})
+	return &t, err
+}
+
+// HandleThread shows a thread with its messages (GET) or deletes it (DELETE):
+// /api/threads/{id}
+func HandleThread(w http.ResponseWriter, r *http.Request) {
+	userKey, ok := threadKey(w, r)
+	if !ok {
+		return
+	}
+	thread, err := loadThread(r.Context(), r.PathValue("id"), userKey, r.Method == http.MethodGet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, thread)
+
+	case http.MethodDelete:
+		tx, err := db.Begin(r.Context())
+		if err == nil {
+			defer tx.Rollback(r.Context())
+			if _, err = tx.Exec(r.Context(), "DELETE FROM thread_messages WHERE thread_id = $1", thread.ID); err == nil {
+				if _, err = tx.Exec(r.Context(), "DELETE FROM threads WHERE id = $1", thread.ID); err == nil {
+					err = tx.Commit(r.Context())
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Thread delete error: %v", err)
+			http.Error(w, "Failed to delete thread", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"deleted": thread.ID})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleThreadExport downloads a thread: JSON by default, or one message
+// per line with ?format=jsonl
+func HandleThreadExport(w http.ResponseWriter, r *http.Request) {
+	userKey, ok := threadKey(w, r)
+	if !ok {
+		return
+	}
+	thread, err := loadThread(r.Context(), r.PathValue("id"), userKey, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", thread.ID+".jsonl"))
+		enc := json.NewEncoder(w)
+		for _, m := range thread.Messages {
+			enc.Encode(m)
+		}
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", thread.ID+".json"))
+	writeJSON(w, http.StatusOK, thread)
+}
+
+// HandleThreadMessages appends to a thread: POST /api/threads/{id}/messages
+// with {"content": "..."} (a user turn, or set "role") or {"messages": [...]}
+func HandleThreadMessages(w http.ResponseWriter, r *http.Request) {
+	userKey, ok := threadKey(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	thread, err := loadThread(r.Context(), r.PathValue("id"), userKey, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var req AppendMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	messages := req.Messages
+	if req.Content != "" {
+		if req.Role == "" {
+			req.Role = "user"
+		}
+		messages = append(messages, Message{Role: req.Role, Content: req.Content})
+	}
+	if len(messages) == 0 {
+		http.Error(w, "content or messages is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateThreadMessages(messages); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := appendThreadMessages(r.Context(), thread.ID, messages); err != nil {
+		log.Printf("Thread append error: %v", err)
+		http.Error(w, "Failed to append messages", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"thread_id": thread.ID, "appended": len(messages)})
+}
+
+func appendThreadMessages(reqCtx context.Context, threadID string, messages []Message) error {
+	tx, err := db.Begin(reqCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(reqCtx)
+	if err := insertThreadMessages(reqCtx, tx, threadID, messages); err != nil {
+		return err
+	}
+	return tx.Commit(reqCtx)
+}
+
+// HandleThreadRun answers a thread: POST /api/threads/{id}/run with an
+// /api/chat body minus "messages" ("message" adds a user turn first). The
+// history is trimmed to the model's context window, and the new turn and
+// the reply are appended only if the run succeeds.
+func HandleThreadRun(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+	userKey, ok := threadKey(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	thread, err := loadThread(r.Context(), r.PathValue("id"), userKey, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var userReq ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&userReq); err != nil {
+		if le := BodyLimitError(cfg, userKey, err); le != nil {
+			RefundRequest(userKey) // Cut off without a Content-Length, after the charge
+			le.Write(w)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(userReq.Messages) > 0 {
+		http.Error(w, "messages come from the thread; send the new turn as message", http.StatusBadRequest)
+		return
+	}
+	if userReq.Model == "" {
+		userReq.Model = thread.Model
+	}
+
+	// 1. History, plus the new turn
+	var added []Message
+	if userReq.Message != "" {
+		added = append(added, Message{Role: "user", Content: userReq.Message})
+	}
+	history := make([]Message, 0, len(thread.Messages)+len(added))
+	for _, m := range thread.Messages {
+		history = append(history, Message{Role: m.Role, Content: m.Content})
+	}
+	userReq.Message, userReq.Messages = "", append(history, added...)
+
+	// The token limit applies to the new turn; CompleteChat trims the
+	// history to fit it, so a long thread never gets stuck on a 413
+	if le := LimitsFor(cfg, userKey).CheckTokens(userReq.Model, added, userReq.Tools); le != nil {
+		RefundRequest(userKey)
+		le.Write(w)
+		return
+	}
+	userReq.tokensChecked = true
+
+	// A template goes in front of the history on every run; it isn't stored
+	if t, err := ApplyTemplate(r.Context(), &userReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if t != nil {
+		w.Header().Set("X-Nexus-Template", t.Ref())
+	}
+
+	// 2. The normal chat path (validation, context fitting, cache, provider)
+	reply, chatErr := CompleteChat(r.Context(), cfg, w, r, userKey, userReq)
+	if chatErr != nil {
+		if chatErr.Limit != nil {
+			RefundRequest(userKey)
+		}
+		chatErr.Write(w)
+		return
+	}
+
+	// 3. Keep the turn and the reply
+	assistant := Message{Role: "assistant", Content: reply}
+	if err := appendThreadMessages(r.Context(), thread.ID, append(added, assistant)); err != nil {
+		log.Printf("Thread append error: %v", err)
+		http.Error(w, "Failed to save the reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"thread_id": thread.ID,
+		"choices": []map[string]any{
+			{"message": assistant},
+		},
+	})
+}
@@ -3,6 +3,8 @@ package handler
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"net/http"
 )
 
 // GenerateAPIKey creates a random secure string like "nk-a1b2c3..."
@@ -12,4 +14,27 @@ func GenerateAPIKey() (string, error) {
 		return "", err
 	}
 	return "nk-" + hex.EncodeToString(bytes), nil
-}
\ No newline at end of file
+}
+// writeJSON sends v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// headerRecorder stands in for a ResponseWriter where there is no HTTP
+// response (WebSocket frames, batch items): it keeps the headers the shared
+// chat code sets, to be reported some other way
+type headerRecorder http.Header
+
+func (h headerRecorder) Header() http.Header         { return http.Header(h) }
+func (h headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (h headerRecorder) WriteHeader(int)             {}
+
+func (h headerRecorder) values() map[string]string {
+	values := map[string]string{}
+	for name := range h {
+		values[name] = http.Header(h).Get(name)
+	}
+	return values
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// VectorRecord is one stored vector with its metadata. The same shape is
+// used by every backend and by cache snapshots.
+type VectorRecord struct {
+	ID       string                 `json:"id"`
+	Values   []float32              `json:"values"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// CacheMatch is a cached answer returned by a similarity search
+type CacheMatch struct {
+	ID       string
+	Score    float64
+	Answer   string
+	Metadata map[string]interface{}
+}
+
+// 1. THE CONTRACT
+type VectorStore interface {
+	Upsert(namespace string, records []VectorRecord) error
+	Query(namespace string, vector []float32, topK int, filter map[string]interface{}) ([]CacheMatch, error)
+	Fetch(namespace string, ids []string) (map[string]VectorRecord, error)
+	List(namespace, cursor string) ([]string, string, error) // One page of ids + next cursor ("" when done)
+	Delete(namespace string, ids []string) error
+	DeleteNamespace(namespace string) error
+	UpdateMetadata(namespace, id string, fields map[string]interface{}) error
+	Namespaces() (map[string]int, error) // Namespace -> entry count
+}
+
+// 2. THE FACTORY
+// VECTOR_STORE picks the backend; it defaults to Pinecone when PINECONE_API_KEY
+// is set. Returns nil when no backend is configured (semantic cache disabled).
+func GetVectorStore(cfg *config.Config) VectorStore {
+	switch cfg.VectorStore {
+	case "memory":
+		return memoryStore
+	case "pinecone", "":
+		if cfg.PineconeKey == "" {
+			return nil
+		}
+		return &PineconeStore{Host: cfg.PineconeHost, APIKey: cfg.PineconeKey}
+	case "off":
+		return nil
+	default:
+		log.Printf("⚠️ Unknown VECTOR_STORE %q, semantic cache disabled", cfg.VectorStore)
+		return nil
+	}
+}
+
+// ScanStore walks a whole namespace page by page, handing each page of
+// records to fn. Returning an error from fn stops the scan.
+func ScanStore(store VectorStore, namespace string, fn func(map[string]VectorRecord) error) error {
+	cursor := ""
+	for {
+		ids, next, err := store.List(namespace, cursor)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			records, err := store.Fetch(namespace, ids)
+			if err != nil {
+				return err
+			}
+			if err := fn(records); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ---------------------------
+// 3. PINECONE IMPLEMENTATION
+// ---------------------------
+type PineconeStore struct {
+	Host   string
+	APIKey string
+}
+
+func (p *PineconeStore) Upsert(namespace string, records []VectorRecord) error {
+	return UpsertPinecone(p.Host, p.APIKey, namespace, records)
+}
+
+func (p *PineconeStore) Query(namespace string, vector []float32, topK int, filter map[string]interface{}) ([]CacheMatch, error) {
+	return QueryPinecone(p.Host, p.APIKey, namespace, vector, topK, filter)
+}
+
+func (p *PineconeStore) Fetch(namespace string, ids []string) (map[string]VectorRecord, error) {
+	return FetchPinecone(p.Host, p.APIKey, namespace, ids)
+}
+
+func (p *PineconeStore) List(namespace, cursor string) ([]string, string, error) {
+	return ListPineconeIDs(p.Host, p.APIKey, namespace, cursor)
+}
+
+func (p *PineconeStore) Delete(namespace string, ids []string) error {
+	return DeleteFromPinecone(p.Host, p.APIKey, namespace, ids)
+}
+
+func (p *PineconeStore) DeleteNamespace(namespace string) error {
+	return DeletePineconeNamespace(p.Host, p.APIKey, namespace)
+}
+
+func (p *PineconeStore) UpdateMetadata(namespace, id string, fields map[string]interface{}) error {
+	return UpdatePineconeMetadata(p.Host, p.APIKey, namespace, id, fields)
+}
+
+func (p *PineconeStore) Namespaces() (map[string]int, error) {
+	return PineconeNamespaces(p.Host, p.APIKey)
+}
+
+// ---------------------------
+// 4. IN-MEMORY IMPLEMENTATION
+// ---------------------------
+// MemoryStore keeps vectors in process memory. Useful for local development
+// and as a restore target for snapshots; everything is lost on restart.
+type MemoryStore struct {
+	mu         sync.RWMutex
+	namespaces map[string]map[string]VectorRecord
+}
+
+var memoryStore = &MemoryStore{namespaces: map[string]map[string]VectorRecord{}}
+
+const memoryPageSize = 100
+
+func (m *MemoryStore) Upsert(namespace string, records []VectorRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.namespaces[namespace] == nil {
+		m.namespaces[namespace] = map[string]VectorRecord{}
+	}
+	for _, r := range records {
+		m.namespaces[namespace][r.ID] = r
+	}
+	return nil
+}
+
+func (m *MemoryStore) Query(namespace string, vector []float32, topK int, filter map[string]interface{}) ([]CacheMatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matches := []CacheMatch{}
+	for id, r := range m.namespaces[namespace] {
+		answer, ok := r.Metadata["response"].(string)
+		if !ok || !matchesFilter(r.Metadata, filter) {
+			continue
+		}
+		matches = append(matches, CacheMatch{ID: id, Score: cosineSimilarity(vector, r.Values), Answer: answer, Metadata: copyMetadata(r.Metadata)})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > topK {
+		matches = matches[:topK]
+	}
+	return matches, nil
+}
+
+func (m *MemoryStore) Fetch(namespace string, ids []string) (map[string]VectorRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := map[string]VectorRecord{}
+	for _, id := range ids {
+		if r, ok := m.namespaces[namespace][id]; ok {
+			r.Metadata = copyMetadata(r.Metadata)
+			out[id] = r
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) List(namespace, cursor string) ([]string, string, error) {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.namespaces[namespace]))
+	for id := range m.namespaces[namespace] {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	// Ids are listed in order; the cursor is the last id of the previous page
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, cursor)
+	if cursor != "" && start < len(ids) && ids[start] == cursor {
+		start++
+	}
+	end := min(start+memoryPageSize, len(ids))
+	next := ""
+	if end < len(ids) {
+		next = ids[end-1]
+	}
+	return ids[start:end], next, nil
+}
+
+func (m *MemoryStore) Delete(namespace string, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.namespaces[namespace], id)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteNamespace(namespace string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.namespaces, namespace)
+	return nil
+}
+
+func (m *MemoryStore) UpdateMetadata(namespace, id string, fields map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.namespaces[namespace][id]
+	if !ok {
+		return nil
+	}
+	r.Metadata = copyMetadata(r.Metadata)
+	for k, v := range fields {
+		r.Metadata[k] = v
+	}
+	m.namespaces[namespace][id] = r
+	return nil
+}
+
+func (m *MemoryStore) Namespaces() (map[string]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := map[string]int{}
+	for name, records := range m.namespaces {
+		counts[name] = len(records)
+	}
+	return counts, nil
+}
+
+// matchesFilter supports the subset of Pinecone filters the gateway uses:
+// {"field": value}, {"field": {"$eq"|"$gte"|"$lte"|"$exists": value}} and
+// {"$or": [filter, ...]}. Like Pinecone, a range never matches a missing
+// or non-numeric field.
+func matchesFilter(metadata, filter map[string]interface{}) bool {
+	for field, cond := range filter {
+		if field == "$or" {
+			alternatives, _ := cond.([]interface{})
+			if !slices.ContainsFunc(alternatives, func(alt interface{}) bool {
+				f, ok := alt.(map[string]interface{})
+				return ok && matchesFilter(metadata, f)
+			}) {
+				return false
+			}
+			continue
+		}
+		ops, ok := cond.(map[string]interface{})
+		if !ok {
+			ops = map[string]interface{}{"$eq": cond}
+		}
+		for op, want := range ops {
+			got, present := metadata[field]
+			switch op {
+			case "$eq":
+				if toFloat(got) != toFloat(want) && got != want {
+					return false
+				}
+			case "$gte":
+				if !(toFloat(got) >= toFloat(want)) {
+					return false
+				}
+			case "$lte":
+				if !(toFloat(got) <= toFloat(want)) {
+					return false
+				}
+			case "$exists":
+				if exists, _ := want.(bool); present != exists {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	}
+	return math.NaN()
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		out[k] = v
+	}
+	return out
+}
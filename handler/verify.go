@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	numberPattern = regexp.MustCompile(`-?\d+(?:[.,]\d+)*`)
+	quotedPattern = regexp.MustCompile(`"([^"]+)"|'([^']+)'`)
+	wordPattern   = regexp.MustCompile(`[\p{L}\p{N}]+`)
+)
+
+// Words too common to say anything about whether two prompts match
+var stopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "is": true, "are": true, "was": true, "be": true,
+	"to": true, "of": true, "in": true, "on": true, "for": true, "and": true, "or": true,
+	"i": true, "you": true, "me": true, "my": true, "it": true, "do": true, "does": true,
+	"what": true, "how": true, "can": true, "please": true, "with": true, "this": true, "that": true,
+}
+
+// SelectVerifiedMatch walks the candidates (best score first) and returns the
+// first one above the threshold that passes every verification rule. When
+// nothing qualifies it returns nil and the reason the best candidate failed.
+func SelectVerifiedMatch(cfg *config.Config, prompt, embedderName string, matches []CacheMatch, threshold float64) (*CacheMatch, string) {
+	reason := "below_threshold"
+	for i := range matches {
+		match := &matches[i]
+		if match.Score <= threshold {
+			break // Matches come back sorted by score
+		}
+		if name, _ := match.Metadata["embedder"].(string); name != "" && name != embedderName {
+			continue // Written by another embedder; its score means nothing here
+		}
+
+		ok, why := VerifyCacheCandidate(cfg, prompt, match)
+		if ok {
+			return match, ""
+		}
+		log.Printf("🛑 Rejected cache candidate %s (score %.2f): %s", match.ID, match.Score, why)
+		if i == 0 {
+			reason = why
+		}
+	}
+	return nil, reason
+}
+
+// VerifyCacheCandidate applies the configured checks to one candidate
+func VerifyCacheCandidate(cfg *config.Config, prompt string, match *CacheMatch) (bool, string) {
+	cached, _ := match.Metadata["prompt"].(string)
+	if cached == "" {
+		return false, "no_stored_prompt"
+	}
+
+	// 1. Numbers must match exactly ("5 km" vs "50 km")
+	if cfg.CacheVerifyNumbers && !sameStrings(extractNumbers(prompt), extractNumbers(cached)) {
+		return false, "number_mismatch"
+	}
+
+	// 2. Named things must match ("capital of France" vs "capital of Germany")
+	if cfg.CacheVerifyEntities && !sameStrings(extractEntities(prompt), extractEntities(cached)) {
+		return false, "entity_mismatch"
+	}
+
+	// 3. Enough shared vocabulary
+	if cfg.CacheVerifyMinOverlap > 0 && lexicalOverlap(prompt, cached) < cfg.CacheVerifyMinOverlap {
+		return false, "low_overlap"
+	}
+
+	// 4. Optional cheap LLM judge, asked last because it costs a round trip
+	if cfg.CacheJudgeModel != "" {
+		same, err := judgeSameQuestion(cfg, prompt, cached)
+		if err != nil {
+			log.Printf("⚠️ Cache judge error: %v", err)
+			return false, "judge_error"
+		}
+		if !same {
+			return false, "judge_rejected"
+		}
+	}
+
+	return true, ""
+}
+
+func extractNumbers(text string) []string {
+	numbers := numberPattern.FindAllString(text, -1)
+	for i, n := range numbers {
+		numbers[i] = strings.ReplaceAll(n, ",", "")
+	}
+	return numbers
+}
+
+// extractEntities collects quoted strings and capitalised words that don't
+// start a sentence, lowercased for comparison
+func extractEntities(text string) []string {
+	var entities []string
+	for _, m := range quotedPattern.FindAllStringSubmatch(text, -1) {
+		entities = append(entities, strings.ToLower(m[1]+m[2]))
+	}
+
+	sentenceStart := true
+	for _, field := range strings.Fields(text) {
+		word := strings.Trim(field, `"'()[]{},;:`)
+		if word != "" && !sentenceStart && word != "I" && isCapitalised(word) {
+			entities = append(entities, strings.ToLower(strings.TrimRight(word, ".?!")))
+		}
+		sentenceStart = strings.HasSuffix(field, ".") || strings.HasSuffix(field, "?") || strings.HasSuffix(field, "!")
+	}
+	return entities
+}
+
+func isCapitalised(word string) bool {
+	return unicode.IsUpper([]rune(word)[0])
+}
+
+// lexicalOverlap is the Jaccard similarity of the two prompts' content words
+func lexicalOverlap(a, b string) float64 {
+	setA, setB := contentWords(a), contentWords(b)
+	if len(setA) == 0 && len(setB) == 0 {
+		return 1
+	}
+	shared := 0
+	for w := range setA {
+		if setB[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(setA)+len(setB)-shared)
+}
+
+func contentWords(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		if !stopWords[w] {
+			words[w] = true
+		}
+	}
+	return words
+}
+
+// sameStrings compares two lists as multisets
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// judgeSameQuestion asks a cheap model whether one answer fits both prompts
+func judgeSameQuestion(cfg *config.Config, prompt, cached string) (bool, error) {
+	provider, err := GetProvider(cfg.CacheJudgeModel, cfg.OpenAIKey, cfg.AnthropicKey)
+	if err != nil {
+		return false, err
+	}
+
+	question := fmt.Sprintf(
+		"Would one correct answer fully answer both of these requests? Numbers, names and units must match.\n\nRequest A: %s\n\nRequest B: %s\n\nReply with only YES or NO.",
+		prompt, cached,
+	)
+	reply, err := provider.Send(context.Background(), []Message{{Role: "user", Content: question}}, SendOptions{})
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(reply)), "YES"), nil
+}
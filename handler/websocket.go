@@ -0,0 +1,439 @@
+package handler
+
+import (
+	"NexusGateway/config"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket transport (/api/ws): one connection, authenticated with an nk-
+// key, carries any number of chat requests. Every frame is JSON and tagged
+// with the client's request id, so requests can run side by side.
+//
+// Browsers can't set headers on a WebSocket, so they send the key as a
+// subprotocol next to "nexus": new WebSocket(url, ["nexus", "nk-..."]).
+// The key never goes in the URL, where proxies and access logs keep it.
+//
+// Client:  {"type": "chat", "id": "r1", ...ChatRequest fields}
+//          {"type": "cancel", "id": "r1"}
+// Server:  start (X-Nexus-* headers), delta, done (finish reason, usage),
+//          cancelled (usage so far) or error
+
+// wsProtocol is the subprotocol the gateway selects; it is never the key
+const wsProtocol = "nexus"
+
+var (
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		Subprotocols:    []string{wsProtocol},
+	}
+
+	wsConnections = Counter("nexus_ws_connections_total", "WebSocket connections accepted")
+	wsRequests    = Counter("nexus_ws_requests_total", "Chat requests received over WebSocket")
+	wsCancelled   = Counter("nexus_ws_cancelled_total", "WebSocket chat requests cancelled by the client")
+)
+
+// WSClientFrame is a frame sent by the client
+type WSClientFrame struct {
+	Type string `json:"type"` // "chat" or "cancel"
+	ID   string `json:"id"`   // Client-chosen request id
+	ChatRequest
+}
+
+// WSServerFrame is a frame sent to the client
+type WSServerFrame struct {
+	Type         string            `json:"type"` // start, delta, done, cancelled or error
+	ID           string            `json:"id,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"` // start: the X-Nexus-* headers /api/chat would send
+	Content      string            `json:"content,omitempty"`
+	ToolCalls    []json.RawMessage `json:"tool_calls,omitempty"`
+	FinishReason string            `json:"finish_reason,omitempty"`
+	Usage        *TokenUsage       `json:"usage,omitempty"`
+	Error        *StreamError      `json:"error,omitempty"`
+}
+
+// wsSession is one WebSocket connection and the requests running on it
+type wsSession struct {
+	cfg    *config.Config
+	conn   *websocket.Conn
+	r      *http.Request // The upgrade request: its headers feed cache options and policy
+	apiKey string
+	ip     string
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	cfg := config.LoadConfig()
+
+	if r.URL.Query().Has("api_key") {
+		http.Error(w, "Send the API key as a Sec-WebSocket-Protocol, not in the URL", http.StatusBadRequest)
+		return
+	}
+	token := wsAPIKey(r)
+	if token == "" {
+		http.Error(w, "Missing API Key", http.StatusUnauthorized)
+		return
+	}
+	if !ValidateAPIKey(token) {
+		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+		return
+	}
+
+	// Browsers may only connect from the allowed origins
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = func(r *http.Request) bool { return wsOriginAllowed(cfg, r) }
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // The upgrader already replied
+	}
+	defer conn.Close()
+	wsConnections.Add(1)
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	s := &wsSession{cfg: cfg, conn: conn, r: r, apiKey: token, ip: ip, running: map[string]context.CancelFunc{}}
+	log.Printf("🔌 WebSocket connected (%s)", ip)
+
+	// Closing the connection cancels whatever is still running on it
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		s.wg.Wait()
+		log.Printf("🔌 WebSocket closed (%s)", ip)
+	}()
+	s.keepAlive(sessionCtx)
+
+	// Frames are capped like request bodies; an oversized one gets a 413
+	// error frame and the connection stays open
+	limits := LimitsFor(cfg, token)
+	for {
+		data, tooLarge, err := s.readFrame(limits.MaxBytes)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			return
+		}
+		s.extendDeadline()
+		if tooLarge > 0 {
+			s.failLimit("", limits.CheckBytes(tooLarge))
+			continue
+		}
+
+		var frame WSClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			s.fail("", "invalid_request", "frames must be JSON objects", http.StatusBadRequest)
+			continue
+		}
+		switch frame.Type {
+		case "chat":
+			s.start(sessionCtx, frame)
+		case "cancel":
+			s.cancel(frame.ID)
+		default:
+			s.fail(frame.ID, "invalid_request", "unknown frame type: "+frame.Type, http.StatusBadRequest)
+		}
+	}
+}
+
+// wsAPIKey reads the key from the Authorization header, or from the
+// subprotocols a browser offered
+func wsAPIKey(r *http.Request) string {
+	if token := getAPIKey(r); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, "nk-") {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// wsOriginAllowed admits clients without an Origin (not a browser), the
+// gateway's own host and WS_ALLOWED_ORIGINS
+func wsOriginAllowed(cfg *config.Config, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || cfg.WSAllowedOrigins["*"] || cfg.WSAllowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// readFrame reads one message. A message over limit is drained instead of
+// kept, and only its size is returned (tooLarge), so the session can refuse
+// it without dropping the connection.
+func (s *wsSession) readFrame(limit int) (data []byte, tooLarge int, err error) {
+	_, reader, err := s.conn.NextReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		data, err = io.ReadAll(reader)
+		return data, 0, err
+	}
+	data, err = io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil || len(data) <= limit {
+		return data, 0, err
+	}
+	rest, err := io.Copy(io.Discard, reader)
+	return nil, len(data) + int(rest), err
+}
+
+// keepAlive pings at the heartbeat interval; a connection that stops
+// answering is closed by the read deadline
+func (s *wsSession) keepAlive(sessionCtx context.Context) {
+	interval := s.cfg.StreamHeartbeatInterval
+	if interval <= 0 {
+		return
+	}
+	s.extendDeadline()
+	s.conn.SetPongHandler(func(string) error {
+		s.extendDeadline()
+		return nil
+	})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-t.C:
+				s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+			}
+		}
+	}()
+}
+
+func (s *wsSession) extendDeadline() {
+	if interval := s.cfg.StreamHeartbeatInterval; interval > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(3 * interval))
+	}
+}
+
+// send writes one frame; the connection allows a single writer at a time
+func (s *wsSession) send(frame WSServerFrame) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := s.conn.WriteJSON(frame); err != nil {
+		log.Printf("WebSocket write error: %v", err)
+	}
+}
+
+func (s *wsSession) fail(id, errType, message string, status int) {
+	s.send(WSServerFrame{Type: "error", ID: id, Error: &StreamError{Type: errType, Message: message, Status: status}})
+}
+
+// failLimit sends a pre-flight 413, with the limit's code
+func (s *wsSession) failLimit(id string, le *LimitError) {
+	s.send(WSServerFrame{Type: "error", ID: id, Error: &StreamError{Type: le.Type, Code: le.Code, Message: le.Message, Status: http.StatusRequestEntityTooLarge}})
+}
+
+// start admits a chat frame: the same rate limit and quota as HTTP requests
+// apply to each one
+func (s *wsSession) start(sessionCtx context.Context, frame WSClientFrame) {
+	wsRequests.Add(1)
+	if frame.ID == "" {
+		s.fail("", "invalid_request", "id is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	_, duplicate := s.running[frame.ID]
+	busy := len(s.running) >= max(s.cfg.WSMaxConcurrent, 1)
+	s.mu.Unlock()
+	if duplicate {
+		s.fail(frame.ID, "invalid_request", "a request with this id is already running", http.StatusConflict)
+		return
+	}
+	if busy {
+		s.fail(frame.ID, "too_many_requests", "too many concurrent requests on this connection", http.StatusTooManyRequests)
+		return
+	}
+	if !AllowRate(s.ip) {
+		s.fail(frame.ID, "rate_limited", "429 - Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if status, message := ChargeRequest(s.apiKey); status != http.StatusOK {
+		errType := "quota_exceeded"
+		if status != http.StatusPaymentRequired {
+			errType = "server_error"
+		}
+		s.fail(frame.ID, errType, message, status)
+		return
+	}
+
+	reqCtx, cancel := context.WithCancel(sessionCtx)
+	s.mu.Lock()
+	s.running[frame.ID] = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, frame.ID)
+			s.mu.Unlock()
+			cancel()
+		}()
+		s.run(reqCtx, frame.ID, frame.ChatRequest)
+	}()
+}
+
+// cancel stops a running request; its run sends the cancelled frame
+func (s *wsSession) cancel(id string) {
+	s.mu.Lock()
+	cancel, ok := s.running[id]
+	s.mu.Unlock()
+	if !ok {
+		s.fail(id, "invalid_request", "no running request with this id", http.StatusNotFound)
+		return
+	}
+	cancel()
+}
+
+// run answers one chat request: the cache tiers of /api/chat/stream, then
+// the streamed upstream call
+func (s *wsSession) run(reqCtx context.Context, id string, userReq ChatRequest) {
+	cfg, userKey := s.cfg, s.apiKey
+	headers := headerRecorder{}
+
+	t, err := ApplyTemplate(reqCtx, &userReq)
+	if err != nil {
+		s.fail(id, "invalid_request", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t != nil {
+		headers.Header().Set("X-Nexus-Template", t.Ref())
+	}
+	if userReq.Model == "" {
+		userReq.Model = "gpt-3.5-turbo"
+	}
+	messages := userReq.Conversation()
+	if err := ValidateConversation(messages); err != nil {
+		s.fail(id, "invalid_request", err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := LimitsFor(cfg, userKey)
+	if le := limits.CheckTokens(userReq.Model, messages, userReq.Tools); le != nil {
+		RefundRequest(userKey) // Like the byte limit, a 413 costs no credit
+		s.failLimit(id, le)
+		return
+	}
+	fit, err := FitContext(reqCtx, cfg, s.r, userKey, userReq.Model, messages, limits.MaxTokens)
+	if err != nil {
+		s.fail(id, "invalid_request", err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages = fit.Messages
+	headers.Header().Set("X-Nexus-Context-Trimmed", fit.Header())
+
+	// 1. Cache lookup, with the connection's headers and the frame's options
+	cacheOpts, err := ResolveCacheOptions(s.r, cfg, userKey, userReq)
+	if err != nil {
+		s.fail(id, "invalid_request", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule := ApplyCachePolicy(cfg, userKey, NewPolicyInput(s.r, userReq, messages), &cacheOpts); rule != "" {
+		headers.Header().Set("X-Nexus-Cache-Policy", rule)
+	}
+	cacheKey, keyOK, skipReason := CacheKeyText(cfg, messages)
+	if !keyOK {
+		log.Printf("⏭️ Skipping semantic cache: %s", skipReason)
+		cacheOpts.Read, cacheOpts.Write = false, false
+	}
+
+	lookup := NewCacheLookup(cfg, userKey, cacheKey, cacheOpts)
+	lookup.Run(cfg, userReq.Model, messages)
+
+	// Hit: replay the cached answer as deltas
+	if lookup.Served() {
+		LogRequest(userKey, userReq.Model, 200, lookup.Status == CacheHit)
+		userReq.logTemplateUse(userKey)
+		lookup.Respond(cfg, headers, userKey, userReq.Model, lookup.EntryID)
+		s.send(WSServerFrame{Type: "start", ID: id, Headers: headers.values()})
+		for _, chunk := range replayChunks(lookup.Answer) {
+			s.send(WSServerFrame{Type: "delta", ID: id, Content: chunk})
+		}
+		s.send(WSServerFrame{Type: "done", ID: id, FinishReason: "stop"})
+		return
+	}
+
+	log.Printf("🐢 CACHE %s: Streaming request from %s over WebSocket...", lookup.Status, userReq.Model)
+	if rc := GetClient(); rc != nil {
+		rc.Incr(ctx, "stats:cache_misses")
+	}
+	lookup.Respond(cfg, headers, userKey, userReq.Model, lookup.WritableID())
+	s.send(WSServerFrame{Type: "start", ID: id, Headers: headers.values()})
+
+	// 2. Stream from the provider until done or cancelled
+	finishReason := ""
+	result := streamUpstream(reqCtx, cfg, userReq, messages, func(chunk StreamChunk) {
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			finishReason = *choice.FinishReason
+		}
+		if choice.Delta.Content != "" || len(choice.Delta.ToolCalls) > 0 {
+			s.send(WSServerFrame{Type: "delta", ID: id, Content: choice.Delta.Content, ToolCalls: choice.Delta.ToolCalls})
+		}
+	})
+	cancelled := reqCtx.Err() != nil
+
+	if !result.Started {
+		if cancelled {
+			LogRequest(userKey, userReq.Model, StreamClientCancelled, false)
+			s.send(WSServerFrame{Type: "cancelled", ID: id})
+			return
+		}
+		LogRequest(userKey, userReq.Model, UpstreamFailureStatus(result.Err), false)
+		s.send(WSServerFrame{Type: "error", ID: id, Error: result.Err})
+		return
+	}
+
+	// 3. Cache, log and charge, as for SSE streams
+	if result.Finished && result.Answer != "" {
+		lookup.Save(cfg, userReq.Model, result.Answer, nil)
+	}
+	status := http.StatusOK
+	if cancelled && !result.Finished {
+		status = StreamClientCancelled
+	} else if !result.Finished {
+		status = http.StatusBadGateway
+	}
+	LogRequest(userKey, userReq.Model, status, false)
+	ChargeStreamUsage(userKey, userReq.Model, result.Usage, status)
+
+	switch status {
+	case StreamClientCancelled:
+		wsCancelled.Add(1)
+		log.Printf("✋ WebSocket request %s cancelled after ~%d tokens", id, result.Usage.Total())
+		s.send(WSServerFrame{Type: "cancelled", ID: id, Usage: &result.Usage})
+	case http.StatusOK:
+		userReq.logTemplateUse(userKey)
+		s.send(WSServerFrame{Type: "done", ID: id, FinishReason: finishReason, Usage: &result.Usage})
+	default:
+		s.send(WSServerFrame{Type: "error", ID: id, Error: result.Err, Usage: &result.Usage})
+	}
+}
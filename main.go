@@ -6,8 +6,13 @@ package main
 import (
 	"NexusGateway/config"
 	"NexusGateway/handler"
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -25,6 +30,12 @@ func main() {
 		handler.InitializeRedis(cfg.RedisURL)
 	}
 
+	// One-off CLI commands (cache-import, cache-export, cache-restore); they
+	// need Redis for namespace routes and embedder bindings
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+
 	// 2. Initialize Database
 	if cfg.DBUrl != "" {
 		handler.InitializeDB(cfg.DBUrl)
@@ -32,7 +43,23 @@ func main() {
 		log.Println("⚠️ Skipping DB connection (DB_URL missing)")
 	}
 
-	// 3. PUBLIC ROUTES
+	// 3. Background cache eviction (TTL + size cap)
+	handler.StartCacheSweeper(cfg)
+	handler.ResumeCacheMigrations(cfg)
+	handler.StartCacheWriter(cfg)
+	handler.StartBatchRunner(cfg)
+	handler.StartAsyncRunner(cfg)
+
+	// A broken cache policy at startup is fatal: it may hold privacy opt-outs
+	if _, err := handler.LoadCachePolicy(cfg); err != nil {
+		log.Fatalf("Cache policy error: %v", err)
+	}
+	// So is an embedder whose vectors don't fit the index it would write to
+	if err := handler.CheckEmbedderConfig(cfg); err != nil {
+		log.Fatalf("Embedder config error: %v", err)
+	}
+
+	// 4. PUBLIC ROUTES
 	http.HandleFunc("/api/register", handler.CORSMiddleware(handler.HandleRegister))
 	http.HandleFunc("/api/webhook", handler.HandleWebhook)
 
@@ -47,21 +74,84 @@ func main() {
 		http.ServeFile(w, r, "public/index.html")
 	})
 
-	// 4. PROTECTED ROUTES
+	// 5. PROTECTED ROUTES
 	protectedChat := handler.AuthMiddleware(handler.RateLimitMiddleware(handler.HandleChat))
 	protectedStream := handler.AuthMiddleware(handler.RateLimitMiddleware(handler.HandleStreamChat))
 	
 	http.HandleFunc("/api/chat", handler.CORSMiddleware(protectedChat))
 	http.HandleFunc("/api/chat/stream", handler.CORSMiddleware(protectedStream))
 
+	// Batch jobs: the upload costs a credit, and so does every line;
+	// polling and downloads are free (the handlers check the job's key)
+	protectedBatch := handler.AuthMiddleware(handler.RateLimitMiddleware(handler.HandleCreateBatch))
+	http.HandleFunc("/api/batches", handler.CORSMiddleware(protectedBatch))
+	http.HandleFunc("/api/batches/{id}", handler.CORSMiddleware(handler.HandleBatch))
+	http.HandleFunc("/api/batches/{id}/results", handler.CORSMiddleware(handler.HandleBatchResults))
+
+	// Async requests ({"async": true} on /api/chat): free to poll, and the
+	// key's callback URL gets the result
+	http.HandleFunc("/api/requests/{id}", handler.CORSMiddleware(handler.HandleAsyncRequest))
+	http.HandleFunc("/api/callback", handler.CORSMiddleware(handler.HandleCallback))
+
+	// Threads: running one costs a credit; managing them is free
+	protectedThreadRun := handler.AuthMiddleware(handler.RateLimitMiddleware(handler.HandleThreadRun))
+	http.HandleFunc("/api/threads", handler.CORSMiddleware(handler.HandleThreads))
+	http.HandleFunc("/api/threads/{id}", handler.CORSMiddleware(handler.HandleThread))
+	http.HandleFunc("/api/threads/{id}/messages", handler.CORSMiddleware(handler.HandleThreadMessages))
+	http.HandleFunc("/api/threads/{id}/export", handler.CORSMiddleware(handler.HandleThreadExport))
+	http.HandleFunc("/api/threads/{id}/run", handler.CORSMiddleware(protectedThreadRun))
+
+	// WebSocket sessions authenticate once, then each chat frame is charged
+	http.HandleFunc("/api/ws", handler.HandleWebSocket)
+
 	http.HandleFunc("/api/stats", handler.CORSMiddleware(handler.HandleStats))
 
+	// Feedback is free: the handler checks the key that got the response
+	http.HandleFunc("/api/feedback", handler.CORSMiddleware(handler.HandleFeedback))
+
     protectedCheckout := handler.AuthMiddleware(handler.HandleCheckout)
 	http.HandleFunc("/api/checkout", handler.CORSMiddleware(protectedCheckout))
 
-	// 5. Start Server
-	log.Printf("🚀 Nexus Gateway V2 (Simple Mode) running on port %s", cfg.Port)
-	if err := http.ListenAndServe(":"+cfg.Port, nil); err != nil {
-		log.Fatal(err)
+	// 6. ADMIN ROUTES (ADMIN_API_KEY)
+	http.HandleFunc("/api/admin/cache", handler.AdminMiddleware(handler.HandleAdminCacheList))
+	http.HandleFunc("/api/admin/cache/search", handler.AdminMiddleware(handler.HandleAdminCacheSearch))
+	http.HandleFunc("/api/admin/cache/entries/{id}", handler.AdminMiddleware(handler.HandleAdminCacheEntry))
+	http.HandleFunc("/api/admin/cache/namespace", handler.AdminMiddleware(handler.HandleAdminCacheNamespace))
+	http.HandleFunc("/api/admin/cache/purge", handler.AdminMiddleware(handler.HandleAdminCachePurge))
+	http.HandleFunc("/api/admin/cache/precision", handler.AdminMiddleware(handler.HandleAdminCachePrecision))
+	http.HandleFunc("/api/admin/cache/import", handler.AdminMiddleware(handler.HandleAdminCacheImport))
+	http.HandleFunc("/api/admin/cache/export", handler.AdminMiddleware(handler.HandleAdminCacheExport))
+	http.HandleFunc("/api/admin/cache/restore", handler.AdminMiddleware(handler.HandleAdminCacheRestore))
+	http.HandleFunc("/api/admin/cache/migrations", handler.AdminMiddleware(handler.HandleAdminCacheMigrations))
+	http.HandleFunc("/api/admin/cache/migrations/{id}", handler.AdminMiddleware(handler.HandleAdminCacheMigration))
+	http.HandleFunc("/api/admin/cache/migrations/{id}/resume", handler.AdminMiddleware(handler.HandleAdminCacheMigration))
+	http.HandleFunc("/api/admin/templates", handler.AdminMiddleware(handler.HandleAdminTemplates))
+	http.HandleFunc("/api/admin/templates/{id}", handler.AdminMiddleware(handler.HandleAdminTemplate))
+
+	// 7. METRICS (ADMIN_API_KEY, Prometheus text format)
+	http.HandleFunc("/api/metrics", handler.AdminMiddleware(handler.HandleMetrics))
+
+	// 8. Start Server
+	server := &http.Server{Addr: ":" + cfg.Port}
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		log.Printf("🚀 Nexus Gateway V2 (Simple Mode) running on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// 9. Graceful shutdown: finish in-flight requests, batch items and async requests, then flush queued cache writes
+	<-stop.Done()
+	log.Println("🛑 Shutting down...")
+	shutdownCtx, done := context.WithTimeout(context.Background(), 15*time.Second)
+	defer done()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ Shutdown: %v", err)
 	}
+	handler.StopBatchRunner(shutdownCtx)
+	handler.StopAsyncRunner(shutdownCtx)
+	handler.StopCacheWriter(shutdownCtx)
 }
\ No newline at end of file
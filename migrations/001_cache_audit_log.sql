@@ -0,0 +1,12 @@
+-- Admin actions on the cache (LogCacheAudit)
+CREATE TABLE IF NOT EXISTS cache_audit_log (
+    id         bigserial PRIMARY KEY,
+    actor      text        NOT NULL,
+    action     text        NOT NULL,
+    namespace  text        NOT NULL DEFAULT '',
+    target     text        NOT NULL DEFAULT '',
+    details    jsonb,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS cache_audit_log_created_at_idx ON cache_audit_log (created_at);
@@ -0,0 +1,11 @@
+-- Requests a cache policy rule kept away from the cache (LogCacheBypass)
+CREATE TABLE IF NOT EXISTS cache_policy_log (
+    id         bigserial PRIMARY KEY,
+    api_key    text        NOT NULL,
+    model      text        NOT NULL DEFAULT '',
+    direction  text        NOT NULL, -- read or write
+    rule       text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS cache_policy_log_rule_idx ON cache_policy_log (rule, created_at);
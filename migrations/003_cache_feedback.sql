@@ -0,0 +1,15 @@
+-- Client ratings of responses (LogCacheFeedback); one per response id
+CREATE TABLE IF NOT EXISTS cache_feedback (
+    id           bigserial PRIMARY KEY,
+    response_id  text             NOT NULL UNIQUE,
+    api_key      text             NOT NULL,
+    namespace    text             NOT NULL DEFAULT '', -- Logical namespace
+    entry_id     text             NOT NULL DEFAULT '',
+    cache_status text             NOT NULL,             -- HIT, MISS or BYPASS
+    score        double precision NOT NULL DEFAULT 0,
+    rating       text             NOT NULL CHECK (rating IN ('good', 'bad')),
+    comment      text             NOT NULL DEFAULT '',
+    created_at   timestamptz      NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS cache_feedback_entry_idx ON cache_feedback (namespace, entry_id);
@@ -0,0 +1,17 @@
+-- Upstream tokens per key: a running total on users (ChargeTokens) and one
+-- row per upstream call, including partial streams (LogTokenUsage)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_used bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS token_usage (
+    id                bigserial PRIMARY KEY,
+    api_key           text             NOT NULL,
+    model             text             NOT NULL,
+    prompt_tokens     integer          NOT NULL DEFAULT 0,
+    completion_tokens integer          NOT NULL DEFAULT 0,
+    estimated         boolean          NOT NULL DEFAULT false, -- Counted locally, not reported upstream
+    cost_usd          double precision NOT NULL DEFAULT 0,
+    status            integer          NOT NULL,
+    created_at        timestamptz      NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS token_usage_api_key_idx ON token_usage (api_key, created_at);
@@ -0,0 +1,27 @@
+-- Batch jobs and their lines. Items are claimed with FOR UPDATE SKIP LOCKED;
+-- claimed_at identifies a claim, so only its worker can finish the item.
+CREATE TABLE IF NOT EXISTS batch_jobs (
+    id          text        PRIMARY KEY,
+    api_key     text        NOT NULL,
+    status      text        NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'completed')),
+    total       integer     NOT NULL,
+    completed   integer     NOT NULL DEFAULT 0,
+    failed      integer     NOT NULL DEFAULT 0,
+    created_at  timestamptz NOT NULL DEFAULT now(),
+    finished_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS batch_jobs_open_idx ON batch_jobs (created_at) WHERE status IN ('queued', 'running');
+
+CREATE TABLE IF NOT EXISTS batch_items (
+    job_id     text        NOT NULL REFERENCES batch_jobs (id) ON DELETE CASCADE,
+    line       integer     NOT NULL,
+    custom_id  text        NOT NULL DEFAULT '',
+    request    jsonb       NOT NULL,
+    status     text        NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    claimed_at timestamptz,
+    result     jsonb,
+    PRIMARY KEY (job_id, line)
+);
+
+CREATE INDEX IF NOT EXISTS batch_items_status_idx ON batch_items (job_id, status, line);
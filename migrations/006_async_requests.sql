@@ -0,0 +1,30 @@
+-- Async chat requests and their callback delivery state
+CREATE TABLE IF NOT EXISTS async_requests (
+    id                text        PRIMARY KEY,
+    api_key           text        NOT NULL,
+    status            text        NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'completed', 'failed')),
+    request           jsonb       NOT NULL,
+    headers           jsonb       NOT NULL DEFAULT '{}', -- Forwarded X-Nexus-* request headers
+    status_code       integer,
+    response          jsonb,
+    result_headers    jsonb,
+    error             text,
+    claimed_at        timestamptz,
+    created_at        timestamptz NOT NULL DEFAULT now(),
+    finished_at       timestamptz,
+    callback_status   text CHECK (callback_status IN ('pending', 'delivered', 'failed')), -- NULL: no callback registered
+    callback_attempts integer     NOT NULL DEFAULT 0,
+    callback_next_at  timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS async_requests_open_idx ON async_requests (created_at) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS async_requests_callback_idx ON async_requests (callback_next_at) WHERE callback_status = 'pending';
+
+-- One callback URL per key: HandleCallback upserts ON CONFLICT (api_key)
+CREATE TABLE IF NOT EXISTS callbacks (
+    api_key    text        PRIMARY KEY,
+    url        text        NOT NULL,
+    secret     text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
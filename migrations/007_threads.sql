@@ -0,0 +1,22 @@
+-- Server-side conversation threads
+CREATE TABLE IF NOT EXISTS threads (
+    id         text        PRIMARY KEY,
+    api_key    text        NOT NULL,
+    title      text        NOT NULL DEFAULT '',
+    model      text        NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS threads_api_key_idx ON threads (api_key, updated_at DESC);
+
+-- Messages in insertion order (ORDER BY id)
+CREATE TABLE IF NOT EXISTS thread_messages (
+    id         bigserial   PRIMARY KEY,
+    thread_id  text        NOT NULL REFERENCES threads (id) ON DELETE CASCADE,
+    role       text        NOT NULL,
+    content    text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS thread_messages_thread_idx ON thread_messages (thread_id, id);
@@ -0,0 +1,26 @@
+-- Prompt templates: one row per immutable version. The primary key turns
+-- two concurrent saves of the same next version into an error.
+CREATE TABLE IF NOT EXISTS prompt_templates (
+    id          text             NOT NULL,
+    version     integer          NOT NULL CHECK (version > 0),
+    description text             NOT NULL DEFAULT '',
+    messages    jsonb            NOT NULL,
+    variables   jsonb            NOT NULL DEFAULT 'null', -- Name → default; null = required
+    model       text             NOT NULL DEFAULT '',
+    temperature double precision,
+    tools       jsonb            NOT NULL DEFAULT 'null',
+    created_at  timestamptz      NOT NULL DEFAULT now(),
+    PRIMARY KEY (id, version)
+);
+
+-- Which template version answered a request (LogTemplateUse)
+CREATE TABLE IF NOT EXISTS template_usage (
+    id          bigserial   PRIMARY KEY,
+    api_key     text        NOT NULL,
+    template_id text        NOT NULL,
+    version     integer     NOT NULL,
+    model       text        NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS template_usage_template_idx ON template_usage (template_id, version, created_at);
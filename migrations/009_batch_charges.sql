@@ -0,0 +1,3 @@
+-- A batch item's credit is taken when it is claimed and stays with the item,
+-- so a re-claimed item reuses it; a failed item gives it back
+ALTER TABLE batch_items ADD COLUMN IF NOT EXISTS charged boolean NOT NULL DEFAULT false;
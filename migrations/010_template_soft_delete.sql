@@ -0,0 +1,4 @@
+-- Deleting a template version only marks it, so its number is never handed
+-- out again. Templates no longer carry tools.
+ALTER TABLE prompt_templates ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+ALTER TABLE prompt_templates DROP COLUMN IF EXISTS tools;